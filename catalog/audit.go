@@ -0,0 +1,97 @@
+package catalog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const auditFileName string = "audit.log"
+
+// AuditEvent records the change of a field of an entry of the catalog
+type AuditEvent struct {
+	Time  time.Time `json:"time"`
+	Actor string    `json:"actor"`
+	Path  string    `json:"path"`
+	Hash  string    `json:"hash"`
+	Field string    `json:"field"`
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+}
+
+// changes returns an event for every field that is different between the entries
+func changes(previous Entry, entry Entry) []AuditEvent {
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+
+	var events []AuditEvent
+	add := func(field string, from string, to string) {
+		if from != to {
+			events = append(events, AuditEvent{Field: field, From: from, To: to})
+		}
+	}
+	add("favourite", strconv.FormatBool(previous.Favourite), strconv.FormatBool(entry.Favourite))
+	add("rating", strconv.Itoa(previous.Rating), strconv.Itoa(entry.Rating))
+	add("caption", previous.Caption, entry.Caption)
+	add("creationTime", formatTime(previous.CreationTime), formatTime(entry.CreationTime))
+	add("timeZone", previous.TimeZone, entry.TimeZone)
+	add("archived", strconv.FormatBool(previous.Archived), strconv.FormatBool(entry.Archived))
+	return events
+}
+
+// appendAudit appends the events to the audit file as JSON lines
+func appendAudit(filePath string, events []AuditEvent) error {
+	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening audit file %s. %w", filePath, err)
+	}
+	defer f.Close()
+
+	encoder := json.NewEncoder(f)
+	for _, event := range events {
+		err := encoder.Encode(event)
+		if err != nil {
+			return fmt.Errorf("error writing audit event. %w", err)
+		}
+	}
+	return nil
+}
+
+// readAudit returns the events of the audit file that match the filter, oldest first
+func readAudit(filePath string, filter func(event AuditEvent) bool) ([]AuditEvent, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error opening audit file %s. %w", filePath, err)
+	}
+	defer f.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event AuditEvent
+		err := json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			// Skip lines that could have been partially written
+			continue
+		}
+		if filter(event) {
+			events = append(events, event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading audit file %s. %w", filePath, err)
+	}
+	return events, nil
+}
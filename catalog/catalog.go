@@ -0,0 +1,157 @@
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"davidc.es/jag/jsonfile"
+)
+
+const catalogFileName string = "catalog.json"
+
+// Entry contains the data of an item of the library managed by the server.
+// The library is treated as read-only so this data is stored outside of it.
+type Entry struct {
+	Favourite bool `json:"favourite,omitempty"`
+	// From 1 to 5, 0 when the item is not rated
+	Rating int `json:"rating,omitempty"`
+	// Replaces the description of the item metadata
+	Caption string `json:"caption,omitempty"`
+	// Replaces the creation time extracted from the item
+	CreationTime time.Time `json:"creationTime,omitzero"`
+	// Name of the time zone of the creation time like Europe/Madrid
+	TimeZone string `json:"timeZone,omitempty"`
+	// Archived items are hidden from the library but not deleted
+	Archived bool `json:"archived,omitempty"`
+}
+
+func (e Entry) isEmpty() bool {
+	return e == Entry{}
+}
+
+// Catalog stores the entries of the items of the library by content hash so they survive renames.
+type Catalog interface {
+	Hash(filePath string) (string, error)
+	Entry(hash string) Entry
+	Entries() map[string]Entry
+	// Update modifies the entry of the hash recording in the audit log who changed which fields of the item of the path
+	Update(hash string, actor string, itemPath string, update func(entry *Entry)) error
+	// History returns the audit events of the entry of the hash, oldest first
+	History(hash string) ([]AuditEvent, error)
+}
+
+type fileCatalog struct {
+	mu        sync.RWMutex
+	filePath  string
+	auditPath string
+	entries   map[string]Entry
+	hashes    *hashCache
+}
+
+// New loads the catalog stored in the data path, creating the data path if it does not exist.
+func New(dataPath string) (Catalog, error) {
+	err := os.MkdirAll(dataPath, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("error creating data directory %s. %w", dataPath, err)
+	}
+
+	c := &fileCatalog{
+		filePath:  path.Join(dataPath, catalogFileName),
+		auditPath: path.Join(dataPath, auditFileName),
+		entries:   make(map[string]Entry),
+		hashes:    newHashCache(),
+	}
+	err = readJSON(c.filePath, &c.entries)
+	if err != nil {
+		return nil, fmt.Errorf("error reading catalog. %w", err)
+	}
+	return c, nil
+}
+
+func (c *fileCatalog) Hash(filePath string) (string, error) {
+	return c.hashes.hash(filePath)
+}
+
+func (c *fileCatalog) Entry(hash string) Entry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.entries[hash]
+}
+
+func (c *fileCatalog) Entries() map[string]Entry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entries := make(map[string]Entry, len(c.entries))
+	for hash, entry := range c.entries {
+		entries[hash] = entry
+	}
+	return entries
+}
+
+func (c *fileCatalog) Update(hash string, actor string, itemPath string, update func(entry *Entry)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	previous, existed := c.entries[hash]
+	entry := previous
+	update(&entry)
+	events := changes(previous, entry)
+	if len(events) == 0 {
+		return nil
+	}
+	if entry.isEmpty() {
+		delete(c.entries, hash)
+	} else {
+		c.entries[hash] = entry
+	}
+
+	err := jsonfile.Write(c.filePath, c.entries)
+	if err != nil {
+		// Keep the memory consistent with the disk
+		if existed {
+			c.entries[hash] = previous
+		} else {
+			delete(c.entries, hash)
+		}
+		return fmt.Errorf("error writing catalog. %w", err)
+	}
+
+	now := time.Now().UTC()
+	for i := range events {
+		events[i].Time = now
+		events[i].Actor = actor
+		events[i].Path = itemPath
+		events[i].Hash = hash
+	}
+	err = appendAudit(c.auditPath, events)
+	if err != nil {
+		return fmt.Errorf("error writing audit. %w", err)
+	}
+	return nil
+}
+
+func (c *fileCatalog) History(hash string) ([]AuditEvent, error) {
+	return readAudit(c.auditPath, func(event AuditEvent) bool { return event.Hash == hash })
+}
+
+// readJSON decodes the file into v. A file that does not exist leaves v untouched.
+func readJSON(filePath string, v any) error {
+	b, err := os.ReadFile(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("error reading %s. %w", filePath, err)
+	}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return fmt.Errorf("error decoding %s. %w", filePath, err)
+	}
+	return nil
+}
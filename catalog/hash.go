@@ -0,0 +1,85 @@
+package catalog
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Number of bytes read from the start and from the end of the file to calculate its hash
+const hashSampleSize int64 = 64 * 1024
+
+type cachedHash struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+// hashCache avoids reading the files again while their size and modification time do not change
+type hashCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedHash
+}
+
+func newHashCache() *hashCache {
+	return &hashCache{entries: make(map[string]cachedHash)}
+}
+
+func (c *hashCache) hash(filePath string) (string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", fmt.Errorf("error reading file info of %s. %w", filePath, err)
+	}
+
+	c.mu.Lock()
+	cached, ok := c.entries[filePath]
+	c.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.hash, nil
+	}
+
+	hash, err := Hash(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.entries[filePath] = cachedHash{size: info.Size(), modTime: info.ModTime(), hash: hash}
+	c.mu.Unlock()
+	return hash, nil
+}
+
+// Hash identifies the content of a file. To be able to hash big videos on every scan only the size,
+// the start and the end of the file are hashed, which is enough to tell photos and videos apart.
+func Hash(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("error opening file %s. %w", filePath, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("error reading file info of %s. %w", filePath, err)
+	}
+
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, info.Size())
+	if info.Size() <= 2*hashSampleSize {
+		_, err = io.Copy(h, f)
+	} else {
+		_, err = io.CopyN(h, f, hashSampleSize)
+		if err == nil {
+			_, err = io.Copy(h, io.NewSectionReader(f, info.Size()-hashSampleSize, hashSampleSize))
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading file %s. %w", filePath, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
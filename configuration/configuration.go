@@ -2,31 +2,85 @@ package configuration
 
 import (
 	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
+	"path"
 	"strconv"
+	"strings"
 )
 
 type Configuration interface {
 	ListenAddress() string
 	ListenPort() string
+	PublicURL() string
 	SigningKey() string
+	VerificationKeys() []string
+	SessionStore() string
 	EncryptedPassword() string
+	AdminUsername() string
 	MaxSessionAgeSeconds() int
+	RememberDays() int
+	RequireAdmin2FA() bool
+	OIDCIssuer() string
+	OIDCClientID() string
+	OIDCClientSecret() string
+	OIDCScopes() []string
+	OIDCName() string
+	OIDCUsernameClaim() string
+	OIDCGroupsClaim() string
+	OIDCGroupRoles() map[string]string
+	OIDCDefaultRole() string
 	LibraryPath() string
 	ThumbnailsPath() string
+	DataPath() string
+	WriteXMPSidecars() bool
+	TrashPath() string
+	StagingPath() string
+	MaxUploadSizeMB() int
+	UploadExpirationHours() int
+	InboxPath() string
+	ImportNamePattern() string
+	WebDAVWritable() bool
+	AllowDelete() bool
+	TrashRetentionDays() int
 }
 
 type configuration struct {
-	listenAddress        string
-	listenPort           string
-	signingKey           string
-	encryptedPassword    string
-	maxSessionAgeSeconds int
-	libraryPath          string
-	thumbnailsPath       string
+	listenAddress         string
+	listenPort            string
+	publicURL             string
+	signingKey            string
+	verificationKeys      []string
+	sessionStore          string
+	encryptedPassword     string
+	adminUsername         string
+	maxSessionAgeSeconds  int
+	rememberDays          int
+	requireAdmin2FA       bool
+	oidcIssuer            string
+	oidcClientID          string
+	oidcClientSecret      string
+	oidcScopes            []string
+	oidcName              string
+	oidcUsernameClaim     string
+	oidcGroupsClaim       string
+	oidcGroupRoles        map[string]string
+	oidcDefaultRole       string
+	libraryPath           string
+	thumbnailsPath        string
+	dataPath              string
+	writeXMPSidecars      bool
+	allowDelete           bool
+	trashRetentionDays    int
+	maxUploadSizeMB       int
+	uploadExpirationHours int
+	inboxPath             string
+	importNamePattern     string
+	webDAVWritable        bool
 }
 
 func (c configuration) ListenAddress() string {
@@ -37,18 +91,92 @@ func (c configuration) ListenPort() string {
 	return c.listenPort
 }
 
+// PublicURL is the URL the users open the gallery with like https://photos.example.com, empty to take it from the requests
+func (c configuration) PublicURL() string {
+	return c.publicURL
+}
+
 func (c configuration) SigningKey() string {
 	return c.signingKey
 }
 
+// VerificationKeys are the previous signing keys, the cookies signed with them are still accepted after rotating the signing key
+func (c configuration) VerificationKeys() []string {
+	return c.verificationKeys
+}
+
+// SessionStore is where the sessions are kept, in the data path with file, in memory with memory
+// or in the signed cookies themselves with signed
+func (c configuration) SessionStore() string {
+	return c.sessionStore
+}
+
 func (c configuration) EncryptedPassword() string {
 	return c.encryptedPassword
 }
 
+// AdminUsername is the username of the admin whose password is the encrypted password
+func (c configuration) AdminUsername() string {
+	return c.adminUsername
+}
+
 func (c configuration) MaxSessionAgeSeconds() int {
 	return c.maxSessionAgeSeconds
 }
 
+// RequireAdmin2FA makes the admins set up the two-factor authentication before logging in
+func (c configuration) RequireAdmin2FA() bool {
+	return c.requireAdmin2FA
+}
+
+// RememberDays is the time the remembered devices stay logged in without being used, zero disables them
+func (c configuration) RememberDays() int {
+	return c.rememberDays
+}
+
+// OIDCIssuer is the URL of the OpenID Connect provider the users can log in with, empty to disable the single sign-on
+func (c configuration) OIDCIssuer() string {
+	return c.oidcIssuer
+}
+
+func (c configuration) OIDCClientID() string {
+	return c.oidcClientID
+}
+
+// OIDCClientSecret is empty when the gallery is registered as a public client
+func (c configuration) OIDCClientSecret() string {
+	return c.oidcClientSecret
+}
+
+func (c configuration) OIDCScopes() []string {
+	return c.oidcScopes
+}
+
+// OIDCName is the name of the provider shown in the login button
+func (c configuration) OIDCName() string {
+	return c.oidcName
+}
+
+// OIDCUsernameClaim is the claim of the ID token with the username of the user created the first time they log in
+func (c configuration) OIDCUsernameClaim() string {
+	return c.oidcUsernameClaim
+}
+
+// OIDCGroupsClaim is the claim of the ID token with the groups of the user
+func (c configuration) OIDCGroupsClaim() string {
+	return c.oidcGroupsClaim
+}
+
+// OIDCGroupRoles are the roles of the members of the groups of the provider by group
+func (c configuration) OIDCGroupRoles() map[string]string {
+	return c.oidcGroupRoles
+}
+
+// OIDCDefaultRole is the role of the users that are not in any group of the roles, empty to refuse them
+func (c configuration) OIDCDefaultRole() string {
+	return c.oidcDefaultRole
+}
+
 func (c configuration) LibraryPath() string {
 	return c.libraryPath
 }
@@ -57,6 +185,52 @@ func (c configuration) ThumbnailsPath() string {
 	return c.thumbnailsPath
 }
 
+func (c configuration) DataPath() string {
+	return c.dataPath
+}
+
+func (c configuration) WriteXMPSidecars() bool {
+	return c.writeXMPSidecars
+}
+
+func (c configuration) TrashPath() string {
+	return path.Join(c.dataPath, "trash")
+}
+
+// StagingPath is where the uploads are stored until they are imported into the library
+func (c configuration) StagingPath() string {
+	return path.Join(c.dataPath, "staging")
+}
+
+func (c configuration) MaxUploadSizeMB() int {
+	return c.maxUploadSizeMB
+}
+
+// UploadExpirationHours is the time the resumable uploads are kept without receiving data, zero keeps them forever
+func (c configuration) UploadExpirationHours() int {
+	return c.uploadExpirationHours
+}
+
+func (c configuration) InboxPath() string {
+	return c.inboxPath
+}
+
+func (c configuration) ImportNamePattern() string {
+	return c.importNamePattern
+}
+
+func (c configuration) WebDAVWritable() bool {
+	return c.webDAVWritable
+}
+
+func (c configuration) AllowDelete() bool {
+	return c.allowDelete
+}
+
+func (c configuration) TrashRetentionDays() int {
+	return c.trashRetentionDays
+}
+
 func New() (Configuration, error) {
 	listenAddressEnvVar, exists := os.LookupEnv("LISTEN_ADDRESS")
 	if !exists {
@@ -70,22 +244,42 @@ func New() (Configuration, error) {
 	}
 	listenPort := flag.String("listen-port", listenPortEnvVar, "Listen port of the service")
 
+	publicURLEnvVar, exists := os.LookupEnv("PUBLIC_URL")
+	if !exists {
+		publicURLEnvVar = ""
+	}
+	publicURL := flag.String("public-url", publicURLEnvVar, "URL the users open the gallery with like https://photos.example.com, taken from the requests if empty")
+
 	signingKeyEnvVar, exists := os.LookupEnv("SIGNING_KEY")
 	if !exists {
-		// Make a byte array of size 32
-		b := make([]byte, 32)
-		// Populate the array with random numbers
-		// Ignore the error since it cannot fail. See source for more details
-		rand.Read(b)
-		signingKeyEnvVar = string(b)
+		// Generated and stored in the data path so the sessions survive the restarts
+		signingKeyEnvVar = ""
+	}
+	signingKey := flag.String("signing-key", signingKeyEnvVar, "Signing key to use for the session, generated in the data path if empty")
+
+	verificationKeysEnvVar, exists := os.LookupEnv("VERIFICATION_KEYS")
+	if !exists {
+		verificationKeysEnvVar = ""
 	}
-	signingKey := flag.String("signing-key", signingKeyEnvVar, "Signing key to use for the session")
+	verificationKeys := flag.String("verification-keys", verificationKeysEnvVar, "Comma separated previous signing keys still accepted to verify the sessions")
+
+	sessionStoreEnvVar, exists := os.LookupEnv("SESSION_STORE")
+	if !exists {
+		sessionStoreEnvVar = "file"
+	}
+	sessionStore := flag.String("session-store", sessionStoreEnvVar, "Where the sessions are stored, file to keep them in the data path across restarts, memory or signed to keep them in the cookies")
 
 	encryptedPasswordEnvVar, exists := os.LookupEnv("ENCRYPTED_PASSWORD")
 	if !exists {
 		encryptedPasswordEnvVar = ""
 	}
-	encryptedPassword := flag.String("encrypted-password", encryptedPasswordEnvVar, "bcrypt encrypted password")
+	encryptedPassword := flag.String("encrypted-password", encryptedPasswordEnvVar, "bcrypt encrypted password of the admin")
+
+	adminUsernameEnvVar, exists := os.LookupEnv("ADMIN_USERNAME")
+	if !exists {
+		adminUsernameEnvVar = "admin"
+	}
+	adminUsername := flag.String("admin-username", adminUsernameEnvVar, "Username of the admin that logs in with the encrypted password")
 
 	maxSessionAgeSecondsEnvVarStr, exists := os.LookupEnv("MAX_SESSION_AGE_SECONDS")
 	if !exists {
@@ -97,6 +291,80 @@ func New() (Configuration, error) {
 	}
 	maxSessionAgeSeconds := flag.Int("max-session-age-seconds", maxSessionAgeSecondsEnvVar, "Max time in seconds the session will be valid for")
 
+	rememberDaysEnvVarStr, exists := os.LookupEnv("REMEMBER_DAYS")
+	if !exists {
+		rememberDaysEnvVarStr = "30"
+	}
+	rememberDaysEnvVar, err := strconv.Atoi(rememberDaysEnvVarStr)
+	if err != nil {
+		return nil, fmt.Errorf("REMEMBER_DAYS must be a number. %w", err)
+	}
+	rememberDays := flag.Int("remember-days", rememberDaysEnvVar, "Days the remembered devices stay logged in without being used, 0 to disable remembering devices")
+
+	requireAdmin2FAEnvVarStr, exists := os.LookupEnv("REQUIRE_ADMIN_2FA")
+	if !exists {
+		requireAdmin2FAEnvVarStr = "false"
+	}
+	requireAdmin2FAEnvVar, err := strconv.ParseBool(requireAdmin2FAEnvVarStr)
+	if err != nil {
+		return nil, fmt.Errorf("REQUIRE_ADMIN_2FA must be a boolean. %w", err)
+	}
+	requireAdmin2FA := flag.Bool("require-admin-2fa", requireAdmin2FAEnvVar, "Require the admins to log in with two-factor authentication")
+
+	oidcIssuerEnvVar, exists := os.LookupEnv("OIDC_ISSUER")
+	if !exists {
+		oidcIssuerEnvVar = ""
+	}
+	oidcIssuer := flag.String("oidc-issuer", oidcIssuerEnvVar, "Issuer URL of the OpenID Connect provider to log in with. Disabled when empty")
+
+	oidcClientIDEnvVar, exists := os.LookupEnv("OIDC_CLIENT_ID")
+	if !exists {
+		oidcClientIDEnvVar = ""
+	}
+	oidcClientID := flag.String("oidc-client-id", oidcClientIDEnvVar, "Client ID of the gallery in the OpenID Connect provider")
+
+	oidcClientSecretEnvVar, exists := os.LookupEnv("OIDC_CLIENT_SECRET")
+	if !exists {
+		oidcClientSecretEnvVar = ""
+	}
+	oidcClientSecret := flag.String("oidc-client-secret", oidcClientSecretEnvVar, "Client secret of the gallery in the OpenID Connect provider, empty for a public client")
+
+	oidcScopesEnvVar, exists := os.LookupEnv("OIDC_SCOPES")
+	if !exists {
+		oidcScopesEnvVar = "openid profile groups"
+	}
+	oidcScopes := flag.String("oidc-scopes", oidcScopesEnvVar, "Space separated scopes requested to the OpenID Connect provider")
+
+	oidcNameEnvVar, exists := os.LookupEnv("OIDC_NAME")
+	if !exists {
+		oidcNameEnvVar = "single sign-on"
+	}
+	oidcName := flag.String("oidc-name", oidcNameEnvVar, "Name of the OpenID Connect provider shown in the login button")
+
+	oidcUsernameClaimEnvVar, exists := os.LookupEnv("OIDC_USERNAME_CLAIM")
+	if !exists {
+		oidcUsernameClaimEnvVar = "preferred_username"
+	}
+	oidcUsernameClaim := flag.String("oidc-username-claim", oidcUsernameClaimEnvVar, "Claim of the ID token with the username")
+
+	oidcGroupsClaimEnvVar, exists := os.LookupEnv("OIDC_GROUPS_CLAIM")
+	if !exists {
+		oidcGroupsClaimEnvVar = "groups"
+	}
+	oidcGroupsClaim := flag.String("oidc-groups-claim", oidcGroupsClaimEnvVar, "Claim of the ID token with the groups of the user")
+
+	oidcGroupRolesEnvVar, exists := os.LookupEnv("OIDC_GROUP_ROLES")
+	if !exists {
+		oidcGroupRolesEnvVar = ""
+	}
+	oidcGroupRoles := flag.String("oidc-group-roles", oidcGroupRolesEnvVar, "Comma separated roles of the groups of the OpenID Connect provider like parents=admin,family=viewer")
+
+	oidcDefaultRoleEnvVar, exists := os.LookupEnv("OIDC_DEFAULT_ROLE")
+	if !exists {
+		oidcDefaultRoleEnvVar = ""
+	}
+	oidcDefaultRole := flag.String("oidc-default-role", oidcDefaultRoleEnvVar, "Role of the users of the OpenID Connect provider without a group of the roles, empty to refuse them")
+
 	libraryPathEnvVar, exists := os.LookupEnv("LIBRARY_PATH")
 	if !exists {
 		libraryPathEnvVar = "library"
@@ -109,19 +377,224 @@ func New() (Configuration, error) {
 	}
 	thumbnailsPath := flag.String("thumbnails-path", thumbnailsPathEnvVar, "Path to store the thumbnails")
 
+	dataPathEnvVar, exists := os.LookupEnv("DATA_PATH")
+	if !exists {
+		dataPathEnvVar = "data"
+	}
+	dataPath := flag.String("data-path", dataPathEnvVar, "Path to store the data managed by the server like favourites and ratings")
+
+	writeXMPSidecarsEnvVarStr, exists := os.LookupEnv("WRITE_XMP_SIDECARS")
+	if !exists {
+		writeXMPSidecarsEnvVarStr = "false"
+	}
+	writeXMPSidecarsEnvVar, err := strconv.ParseBool(writeXMPSidecarsEnvVarStr)
+	if err != nil {
+		return nil, fmt.Errorf("WRITE_XMP_SIDECARS must be a boolean. %w", err)
+	}
+	writeXMPSidecars := flag.Bool("write-xmp-sidecars", writeXMPSidecarsEnvVar, "Write the ratings to XMP sidecars next to the images of the library")
+
+	allowDeleteEnvVarStr, exists := os.LookupEnv("ALLOW_DELETE")
+	if !exists {
+		allowDeleteEnvVarStr = "false"
+	}
+	allowDeleteEnvVar, err := strconv.ParseBool(allowDeleteEnvVarStr)
+	if err != nil {
+		return nil, fmt.Errorf("ALLOW_DELETE must be a boolean. %w", err)
+	}
+	allowDelete := flag.Bool("allow-delete", allowDeleteEnvVar, "Allow moving items of the library to the trash")
+
+	trashRetentionDaysEnvVarStr, exists := os.LookupEnv("TRASH_RETENTION_DAYS")
+	if !exists {
+		trashRetentionDaysEnvVarStr = "30"
+	}
+	trashRetentionDaysEnvVar, err := strconv.Atoi(trashRetentionDaysEnvVarStr)
+	if err != nil {
+		return nil, fmt.Errorf("TRASH_RETENTION_DAYS must be a number. %w", err)
+	}
+	trashRetentionDays := flag.Int("trash-retention-days", trashRetentionDaysEnvVar, "Days the items stay in the trash before being deleted permanently")
+
+	maxUploadSizeMBEnvVarStr, exists := os.LookupEnv("MAX_UPLOAD_SIZE_MB")
+	if !exists {
+		maxUploadSizeMBEnvVarStr = "10240"
+	}
+	maxUploadSizeMBEnvVar, err := strconv.Atoi(maxUploadSizeMBEnvVarStr)
+	if err != nil {
+		return nil, fmt.Errorf("MAX_UPLOAD_SIZE_MB must be a number. %w", err)
+	}
+	maxUploadSizeMB := flag.Int("max-upload-size-mb", maxUploadSizeMBEnvVar, "Max size in megabytes of the resumable uploads")
+
+	uploadExpirationHoursEnvVarStr, exists := os.LookupEnv("UPLOAD_EXPIRATION_HOURS")
+	if !exists {
+		uploadExpirationHoursEnvVarStr = "24"
+	}
+	uploadExpirationHoursEnvVar, err := strconv.Atoi(uploadExpirationHoursEnvVarStr)
+	if err != nil {
+		return nil, fmt.Errorf("UPLOAD_EXPIRATION_HOURS must be a number. %w", err)
+	}
+	uploadExpirationHours := flag.Int("upload-expiration-hours", uploadExpirationHoursEnvVar, "Hours the unfinished resumable uploads are kept without receiving data, 0 to keep them forever")
+
+	inboxPathEnvVar, exists := os.LookupEnv("INBOX_PATH")
+	if !exists {
+		inboxPathEnvVar = ""
+	}
+	inboxPath := flag.String("inbox-path", inboxPathEnvVar, "Path of a folder whose files are imported into the library periodically. Disabled when empty")
+
+	importNamePatternEnvVar, exists := os.LookupEnv("IMPORT_NAME_PATTERN")
+	if !exists {
+		importNamePatternEnvVar = ""
+	}
+	importNamePattern := flag.String("import-name-pattern", importNamePatternEnvVar, "Pattern to rename the imported files like IMG_{date}_{time}. Empty keeps the original names")
+
+	webDAVWritableEnvVarStr, exists := os.LookupEnv("WEBDAV_WRITABLE")
+	if !exists {
+		webDAVWritableEnvVarStr = "false"
+	}
+	webDAVWritableEnvVar, err := strconv.ParseBool(webDAVWritableEnvVarStr)
+	if err != nil {
+		return nil, fmt.Errorf("WEBDAV_WRITABLE must be a boolean. %w", err)
+	}
+	webDAVWritable := flag.Bool("webdav-writable", webDAVWritableEnvVar, "Allow adding files to the library through WebDAV")
+
 	flag.Parse()
 
-	if len(*encryptedPassword) == 0 {
+	// The import command does not serve the gallery
+	if len(*encryptedPassword) == 0 && flag.Arg(0) != "import" {
 		return nil, errors.New("encrypted password is mandatory and must not be empty")
 	}
+	if *publicURL != "" {
+		u, err := url.Parse(*publicURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("public URL must be like https://photos.example.com, not %s", *publicURL)
+		}
+		*publicURL = u.Scheme + "://" + u.Host
+	}
+	if *oidcIssuer != "" {
+		u, err := url.Parse(*oidcIssuer)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return nil, fmt.Errorf("OIDC issuer must be like https://auth.example.com, not %s", *oidcIssuer)
+		}
+		if *oidcClientID == "" {
+			return nil, errors.New("OIDC client ID is mandatory with an OIDC issuer")
+		}
+	}
+	groupRoles, err := splitGroupRoles(*oidcGroupRoles)
+	if err != nil {
+		return nil, err
+	}
+	if *sessionStore != "file" && *sessionStore != "memory" && *sessionStore != "signed" {
+		return nil, fmt.Errorf("session store must be file, memory or signed, not %s", *sessionStore)
+	}
+	if len(*signingKey) == 0 && flag.Arg(0) != "import" {
+		key, err := loadSigningKey(*dataPath)
+		if err != nil {
+			return nil, err
+		}
+		*signingKey = key
+	}
 
 	return configuration{
-		listenAddress:        *listenAddress,
-		listenPort:           *listenPort,
-		signingKey:           *signingKey,
-		encryptedPassword:    *encryptedPassword,
-		maxSessionAgeSeconds: *maxSessionAgeSeconds,
-		libraryPath:          *libraryPath,
-		thumbnailsPath:       *thumbnailsPath,
+		listenAddress:         *listenAddress,
+		listenPort:            *listenPort,
+		publicURL:             *publicURL,
+		signingKey:            *signingKey,
+		verificationKeys:      splitKeys(*verificationKeys),
+		sessionStore:          *sessionStore,
+		encryptedPassword:     *encryptedPassword,
+		adminUsername:         *adminUsername,
+		maxSessionAgeSeconds:  *maxSessionAgeSeconds,
+		rememberDays:          *rememberDays,
+		requireAdmin2FA:       *requireAdmin2FA,
+		oidcIssuer:            *oidcIssuer,
+		oidcClientID:          *oidcClientID,
+		oidcClientSecret:      *oidcClientSecret,
+		oidcScopes:            strings.Fields(*oidcScopes),
+		oidcName:              *oidcName,
+		oidcUsernameClaim:     *oidcUsernameClaim,
+		oidcGroupsClaim:       *oidcGroupsClaim,
+		oidcGroupRoles:        groupRoles,
+		oidcDefaultRole:       *oidcDefaultRole,
+		libraryPath:           *libraryPath,
+		thumbnailsPath:        *thumbnailsPath,
+		dataPath:              *dataPath,
+		writeXMPSidecars:      *writeXMPSidecars,
+		allowDelete:           *allowDelete,
+		trashRetentionDays:    *trashRetentionDays,
+		maxUploadSizeMB:       *maxUploadSizeMB,
+		uploadExpirationHours: *uploadExpirationHours,
+		inboxPath:             *inboxPath,
+		importNamePattern:     *importNamePattern,
+		webDAVWritable:        *webDAVWritable,
 	}, nil
 }
+
+// Name of the file of the data path with the signing key generated when none is configured
+const signingKeyFileName string = "signing.key"
+
+// loadSigningKey reads the signing key of the data path, generating and writing it the first time
+func loadSigningKey(dataPath string) (string, error) {
+	keyPath := path.Join(dataPath, signingKeyFileName)
+	b, err := os.ReadFile(keyPath)
+	if err == nil {
+		if len(b) == 0 {
+			return "", fmt.Errorf("signing key %s is empty", keyPath)
+		}
+		return string(b), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("error reading signing key %s. %w", keyPath, err)
+	}
+
+	err = os.MkdirAll(dataPath, os.ModePerm)
+	if err != nil {
+		return "", fmt.Errorf("error creating data directory %s. %w", dataPath, err)
+	}
+	// Make a byte array of size 32
+	b = make([]byte, 32)
+	// Populate the array with random numbers
+	// Ignore the error since it cannot fail. See source for more details
+	rand.Read(b)
+	key := hex.EncodeToString(b)
+	// Only create the file if it does not exist so a key written by another process is not replaced
+	f, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return loadSigningKey(dataPath)
+		}
+		return "", fmt.Errorf("error creating signing key %s. %w", keyPath, err)
+	}
+	_, err = f.WriteString(key)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("error writing signing key %s. %w", keyPath, err)
+	}
+	return key, nil
+}
+
+func splitKeys(keys string) []string {
+	var result []string
+	for _, key := range strings.Split(keys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// splitGroupRoles parses the roles of the groups like parents=admin,family=viewer
+func splitGroupRoles(groupRoles string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, groupRole := range strings.Split(groupRoles, ",") {
+		if strings.TrimSpace(groupRole) == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(groupRole, "=")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if !ok || group == "" || role == "" {
+			return nil, fmt.Errorf("OIDC group roles must be like parents=admin,family=viewer, not %s", groupRoles)
+		}
+		result[group] = role
+	}
+	return result, nil
+}
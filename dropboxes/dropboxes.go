@@ -0,0 +1,322 @@
+package dropboxes
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"davidc.es/jag/jsonfile"
+)
+
+const dropBoxesFileName string = "dropboxes.json"
+
+// Name of the folder of the data path with the files waiting for moderation
+const moderationDirName string = "moderation"
+
+var (
+	ErrNotFound      = errors.New("drop box not found")
+	ErrQuotaExceeded = errors.New("the drop box is full")
+	ErrTooBig        = errors.New("the file is bigger than the space left in the drop box")
+)
+
+// DropBox lets anyone with the link of the token upload files to a folder of the library.
+// The uploads wait in the moderation queue until they are approved.
+type DropBox struct {
+	Token        string    `json:"token"`
+	Title        string    `json:"title"`
+	Folder       string    `json:"folder"`
+	CreatedBy    string    `json:"createdBy"`
+	CreationTime time.Time `json:"creationTime"`
+	// Zero when the drop box does not expire
+	Expiration time.Time `json:"expiration,omitzero"`
+	// Quotas of the drop box, zero when there is no limit
+	MaxFiles int   `json:"maxFiles,omitempty"`
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	// Files and bytes received so far
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (d DropBox) Expired() bool {
+	return !d.Expiration.IsZero() && time.Now().After(d.Expiration)
+}
+
+// RemainingBytes returns the bytes that can still be uploaded, -1 when there is no limit
+func (d DropBox) RemainingBytes() int64 {
+	if d.MaxBytes == 0 {
+		return -1
+	}
+	return max(d.MaxBytes-d.Bytes, 0)
+}
+
+// RemainingFiles returns the files that can still be uploaded, -1 when there is no limit
+func (d DropBox) RemainingFiles() int {
+	if d.MaxFiles == 0 {
+		return -1
+	}
+	return max(d.MaxFiles-d.Files, 0)
+}
+
+// Upload is a file received in a drop box waiting to be approved into the folder of the drop box
+type Upload struct {
+	ID           string    `json:"id"`
+	Token        string    `json:"token"`
+	DropBoxTitle string    `json:"dropBoxTitle"`
+	Folder       string    `json:"folder"`
+	Name         string    `json:"name"`
+	Uploader     string    `json:"uploader,omitempty"`
+	Size         int64     `json:"size"`
+	UploadTime   time.Time `json:"uploadTime"`
+}
+
+// Store keeps the drop boxes and their uploads. The expired drop boxes are removed the next time the store is written,
+// their uploads are kept until they are moderated.
+type Store interface {
+	Create(dropBox DropBox) (DropBox, error)
+	// DropBox returns the drop box of the token, ErrNotFound when it does not exist or it expired
+	DropBox(token string) (DropBox, error)
+	// DropBoxes returns the drop boxes that did not expire, newest first
+	DropBoxes() []DropBox
+	Revoke(token string) error
+	// AddUpload moves the file of the source path to the moderation queue of the drop box of the token.
+	// ErrQuotaExceeded or ErrTooBig are returned when the file does not fit in the quotas of the drop box.
+	AddUpload(token string, sourcePath string, name string, uploader string) (Upload, error)
+	// Uploads returns the uploads waiting for moderation, oldest first
+	Uploads() []Upload
+	Upload(id string) (Upload, error)
+	// UploadPath returns the path of the file of the upload
+	UploadPath(upload Upload) string
+	// RemoveUpload removes the upload from the queue deleting its file if it was not moved
+	RemoveUpload(id string) error
+}
+
+type fileStore struct {
+	mu             sync.RWMutex
+	filePath       string
+	moderationPath string
+	dropBoxes      map[string]DropBox
+	uploads        map[string]Upload
+}
+
+type storeFile struct {
+	DropBoxes map[string]DropBox `json:"dropBoxes"`
+	Uploads   map[string]Upload  `json:"uploads"`
+}
+
+// New loads the drop boxes stored in the data path, creating the data path if it does not exist.
+func New(dataPath string) (Store, error) {
+	s := &fileStore{
+		filePath:       path.Join(dataPath, dropBoxesFileName),
+		moderationPath: path.Join(dataPath, moderationDirName),
+		dropBoxes:      make(map[string]DropBox),
+		uploads:        make(map[string]Upload),
+	}
+	err := os.MkdirAll(s.moderationPath, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("error creating moderation directory %s. %w", s.moderationPath, err)
+	}
+
+	b, err := os.ReadFile(s.filePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading %s. %w", s.filePath, err)
+	}
+	if err == nil {
+		var f storeFile
+		err = json.Unmarshal(b, &f)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s. %w", s.filePath, err)
+		}
+		if f.DropBoxes != nil {
+			s.dropBoxes = f.DropBoxes
+		}
+		if f.Uploads != nil {
+			s.uploads = f.Uploads
+		}
+	}
+	return s, nil
+}
+
+func (s *fileStore) Create(dropBox DropBox) (DropBox, error) {
+	dropBox.Token = newID(32)
+	dropBox.CreationTime = time.Now().UTC()
+	dropBox.Files = 0
+	dropBox.Bytes = 0
+
+	err := s.update(func(dropBoxes map[string]DropBox, uploads map[string]Upload) error {
+		dropBoxes[dropBox.Token] = dropBox
+		return nil
+	})
+	if err != nil {
+		return DropBox{}, err
+	}
+	return dropBox, nil
+}
+
+func (s *fileStore) DropBox(token string) (DropBox, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dropBox, ok := s.dropBoxes[token]
+	if !ok || dropBox.Expired() {
+		return DropBox{}, ErrNotFound
+	}
+	return dropBox, nil
+}
+
+func (s *fileStore) DropBoxes() []DropBox {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var dropBoxes []DropBox
+	for _, dropBox := range s.dropBoxes {
+		if !dropBox.Expired() {
+			dropBoxes = append(dropBoxes, dropBox)
+		}
+	}
+	slices.SortFunc(dropBoxes, func(a, b DropBox) int { return b.CreationTime.Compare(a.CreationTime) })
+	return dropBoxes
+}
+
+func (s *fileStore) Revoke(token string) error {
+	return s.update(func(dropBoxes map[string]DropBox, uploads map[string]Upload) error {
+		if _, ok := dropBoxes[token]; !ok {
+			return ErrNotFound
+		}
+		delete(dropBoxes, token)
+		return nil
+	})
+}
+
+func (s *fileStore) AddUpload(token string, sourcePath string, name string, uploader string) (Upload, error) {
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return Upload{}, fmt.Errorf("error reading %s. %w", sourcePath, err)
+	}
+	upload := Upload{
+		ID:         time.Now().UTC().Format("20060102150405") + "-" + newID(8),
+		Token:      token,
+		Name:       path.Base(filepath.ToSlash(name)),
+		Uploader:   uploader,
+		Size:       info.Size(),
+		UploadTime: time.Now().UTC(),
+	}
+
+	err = s.update(func(dropBoxes map[string]DropBox, uploads map[string]Upload) error {
+		dropBox, ok := dropBoxes[token]
+		if !ok {
+			return ErrNotFound
+		}
+		if dropBox.RemainingFiles() == 0 {
+			return ErrQuotaExceeded
+		}
+		if dropBox.RemainingBytes() >= 0 && upload.Size > dropBox.RemainingBytes() {
+			return ErrTooBig
+		}
+		// Every upload is stored in its own folder so they keep their names
+		uploadPath := s.UploadPath(upload)
+		err := os.MkdirAll(path.Dir(uploadPath), os.ModePerm)
+		if err != nil {
+			return fmt.Errorf("error creating moderation directory of %s. %w", upload.Name, err)
+		}
+		err = os.Rename(sourcePath, uploadPath)
+		if err != nil {
+			return fmt.Errorf("error moving %s to the moderation queue. %w", upload.Name, err)
+		}
+
+		dropBox.Files++
+		dropBox.Bytes += upload.Size
+		dropBoxes[token] = dropBox
+		upload.DropBoxTitle = dropBox.Title
+		upload.Folder = dropBox.Folder
+		uploads[upload.ID] = upload
+		return nil
+	})
+	if err != nil {
+		// Do not leave the file in the queue when the store could not be written
+		os.RemoveAll(path.Join(s.moderationPath, upload.ID))
+		return Upload{}, err
+	}
+	return upload, nil
+}
+
+func (s *fileStore) Uploads() []Upload {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	uploads := make([]Upload, 0, len(s.uploads))
+	for _, upload := range s.uploads {
+		uploads = append(uploads, upload)
+	}
+	slices.SortFunc(uploads, func(a, b Upload) int { return a.UploadTime.Compare(b.UploadTime) })
+	return uploads
+}
+
+func (s *fileStore) Upload(id string) (Upload, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	upload, ok := s.uploads[id]
+	if !ok {
+		return Upload{}, ErrNotFound
+	}
+	return upload, nil
+}
+
+func (s *fileStore) UploadPath(upload Upload) string {
+	return path.Join(s.moderationPath, upload.ID, upload.Name)
+}
+
+func (s *fileStore) RemoveUpload(id string) error {
+	return s.update(func(dropBoxes map[string]DropBox, uploads map[string]Upload) error {
+		upload, ok := uploads[id]
+		if !ok {
+			return ErrNotFound
+		}
+		err := os.RemoveAll(path.Join(s.moderationPath, upload.ID))
+		if err != nil {
+			return fmt.Errorf("error removing %s from the moderation queue. %w", upload.Name, err)
+		}
+		delete(uploads, id)
+		return nil
+	})
+}
+
+// update modifies a copy of the drop boxes and uploads and writes them to disk before replacing the ones in memory
+func (s *fileStore) update(update func(dropBoxes map[string]DropBox, uploads map[string]Upload) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dropBoxes := make(map[string]DropBox, len(s.dropBoxes))
+	for token, dropBox := range s.dropBoxes {
+		if !dropBox.Expired() {
+			dropBoxes[token] = dropBox
+		}
+	}
+	uploads := make(map[string]Upload, len(s.uploads))
+	for id, upload := range s.uploads {
+		uploads[id] = upload
+	}
+	err := update(dropBoxes, uploads)
+	if err != nil {
+		return err
+	}
+
+	err = jsonfile.Write(s.filePath, storeFile{DropBoxes: dropBoxes, Uploads: uploads})
+	if err != nil {
+		return err
+	}
+	s.dropBoxes = dropBoxes
+	s.uploads = uploads
+	return nil
+}
+
+func newID(size int) string {
+	b := make([]byte, size)
+	// Ignore the error since it cannot fail. See source for more details
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
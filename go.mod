@@ -5,4 +5,6 @@ go 1.25.0
 require (
 	golang.org/x/crypto v0.54.0
 	golang.org/x/image v0.44.0
+	golang.org/x/net v0.56.0
+	rsc.io/qr v0.2.0
 )
@@ -0,0 +1,80 @@
+package html
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"davidc.es/jag/library"
+)
+
+// Filter selects the images shown in the year and album pages
+type Filter struct {
+	Tag       string
+	Favourite bool
+	MinRating int
+}
+
+func (f Filter) matches(image library.Image) bool {
+	if f.Tag != "" && !image.HasKeyword(f.Tag) {
+		return false
+	}
+	if f.Favourite && !image.Favourite {
+		return false
+	}
+	return image.Rating >= f.MinRating
+}
+
+func (f Filter) url() string {
+	values := url.Values{}
+	if f.Tag != "" {
+		values.Set("tag", f.Tag)
+	}
+	if f.Favourite {
+		values.Set("favourite", "true")
+	}
+	if f.MinRating > 0 {
+		values.Set("rating", strconv.Itoa(f.MinRating))
+	}
+	return "?" + values.Encode()
+}
+
+// filters returns the links to apply or remove every filter available for the images keeping the rest of the filters.
+func (f Filter) filters(images []library.Image) []filterLink {
+	favourite := f
+	favourite.Favourite = !f.Favourite
+	filters := []filterLink{{Label: "Favourites", URL: favourite.url(), Selected: f.Favourite}}
+
+	for rating := 1; rating <= 5; rating++ {
+		filter := f
+		filter.MinRating = rating
+		if f.MinRating == rating {
+			filter.MinRating = 0
+		}
+		filters = append(filters, filterLink{Label: fmt.Sprintf("%d+ ★", rating), URL: filter.url(), Selected: f.MinRating == rating})
+	}
+
+	// Offer as filters the keywords of all the images of the folder
+	var keywords []string
+	for _, image := range images {
+		for _, keyword := range image.Keywords {
+			if !slices.ContainsFunc(keywords, func(k string) bool { return strings.EqualFold(k, keyword) }) {
+				keywords = append(keywords, keyword)
+			}
+		}
+	}
+	slices.SortFunc(keywords, func(a, b string) int { return strings.Compare(strings.ToLower(a), strings.ToLower(b)) })
+	for _, keyword := range keywords {
+		selected := strings.EqualFold(keyword, f.Tag)
+		filter := f
+		filter.Tag = keyword
+		if selected {
+			// The link of the selected filter removes it
+			filter.Tag = ""
+		}
+		filters = append(filters, filterLink{Label: keyword, URL: filter.url(), Selected: selected})
+	}
+	return filters
+}
@@ -2,10 +2,23 @@ package html
 
 import (
 	"embed"
+	"encoding/base64"
+	"fmt"
+	"html/template"
 	"io"
-	"text/template"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"davidc.es/jag/catalog"
+	"davidc.es/jag/dropboxes"
 	"davidc.es/jag/library"
+	"davidc.es/jag/search"
+	"davidc.es/jag/shares"
+	"davidc.es/jag/users"
+	"rsc.io/qr"
 )
 
 //go:embed *.html.tmpl
@@ -14,6 +27,7 @@ var htmlFiles embed.FS
 type imageData struct {
 	ImagePath     string
 	ThumbnailPath string
+	Favourite     bool
 }
 
 type bucket struct {
@@ -21,53 +35,788 @@ type bucket struct {
 	Images []imageData
 }
 
+type folderData struct {
+	Name          string
+	Title         string
+	Warning       string
+	Count         int
+	DateRange     string
+	ThumbnailPath string
+}
+
+// The error pages are rendered without the user since they can be rendered before the authentication
+type errorData struct {
+	User users.User
+}
+
 type indexData struct {
-	Years []string
+	User   users.User
+	Years  []folderData
+	Albums []folderData
+}
+
+type filterLink struct {
+	Label    string
+	URL      string
+	Selected bool
+}
+
+type albumData struct {
+	User        users.User
+	Title       string
+	Description string
+	Warning     string
+	Filters     []filterLink
+	Buckets     []*bucket
+	Selection   Selection
+}
+
+// Selection are the options of the bulk actions of the selected items of a grid
+type Selection struct {
+	// Albums the items can be moved to
+	Albums    []string
+	CanEdit   bool
+	CanDelete bool
+	// Page the browser returns to after applying an action
+	RedirectURL string
+	// Folder of the page to share it as a whole, empty in the pages that are not folders
+	Folder string
+}
+
+type detailData struct {
+	User        users.User
+	Path        string
+	Name        string
+	Folder      string
+	IsVideo     bool
+	Title       string
+	Description string
+	Date        string
+	Camera      string
+	Location    string
+	LocationURL string
+	Keywords    []string
+	Stars       []star
+	Favourite   bool
+	Archived    bool
+	CanEdit     bool
+	CanDelete   bool
+	// Values of the edit form, empty when they are not overridden in the catalog
+	Caption  string
+	DateTime string
+	TimeZone string
+	History  []historyData
+}
+
+type historyData struct {
+	Time   string
+	Actor  string
+	Change string
+}
+
+type star struct {
+	Rating int
+	Filled bool
+}
+
+type trashData struct {
+	User      users.User
+	CanDelete bool
+	CanPurge  bool
+	Retention int
+	Items     []trashedItemData
+}
+
+type trashedItemData struct {
+	ID            string
+	Path          string
+	HasThumbnail  bool
+	DeletedBy     string
+	DeletionTime  string
+	ExpectedPurge string
+}
+
+// UploadResult is the outcome of the import of an uploaded file. Path is set when it succeeded and Error when it failed.
+type UploadResult struct {
+	Name  string
+	Path  string
+	Error string
+}
+
+type uploadData struct {
+	User    users.User
+	Albums  []string
+	Results []UploadResult
+}
+
+type usersData struct {
+	User          users.User
+	Users         []userData
+	Roles         []users.Role
+	InvitationURL string
+	Error         string
+}
+
+type userData struct {
+	Username     string
+	Role         users.Role
+	Groups       string
+	Status       string
+	CreationTime string
+	// The admin of the encrypted password and the current user cannot be changed
+	Editable bool
+	Disabled bool
+}
+
+type accessData struct {
+	User    users.User
+	Rules   []ruleData
+	Folders []string
+	Error   string
+}
+
+type ruleData struct {
+	Folder string
+	Users  string
+	Groups string
+}
+
+type invitationData struct {
+	Username string
+	Error    string
+}
+
+type shareData struct {
+	Token         string
+	Title         string
+	Buckets       []*bucket
+	AllowDownload bool
+	// Set when the password has to be entered before showing the items
+	Locked bool
+	Error  string
+}
+
+type sharedItemData struct {
+	Token         string
+	Title         string
+	Path          string
+	Name          string
+	IsVideo       bool
+	AllowDownload bool
+}
+
+type sharesData struct {
+	User   users.User
+	Shares []shareLinkData
+}
+
+type shareLinkData struct {
+	Token         string
+	URL           string
+	Title         string
+	Contents      string
+	CreatedBy     string
+	CreationTime  string
+	Expiration    string
+	HasPassword   bool
+	AllowDownload bool
+	Views         int
+}
+
+type dropBoxesData struct {
+	User      users.User
+	DropBoxes []dropBoxData
+	Albums    []string
+	Error     string
+}
+
+type dropBoxData struct {
+	Token      string
+	URL        string
+	Title      string
+	Folder     string
+	CreatedBy  string
+	Expiration string
+	// Received and maximum files and sizes, the maximums are empty when there is no limit
+	Files    int
+	MaxFiles string
+	Size     string
+	MaxSize  string
+}
+
+type moderationData struct {
+	User    users.User
+	Uploads []uploadedData
+}
+
+type uploadedData struct {
+	ID         string
+	Name       string
+	IsVideo    bool
+	Uploader   string
+	DropBox    string
+	Folder     string
+	Size       string
+	UploadTime string
+}
+
+type guestUploadData struct {
+	Title          string
+	RemainingFiles string
+	RemainingSize  string
+	Full           bool
+	Results        []UploadResult
+}
+
+// Device is a session of the user in the devices page
+type Device struct {
+	ID           string
+	UserAgent    string
+	IP           string
+	CreationTime time.Time
+	LastSeen     time.Time
+	// Current is the session of the request
+	Current bool
+}
+
+type loginData struct {
+	Remember     bool
+	SingleSignOn string
+	Error        string
+}
+
+// TOTPSetup is the secret being set up and its otpauth URI
+type TOTPSetup struct {
+	Secret string
+	URI    string
+}
+
+type totpSetupData struct {
+	Secret string
+	QRCode template.URL
+}
+
+type passkeysData struct {
+	User     users.User
+	Passkeys []passkeyData
+}
+
+type passkeyData struct {
+	ID           string
+	Name         string
+	CreationTime string
+	LastUsed     string
+}
+
+type secondFactorData struct {
+	Setup         *totpSetupData
+	RecoveryCodes []string
+	Error         string
+}
+
+type twoFactorData struct {
+	User          users.User
+	Required      bool
+	Setup         *totpSetupData
+	RecoveryCodes []string
+	Error         string
+}
+
+type devicesData struct {
+	User       users.User
+	Devices    []deviceData
+	Remembered []deviceData
+}
+
+type deviceData struct {
+	ID           string
+	Name         string
+	UserAgent    string
+	IP           string
+	CreationTime string
+	LastSeen     string
+	Current      bool
+}
+
+type tagsData struct {
+	User users.User
+	Tags []tagData
+}
+
+type tagData struct {
+	Name  string
+	Count int
 }
 
 var templates map[string]*template.Template
 
 func ParseTemplates() {
-	templates = make(map[string]*template.Template, 5)
+	templates = make(map[string]*template.Template, 14)
 	templates["login"] = template.Must(template.New("login").ParseFS(htmlFiles, "layout.html.tmpl", "login_header.html.tmpl", "login.html.tmpl"))
 	templates["index"] = template.Must(template.New("index").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "index.html.tmpl"))
 	templates["not_found"] = template.Must(template.New("not_found").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "404.html.tmpl"))
 	templates["internal_error"] = template.Must(template.New("internal_error").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "internal_error.html.tmpl"))
-	templates["year"] = template.Must(template.New("year").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "year.html.tmpl"))
+	templates["year"] = template.Must(template.New("year").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "download.html.tmpl", "share_options.html.tmpl", "selection.html.tmpl", "year.html.tmpl"))
+	templates["search"] = template.Must(template.New("search").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "search.html.tmpl"))
+	templates["detail"] = template.Must(template.New("detail").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "share_options.html.tmpl", "detail.html.tmpl"))
+	templates["tags"] = template.Must(template.New("tags").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "tags.html.tmpl"))
+	templates["album"] = template.Must(template.New("album").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "download.html.tmpl", "share_options.html.tmpl", "selection.html.tmpl", "album.html.tmpl"))
+	templates["upload"] = template.Must(template.New("upload").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "upload.html.tmpl"))
+	templates["trash"] = template.Must(template.New("trash").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "trash.html.tmpl"))
+	templates["users"] = template.Must(template.New("users").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "users.html.tmpl"))
+	templates["access"] = template.Must(template.New("access").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "access.html.tmpl"))
+	templates["invitation"] = template.Must(template.New("invitation").ParseFS(htmlFiles, "layout.html.tmpl", "login_header.html.tmpl", "invitation.html.tmpl"))
+	templates["dropboxes"] = template.Must(template.New("dropboxes").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "dropboxes.html.tmpl"))
+	templates["moderation"] = template.Must(template.New("moderation").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "moderation.html.tmpl"))
+	templates["dropbox"] = template.Must(template.New("dropbox").ParseFS(htmlFiles, "layout.html.tmpl", "login_header.html.tmpl", "dropbox.html.tmpl"))
+	templates["devices"] = template.Must(template.New("devices").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "devices.html.tmpl"))
+	templates["logged_in"] = template.Must(template.New("logged_in").ParseFS(htmlFiles, "layout.html.tmpl", "login_header.html.tmpl", "logged_in.html.tmpl"))
+	templates["second_factor"] = template.Must(template.New("second_factor").ParseFS(htmlFiles, "layout.html.tmpl", "login_header.html.tmpl", "totp_setup.html.tmpl", "second_factor.html.tmpl"))
+	templates["passkeys"] = template.Must(template.New("passkeys").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "passkeys.html.tmpl"))
+	templates["two_factor"] = template.Must(template.New("two_factor").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "totp_setup.html.tmpl", "two_factor.html.tmpl"))
+	templates["shares"] = template.Must(template.New("shares").ParseFS(htmlFiles, "layout.html.tmpl", "header.html.tmpl", "shares.html.tmpl"))
+	templates["share"] = template.Must(template.New("share").ParseFS(htmlFiles, "layout.html.tmpl", "login_header.html.tmpl", "share.html.tmpl"))
+	templates["shared_item"] = template.Must(template.New("shared_item").ParseFS(htmlFiles, "layout.html.tmpl", "login_header.html.tmpl", "shared_item.html.tmpl"))
+}
+
+// Login renders the login form, with the remember checkbox when the devices can be remembered
+// and the button to log in with the identity provider of the single sign-on when its name is not empty
+func Login(w io.Writer, remember bool, singleSignOn string, message string) error {
+	return templates["login"].ExecuteTemplate(w, "base", loginData{Remember: remember, SingleSignOn: singleSignOn, Error: message})
+}
+
+// LoggedIn renders the page that takes the user to the gallery after logging in with the identity provider.
+// The redirect back from the identity provider is a cross-site navigation without the session cookie,
+// which is strict, so the gallery is opened from this page of the same site.
+func LoggedIn(w io.Writer) error {
+	return templates["logged_in"].ExecuteTemplate(w, "base", nil)
+}
+
+// SecondFactor renders the second step of the login asking for a code, or the setup of the TOTP secret when it is not nil.
+// The recovery codes are shown when the TOTP was just enabled.
+func SecondFactor(w io.Writer, setup *TOTPSetup, recoveryCodes []string, message string) error {
+	data := secondFactorData{RecoveryCodes: recoveryCodes, Error: message}
+	var err error
+	data.Setup, err = toTOTPSetupData(setup)
+	if err != nil {
+		return err
+	}
+
+	return templates["second_factor"].ExecuteTemplate(w, "base", data)
+}
+
+// TwoFactor renders the two-factor authentication settings of the user
+func TwoFactor(w io.Writer, user users.User, required bool, setup *TOTPSetup, recoveryCodes []string, message string) error {
+	data := twoFactorData{User: user, Required: required, RecoveryCodes: recoveryCodes, Error: message}
+	var err error
+	data.Setup, err = toTOTPSetupData(setup)
+	if err != nil {
+		return err
+	}
+
+	return templates["two_factor"].ExecuteTemplate(w, "base", data)
+}
+
+// Passkeys renders the passkeys of the user
+func Passkeys(w io.Writer, user users.User) error {
+	data := passkeysData{User: user}
+	for _, passkey := range user.Passkeys {
+		lastUsed := "never"
+		if !passkey.LastUsed.IsZero() {
+			lastUsed = passkey.LastUsed.Local().Format("2 January 2006 15:04")
+		}
+		data.Passkeys = append(data.Passkeys, passkeyData{
+			ID:           passkey.ID,
+			Name:         passkey.Name,
+			CreationTime: passkey.CreationTime.Local().Format("2 January 2006 15:04"),
+			LastUsed:     lastUsed,
+		})
+	}
+
+	return templates["passkeys"].ExecuteTemplate(w, "base", data)
 }
 
-func Login(w io.Writer) error {
-	return templates["login"].ExecuteTemplate(w, "base", nil)
+// toTOTPSetupData renders the QR code of the URI as an inline PNG image
+func toTOTPSetupData(setup *TOTPSetup) (*totpSetupData, error) {
+	if setup == nil {
+		return nil, nil
+	}
+	code, err := qr.Encode(setup.URI, qr.M)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding QR code. %w", err)
+	}
+	return &totpSetupData{
+		Secret: setup.Secret,
+		QRCode: template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG())),
+	}, nil
 }
 
-func Index(w io.Writer, years []string) error {
-	data := indexData{Years: years}
+func Index(w io.Writer, user users.User, years []library.Album, albums []library.Album) error {
+	data := indexData{User: user, Years: toFolderData(years), Albums: toFolderData(albums)}
 
 	return templates["index"].ExecuteTemplate(w, "base", data)
 }
 
 func NotFound(w io.Writer) error {
-	return templates["not_found"].ExecuteTemplate(w, "base", nil)
+	return templates["not_found"].ExecuteTemplate(w, "base", errorData{})
 }
 
 func InternalError(w io.Writer) error {
-	return templates["internal_error"].ExecuteTemplate(w, "base", nil)
+	return templates["internal_error"].ExecuteTemplate(w, "base", errorData{})
 }
 
-func Year(w io.Writer, images []library.Image) error {
+// Year renders the images of a year matching the filter.
+func Year(w io.Writer, user users.User, album library.Album, images []library.Image, filter Filter, selection Selection) error {
+	data := toAlbumData(album, images, filter, "January")
+	data.User = user
+	data.Selection = selection
+
+	return templates["year"].ExecuteTemplate(w, "base", data)
+}
+
+func Album(w io.Writer, user users.User, album library.Album, images []library.Image, filter Filter, selection Selection) error {
+	// Albums can span several years so the year is part of the bucket
+	data := toAlbumData(album, images, filter, "January 2006")
+	data.User = user
+	data.Selection = selection
+
+	return templates["album"].ExecuteTemplate(w, "base", data)
+}
+
+func Detail(w io.Writer, user users.User, image library.Image, exif library.Exif, history []catalog.AuditEvent, canDelete bool) error {
+	data := detailData{
+		User:        user,
+		Path:        image.Path,
+		Name:        image.Name,
+		Folder:      path.Dir(image.Path),
+		IsVideo:     image.IsVideo(),
+		Title:       image.Title,
+		Description: image.Description,
+		Date:        image.CreationTime.Format("2 January 2006 15:04"),
+		Camera:      exif.Camera(),
+		Keywords:    image.Keywords,
+		Favourite:   image.Favourite,
+		Caption:     image.Caption,
+		TimeZone:    image.TimeZone,
+		Archived:    image.Archived,
+		CanEdit:     user.IsContributor(),
+		CanDelete:   canDelete,
+	}
+	if image.TimeZone != "" {
+		data.Date = image.CreationTime.Format("2 January 2006 15:04 MST")
+		data.DateTime = image.CreationTime.Format("2006-01-02T15:04")
+	}
+	// Newest first
+	for _, event := range slices.Backward(history) {
+		change := fmt.Sprintf("%s changed from %q to %q", event.Field, event.From, event.To)
+		data.History = append(data.History, historyData{Time: event.Time.Format("2 January 2006 15:04"), Actor: event.Actor, Change: change})
+	}
+	for rating := 1; rating <= 5; rating++ {
+		data.Stars = append(data.Stars, star{Rating: rating, Filled: rating <= image.Rating})
+	}
+	if exif.HasLocation {
+		data.Location = fmt.Sprintf("%.5f, %.5f", exif.Latitude, exif.Longitude)
+		data.LocationURL = fmt.Sprintf("https://www.openstreetmap.org/?mlat=%f&mlon=%f#map=15/%f/%f", exif.Latitude, exif.Longitude, exif.Latitude, exif.Longitude)
+	}
+
+	return templates["detail"].ExecuteTemplate(w, "base", data)
+}
+
+func Tags(w io.Writer, user users.User, tags []search.FacetValue) error {
+	data := tagsData{User: user}
+	for _, tag := range tags {
+		data.Tags = append(data.Tags, tagData{Name: tag.Value, Count: tag.Count})
+	}
+
+	return templates["tags"].ExecuteTemplate(w, "base", data)
+}
+
+func Upload(w io.Writer, user users.User, albums []string, results []UploadResult) error {
+	return templates["upload"].ExecuteTemplate(w, "base", uploadData{User: user, Albums: albums, Results: results})
+}
+
+// Trash renders the items of the trash with the date they will be purged after the retention.
+func Trash(w io.Writer, user users.User, items []library.TrashedItem, canDelete bool, retention time.Duration) error {
+	data := trashData{User: user, CanDelete: canDelete, CanPurge: canDelete && user.IsAdmin(), Retention: int(retention.Hours() / 24)}
+	for _, item := range items {
+		data.Items = append(data.Items, trashedItemData{
+			ID:            item.ID,
+			Path:          item.Path,
+			HasThumbnail:  item.ThumbnailName != "",
+			DeletedBy:     item.DeletedBy,
+			DeletionTime:  item.DeletionTime.Local().Format("2 January 2006 15:04"),
+			ExpectedPurge: item.DeletionTime.Add(retention).Local().Format("2 January 2006"),
+		})
+	}
+
+	return templates["trash"].ExecuteTemplate(w, "base", data)
+}
+
+// Users renders the users with the link to set the password of the last invited or reset user.
+func Users(w io.Writer, user users.User, accounts []users.User, adminUsername string, invitationURL string, message string) error {
+	data := usersData{User: user, Roles: []users.Role{users.RoleViewer, users.RoleContributor, users.RoleAdmin}, InvitationURL: invitationURL, Error: message}
+	for _, account := range accounts {
+		status := "active"
+		switch {
+		case account.Disabled:
+			status = "disabled"
+		case account.PendingInvitation():
+			status = "invited"
+		case account.OIDCSubject != "":
+			status = "active, single sign-on"
+		case account.HasTOTP():
+			status = "active, 2FA"
+		}
+		data.Users = append(data.Users, userData{
+			Username:     account.Username,
+			Role:         account.Role,
+			Groups:       strings.Join(account.Groups, ", "),
+			Status:       status,
+			CreationTime: account.CreationTime.Local().Format("2 January 2006"),
+			Editable:     !strings.EqualFold(account.Username, adminUsername) && !strings.EqualFold(account.Username, user.Username),
+			Disabled:     account.Disabled,
+		})
+	}
+
+	return templates["users"].ExecuteTemplate(w, "base", data)
+}
+
+// Access renders the access rules of the folders with the folders of the library to suggest in the form.
+func Access(w io.Writer, user users.User, rules []users.Rule, folders []string, message string) error {
+	data := accessData{User: user, Folders: folders, Error: message}
+	for _, rule := range rules {
+		data.Rules = append(data.Rules, ruleData{Folder: rule.Folder, Users: strings.Join(rule.Users, ", "), Groups: strings.Join(rule.Groups, ", ")})
+	}
+
+	return templates["access"].ExecuteTemplate(w, "base", data)
+}
+
+// Invitation renders the form to set the password of an invited user. The username is empty when the invitation is not valid.
+func Invitation(w io.Writer, username string, message string) error {
+	return templates["invitation"].ExecuteTemplate(w, "base", invitationData{Username: username, Error: message})
+}
+
+// Shares renders the active share links with their URL made of the base URL and the token.
+func Shares(w io.Writer, user users.User, links []shares.Share, baseURL string) error {
+	data := sharesData{User: user}
+	for _, share := range links {
+		link := shareLinkData{
+			Token:         share.Token,
+			URL:           baseURL + share.Token,
+			Title:         share.Title,
+			Contents:      share.Folder,
+			CreatedBy:     share.CreatedBy,
+			CreationTime:  share.CreationTime.Local().Format("2 January 2006"),
+			Expiration:    "never",
+			HasPassword:   share.HasPassword(),
+			AllowDownload: share.AllowDownload,
+			Views:         share.Views,
+		}
+		if len(share.Paths) == 1 {
+			link.Contents = share.Paths[0]
+		} else if share.Folder == "" {
+			link.Contents = fmt.Sprintf("%d items", len(share.Paths))
+		}
+		if !share.Expiration.IsZero() {
+			// The share expires at the start of the day after the last valid day
+			link.Expiration = share.Expiration.Local().AddDate(0, 0, -1).Format("2 January 2006")
+		}
+		data.Shares = append(data.Shares, link)
+	}
+
+	return templates["shares"].ExecuteTemplate(w, "base", data)
+}
+
+// Share renders the public page of a share link with its items.
+func Share(w io.Writer, token string, title string, images []library.Image, allowDownload bool) error {
+	data := shareData{Token: token, Title: title, Buckets: toBuckets(images, "January 2006"), AllowDownload: allowDownload}
+	return templates["share"].ExecuteTemplate(w, "base", data)
+}
+
+// SharePassword renders the form to enter the password of a share link.
+func SharePassword(w io.Writer, token string, title string, message string) error {
+	return templates["share"].ExecuteTemplate(w, "base", shareData{Token: token, Title: title, Locked: true, Error: message})
+}
+
+func SharedItem(w io.Writer, token string, title string, image library.Image, allowDownload bool) error {
+	data := sharedItemData{Token: token, Title: title, Path: image.Path, Name: image.Name, IsVideo: image.IsVideo(), AllowDownload: allowDownload}
+	return templates["shared_item"].ExecuteTemplate(w, "base", data)
+}
+
+// DropBoxes renders the active drop boxes with their URL made of the base URL and the token and the form to create them.
+func DropBoxes(w io.Writer, user users.User, dropBoxes []dropboxes.DropBox, albums []string, baseURL string, message string) error {
+	data := dropBoxesData{User: user, Albums: albums, Error: message}
+	for _, dropBox := range dropBoxes {
+		box := dropBoxData{
+			Token:      dropBox.Token,
+			URL:        baseURL + dropBox.Token,
+			Title:      dropBox.Title,
+			Folder:     dropBox.Folder,
+			CreatedBy:  dropBox.CreatedBy,
+			Expiration: "never",
+			Files:      dropBox.Files,
+			Size:       formatSize(dropBox.Bytes),
+		}
+		if !dropBox.Expiration.IsZero() {
+			box.Expiration = dropBox.Expiration.Local().AddDate(0, 0, -1).Format("2 January 2006")
+		}
+		if dropBox.MaxFiles > 0 {
+			box.MaxFiles = strconv.Itoa(dropBox.MaxFiles)
+		}
+		if dropBox.MaxBytes > 0 {
+			box.MaxSize = formatSize(dropBox.MaxBytes)
+		}
+		data.DropBoxes = append(data.DropBoxes, box)
+	}
+
+	return templates["dropboxes"].ExecuteTemplate(w, "base", data)
+}
+
+// Moderation renders the uploads of the drop boxes waiting to be approved.
+func Moderation(w io.Writer, user users.User, uploads []dropboxes.Upload) error {
+	data := moderationData{User: user}
+	for _, upload := range uploads {
+		data.Uploads = append(data.Uploads, uploadedData{
+			ID:         upload.ID,
+			Name:       upload.Name,
+			IsVideo:    library.Image{Name: upload.Name}.IsVideo(),
+			Uploader:   upload.Uploader,
+			DropBox:    upload.DropBoxTitle,
+			Folder:     upload.Folder,
+			Size:       formatSize(upload.Size),
+			UploadTime: upload.UploadTime.Local().Format("2 January 2006 15:04"),
+		})
+	}
+
+	return templates["moderation"].ExecuteTemplate(w, "base", data)
+}
+
+// DropBox renders the public page to upload files to a drop box with the results of the last upload.
+func DropBox(w io.Writer, dropBox dropboxes.DropBox, results []UploadResult) error {
+	data := guestUploadData{Title: dropBox.Title, Results: results}
+	if remaining := dropBox.RemainingFiles(); remaining >= 0 {
+		data.RemainingFiles = strconv.Itoa(remaining)
+		data.Full = remaining == 0
+	}
+	if remaining := dropBox.RemainingBytes(); remaining >= 0 {
+		data.RemainingSize = formatSize(remaining)
+		data.Full = data.Full || remaining == 0
+	}
+
+	return templates["dropbox"].ExecuteTemplate(w, "base", data)
+}
+
+// Devices renders the sessions and the remembered devices of the user.
+func Devices(w io.Writer, user users.User, devices []Device, remembered []Device) error {
+	data := devicesData{User: user, Devices: toDeviceData(devices), Remembered: toDeviceData(remembered)}
+
+	return templates["devices"].ExecuteTemplate(w, "base", data)
+}
+
+func toDeviceData(devices []Device) []deviceData {
+	var data []deviceData
+	for _, device := range devices {
+		data = append(data, deviceData{
+			ID:           device.ID,
+			Name:         deviceName(device.UserAgent),
+			UserAgent:    device.UserAgent,
+			IP:           device.IP,
+			CreationTime: device.CreationTime.Local().Format("2 January 2006 15:04"),
+			LastSeen:     device.LastSeen.Local().Format("2 January 2006 15:04"),
+			Current:      device.Current,
+		})
+	}
+	return data
+}
+
+// deviceName returns a short description like Firefox on Linux of the user agent
+func deviceName(userAgent string) string {
+	browser := "Unknown browser"
+	// The order matters since most browsers also name the ones they are based on
+	for _, name := range []string{"Edg", "OPR", "Firefox", "Chrome", "Safari", "curl"} {
+		if strings.Contains(userAgent, name+"/") {
+			browser = strings.NewReplacer("Edg", "Edge", "OPR", "Opera").Replace(name)
+			break
+		}
+	}
+	for _, system := range []string{"Android", "iPhone", "iPad", "Windows", "Mac OS", "Linux"} {
+		if strings.Contains(userAgent, system) {
+			return browser + " on " + strings.TrimSuffix(system, " OS")
+		}
+	}
+	return browser
+}
+
+// formatSize returns the size in bytes in the biggest unit that makes it at least 1
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", size)
+}
+
+func toAlbumData(album library.Album, images []library.Image, filter Filter, dateLayout string) albumData {
+	data := albumData{
+		Title:       album.DisplayName(),
+		Description: album.Metadata.Description,
+	}
+	if album.MetadataError != nil {
+		data.Warning = album.MetadataError.Error()
+	}
+
+	data.Filters = filter.filters(images)
+	images = slices.DeleteFunc(slices.Clone(images), func(image library.Image) bool { return !filter.matches(image) })
+	data.Buckets = toBuckets(images, dateLayout)
+	return data
+}
+
+func toBuckets(images []library.Image, dateLayout string) []*bucket {
 	var data []*bucket
 	for _, image := range images {
-		date := image.CreationTime.Format("January")
+		date := image.CreationTime.Format(dateLayout)
 		if b := containsBucket(data, date); b != nil {
-			b.Images = append(b.Images, imageData{ImagePath: image.Path, ThumbnailPath: image.ThumbnailPath})
+			b.Images = append(b.Images, imageData{ImagePath: image.Path, ThumbnailPath: image.ThumbnailPath, Favourite: image.Favourite})
 		} else {
 			newBucket := &bucket{Date: date, Images: make([]imageData, 0)}
-			newBucket.Images = append(newBucket.Images, imageData{ImagePath: image.Path, ThumbnailPath: image.ThumbnailPath})
+			newBucket.Images = append(newBucket.Images, imageData{ImagePath: image.Path, ThumbnailPath: image.ThumbnailPath, Favourite: image.Favourite})
 			data = append(data, newBucket)
 		}
 	}
+	return data
+}
 
-	return templates["year"].ExecuteTemplate(w, "base", data)
+func toFolderData(albums []library.Album) []folderData {
+	data := make([]folderData, 0, len(albums))
+	for _, album := range albums {
+		folder := folderData{
+			Name:          album.Name,
+			Title:         album.DisplayName(),
+			Count:         album.Count,
+			DateRange:     dateRange(album.From, album.To),
+			ThumbnailPath: album.ThumbnailPath,
+		}
+		if album.MetadataError != nil {
+			folder.Warning = album.MetadataError.Error()
+		}
+		data = append(data, folder)
+	}
+	return data
+}
+
+func dateRange(from time.Time, to time.Time) string {
+	if from.IsZero() {
+		return ""
+	}
+	start, end := from.Format("Jan 2006"), to.Format("Jan 2006")
+	if start == end {
+		return start
+	}
+	return start + " - " + end
 }
 
 func containsBucket(buckets []*bucket, date string) *bucket {
@@ -0,0 +1,134 @@
+package html
+
+import (
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"davidc.es/jag/search"
+	"davidc.es/jag/users"
+)
+
+type searchImage struct {
+	ImagePath     string
+	ThumbnailPath string
+	Name          string
+	FolderTitle   string
+}
+
+type facetValueData struct {
+	Label    string
+	Count    int
+	URL      string
+	Selected bool
+}
+
+type facetData struct {
+	Name   string
+	Values []facetValueData
+}
+
+type hiddenField struct {
+	Name  string
+	Value string
+}
+
+type searchData struct {
+	User    users.User
+	Query   string
+	From    string
+	To      string
+	Error   string
+	Total   int
+	Images  []searchImage
+	Facets  []facetData
+	Filters []hiddenField
+	NextURL string
+}
+
+// Max number of values displayed for each facet
+const maxFacetValues int = 20
+
+// Query parameters of the facets, in the order they are displayed
+var facetParameters = []string{"year", "type", "camera", "location", "tag"}
+
+func Search(w io.Writer, user users.User, values url.Values, result search.Result, queryErr error) error {
+	data := searchData{
+		User:  user,
+		Query: values.Get("q"),
+		From:  values.Get("from"),
+		To:    values.Get("to"),
+		Total: result.Total,
+	}
+	if queryErr != nil {
+		data.Error = queryErr.Error()
+	}
+
+	for _, document := range result.Documents {
+		data.Images = append(data.Images, searchImage{
+			ImagePath:     document.Path,
+			ThumbnailPath: document.ThumbnailPath,
+			Name:          document.Name,
+			FolderTitle:   document.FolderTitle,
+		})
+	}
+
+	data.Facets = []facetData{
+		toFacetData("Year", "year", result.Facets.Years, values),
+		toFacetData("Type", "type", result.Facets.MediaTypes, values),
+		toFacetData("Camera", "camera", result.Facets.Cameras, values),
+		toFacetData("Has location", "location", result.Facets.HasLocation, values),
+		toFacetData("Tag", "tag", result.Facets.Tags, values),
+	}
+
+	// Keep the selected facets when the form is submitted again
+	for _, parameter := range facetParameters {
+		if value := values.Get(parameter); value != "" {
+			data.Filters = append(data.Filters, hiddenField{Name: parameter, Value: value})
+		}
+	}
+
+	offset, _ := strconv.Atoi(values.Get("offset"))
+	if next := offset + len(result.Documents); next < result.Total {
+		nextValues := cloneValues(values)
+		nextValues.Set("offset", strconv.Itoa(next))
+		data.NextURL = "/search?" + nextValues.Encode()
+	}
+
+	return templates["search"].ExecuteTemplate(w, "base", data)
+}
+
+// toFacetData creates the links of the facet values. The link of the selected value removes the filter.
+func toFacetData(name string, parameter string, facetValues []search.FacetValue, values url.Values) facetData {
+	facet := facetData{Name: name}
+	for n, value := range facetValues {
+		selected := strings.EqualFold(values.Get(parameter), value.Value)
+		// Only the most common values are shown, but the selected one is always kept to be able to remove the filter
+		if n >= maxFacetValues && !selected {
+			continue
+		}
+		linkValues := cloneValues(values)
+		linkValues.Del("offset")
+		if selected {
+			linkValues.Del(parameter)
+		} else {
+			linkValues.Set(parameter, value.Value)
+		}
+		facet.Values = append(facet.Values, facetValueData{
+			Label:    value.Value,
+			Count:    value.Count,
+			URL:      "/search?" + linkValues.Encode(),
+			Selected: selected,
+		})
+	}
+	return facet
+}
+
+func cloneValues(values url.Values) url.Values {
+	clone := make(url.Values, len(values))
+	for key, value := range values {
+		clone[key] = append([]string(nil), value...)
+	}
+	return clone
+}
@@ -0,0 +1,180 @@
+package http
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"davidc.es/jag/catalog"
+	"davidc.es/jag/html"
+	"davidc.es/jag/library"
+	"davidc.es/jag/search"
+)
+
+// The bulk endpoints take the items in the path form values. Browsers are redirected to the redirect
+// form value, which must be a path of the gallery, and other clients get a No Content response.
+
+func bulkFavourite(libraryPath string, itemCatalog catalog.Catalog, searchIndex *search.Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		favourite, err := strconv.ParseBool(r.FormValue("favourite"))
+		if err != nil {
+			http.Error(w, "favourite must be a boolean", http.StatusBadRequest)
+			return
+		}
+
+		bulkUpdate(w, r, libraryPath, itemCatalog, searchIndex, func(entry *catalog.Entry) { entry.Favourite = favourite })
+	}
+}
+
+func bulkArchive(libraryPath string, itemCatalog catalog.Catalog, searchIndex *search.Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		archived, err := strconv.ParseBool(r.FormValue("archived"))
+		if err != nil {
+			http.Error(w, "archived must be a boolean", http.StatusBadRequest)
+			return
+		}
+
+		bulkUpdate(w, r, libraryPath, itemCatalog, searchIndex, func(entry *catalog.Entry) { entry.Archived = archived })
+	}
+}
+
+// bulkUpdate updates the catalog entries of all the items of the form
+func bulkUpdate(w http.ResponseWriter, r *http.Request, libraryPath string, itemCatalog catalog.Catalog, searchIndex *search.Index, update func(entry *catalog.Entry)) {
+	images, ok := formItems(w, r, libraryPath)
+	if !ok {
+		return
+	}
+
+	for _, image := range images {
+		if image.Hash == "" {
+			http.Error(w, "item could not be hashed "+image.Path, http.StatusInternalServerError)
+			return
+		}
+		err := itemCatalog.Update(image.Hash, actor(r), image.Path, update)
+		if err != nil {
+			log.Printf("error updating catalog entry of %s. %v", image.Path, err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+	}
+	searchIndex.Refresh(libraryPath)
+
+	bulkDone(w, r)
+}
+
+func bulkMove(libraryPath string, thumbnailsPath string, searchIndex *search.Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		album := r.FormValue("album")
+		if album == "" {
+			http.Error(w, "album is required", http.StatusBadRequest)
+			return
+		}
+		if !canAccess(r, album) {
+			http.Error(w, "album not found "+album, http.StatusNotFound)
+			return
+		}
+		images, ok := formItems(w, r, libraryPath)
+		if !ok {
+			return
+		}
+
+		for _, image := range images {
+			moved, err := library.Move(libraryPath, thumbnailsPath, image.Path, album)
+			if err != nil {
+				if errors.Is(err, library.ErrNotExist) {
+					http.Error(w, "album not found "+album, http.StatusNotFound)
+					return
+				}
+				log.Printf("error moving %s to %s. %v", image.Path, album, err)
+				http.Error(w, "unexpected error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("%s moved %s to %s", actor(r), image.Path, moved.Path)
+		}
+		searchIndex.Refresh(libraryPath)
+
+		bulkDone(w, r)
+	}
+}
+
+func bulkDelete(libraryPath string, thumbnailsPath string, trashPath string, allowDelete bool, searchIndex *search.Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowDelete {
+			http.Error(w, "deleting items is not allowed", http.StatusForbidden)
+			return
+		}
+		images, ok := formItems(w, r, libraryPath)
+		if !ok {
+			return
+		}
+
+		for _, image := range images {
+			item, err := library.Trash(libraryPath, thumbnailsPath, trashPath, image.Path, actor(r))
+			if err != nil {
+				log.Printf("error moving %s to the trash. %v", image.Path, err)
+				http.Error(w, "unexpected error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("%s moved %s to the trash", item.DeletedBy, item.Path)
+		}
+		searchIndex.Refresh(libraryPath)
+
+		bulkDone(w, r)
+	}
+}
+
+// formItems returns the items of the path values of the form writing an error when any of them does not exist
+func formItems(w http.ResponseWriter, r *http.Request, libraryPath string) ([]library.Image, bool) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return nil, false
+	}
+	itemPaths := r.Form["path"]
+	if len(itemPaths) == 0 {
+		http.Error(w, "at least one path is required", http.StatusBadRequest)
+		return nil, false
+	}
+	images := make([]library.Image, 0, len(itemPaths))
+	for _, itemPath := range itemPaths {
+		if !canAccess(r, itemPath) {
+			http.Error(w, "item not found "+itemPath, http.StatusNotFound)
+			return nil, false
+		}
+		image, err := library.Item(libraryPath, itemPath)
+		if err != nil {
+			if errors.Is(err, library.ErrNotExist) {
+				http.Error(w, "item not found "+itemPath, http.StatusNotFound)
+				return nil, false
+			}
+			log.Printf("error reading item %s. %v", itemPath, err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return nil, false
+		}
+		images = append(images, image)
+	}
+	return images, true
+}
+
+// selection returns the options of the bulk actions of the grid of the request
+func selection(r *http.Request, libraryPath string, allowDelete bool) html.Selection {
+	user := currentUser(r)
+	return html.Selection{
+		Albums:      albumFolders(r, libraryPath),
+		CanEdit:     user.IsContributor(),
+		CanDelete:   allowDelete && user.IsContributor(),
+		RedirectURL: r.URL.RequestURI(),
+	}
+}
+
+func bulkDone(w http.ResponseWriter, r *http.Request) {
+	redirect := r.FormValue("redirect")
+	// Only paths of the gallery to avoid open redirects
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
@@ -0,0 +1,143 @@
+package http
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"davidc.es/jag/html"
+)
+
+type sessionContextKey struct{}
+
+// withSessionID stores the id of the session of the request so the devices page can tell the current device apart
+func withSessionID(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, id))
+}
+
+func currentSessionID(r *http.Request) string {
+	id, _ := r.Context().Value(sessionContextKey{}).(string)
+	return id
+}
+
+// currentRememberedID returns the id of the remembered device of the request, empty when it is not remembered
+func currentRememberedID(r *http.Request) string {
+	cookie, err := r.Cookie(rememberCookieName)
+	if err != nil {
+		return ""
+	}
+	id, _, _ := strings.Cut(cookie.Value, ".")
+	return id
+}
+
+// devicesPage lists the sessions of the user so the ones of lost or shared devices can be closed
+func devicesPage(sessionService sessionService, rememberStore *rememberStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		var devices []html.Device
+		for _, session := range sessionService.userSessions(user.Username) {
+			devices = append(devices, html.Device{
+				ID:           session.id,
+				UserAgent:    session.userAgent,
+				IP:           session.ip,
+				CreationTime: session.creationTimestamp,
+				LastSeen:     session.lastSeenTimestamp,
+				Current:      session.id == currentSessionID(r),
+			})
+		}
+
+		var remembered []html.Device
+		for _, device := range rememberStore.userDevices(user.Username) {
+			remembered = append(remembered, html.Device{
+				ID:           device.id,
+				UserAgent:    device.UserAgent,
+				IP:           device.IP,
+				CreationTime: device.CreationTimestamp,
+				LastSeen:     device.LastSeenTimestamp,
+				Current:      device.id == currentRememberedID(r),
+			})
+		}
+
+		err := html.Devices(w, user, devices, remembered)
+		if err != nil {
+			html.InternalError(w)
+			log.Printf("error serving devices. %v", err)
+			return
+		}
+	}
+}
+
+func revokeDevice(sessionService sessionService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		// Users can only close their own sessions
+		owned := slices.ContainsFunc(sessionService.userSessions(currentUser(r).Username), func(session session) bool { return session.id == id })
+		if !owned {
+			http.NotFound(w, r)
+			return
+		}
+		err := sessionService.deleteSessionByID(id)
+		if err != nil {
+			log.Printf("could not delete session. %v", err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s logged out a device", actor(r))
+
+		if id == currentSessionID(r) {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/devices", http.StatusSeeOther)
+	}
+}
+
+// forgetDevice forgets a remembered device of the user, which stays logged in until its session expires
+func forgetDevice(rememberStore *rememberStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		// Users can only forget their own devices
+		owned := slices.ContainsFunc(rememberStore.userDevices(currentUser(r).Username), func(device rememberedDevice) bool { return device.id == id })
+		if !owned {
+			http.NotFound(w, r)
+			return
+		}
+		err := rememberStore.forgetByID(id)
+		if err != nil {
+			log.Printf("could not forget remembered device. %v", err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s forgot a remembered device", actor(r))
+
+		if id == currentRememberedID(r) {
+			http.SetCookie(w, &http.Cookie{Name: rememberCookieName, Path: "/", MaxAge: -1})
+		}
+		http.Redirect(w, r, "/devices", http.StatusSeeOther)
+	}
+}
+
+// logoutEverywhere closes all the sessions of the user, including the current one, and forgets all the remembered devices
+func logoutEverywhere(sessionService sessionService, rememberStore *rememberStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := sessionService.deleteSessions(currentUser(r).Username)
+		if err != nil {
+			log.Printf("could not delete sessions. %v", err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		err = rememberStore.forgetUser(currentUser(r).Username)
+		if err != nil {
+			log.Printf("could not forget remembered devices. %v", err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s logged out everywhere", actor(r))
+
+		http.SetCookie(w, &http.Cookie{Name: cookieName, Path: "/", MaxAge: -1})
+		http.SetCookie(w, &http.Cookie{Name: rememberCookieName, Path: "/", MaxAge: -1})
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+}
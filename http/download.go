@@ -0,0 +1,127 @@
+package http
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"davidc.es/jag/library"
+)
+
+const (
+	variantOriginal string = "original"
+	variantDisplay  string = "display"
+)
+
+// downloadFolder streams a ZIP file with the items of the folder.
+func downloadFolder(libraryPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		folder := r.PathValue("folder")
+		if !canAccess(r, folder) {
+			http.NotFound(w, r)
+			return
+		}
+		_, images, err := library.Folder(libraryPath, folder)
+		if err != nil {
+			if errors.Is(err, library.ErrNotExist) {
+				http.NotFound(w, r)
+				return
+			}
+			log.Printf("error reading folder %s. %v", folder, err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+
+		writeZip(w, libraryPath, folder, images, r.URL.Query().Get("variant"))
+	}
+}
+
+// downloadSelection streams a ZIP file with the items of the paths of the form.
+func downloadSelection(libraryPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		images, ok := formItems(w, r, libraryPath)
+		if !ok {
+			return
+		}
+
+		writeZip(w, libraryPath, r.FormValue("name"), images, r.FormValue("variant"))
+	}
+}
+
+// writeZip streams the ZIP file without temporary files. The photos and videos are already compressed
+// so they are stored without compression. Archives bigger than 4 GB are written as ZIP64.
+func writeZip(w http.ResponseWriter, libraryPath string, name string, images []library.Image, variant string) {
+	if variant == "" {
+		variant = variantOriginal
+	}
+	if variant != variantOriginal && variant != variantDisplay {
+		http.Error(w, "variant must be original or display", http.StatusBadRequest)
+		return
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "jag"
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".zip"}))
+
+	zipWriter := zip.NewWriter(w)
+	names := make(map[string]bool, len(images))
+	for _, image := range images {
+		header := &zip.FileHeader{
+			// Keep the folders so items with the same name in different folders do not clash
+			Name:     image.Path,
+			Method:   zip.Store,
+			Modified: image.CreationTime,
+		}
+		if variant == variantDisplay {
+			header.Name = path.Join(path.Dir(image.Path), library.DisplayImageName(image.Name))
+		}
+		// The display renditions of photo.png and photo.jpg have the same name
+		ext := path.Ext(header.Name)
+		base := strings.TrimSuffix(header.Name, ext)
+		for i := 1; names[header.Name]; i++ {
+			header.Name = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		names[header.Name] = true
+		entry, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			log.Printf("error writing zip entry %s. %v", image.Path, err)
+			return
+		}
+
+		filePath := path.Join(libraryPath, image.Path)
+		if variant == variantDisplay {
+			err = library.EncodeDisplayImage(entry, filePath)
+		} else {
+			err = copyFileTo(entry, filePath)
+		}
+		if err != nil {
+			// The response has already started so the client will get a truncated file
+			log.Printf("error writing %s to the zip. %v", image.Path, err)
+			return
+		}
+	}
+	err := zipWriter.Close()
+	if err != nil {
+		log.Printf("error finishing zip. %v", err)
+	}
+}
+
+func copyFileTo(w io.Writer, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,352 @@
+package http
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"davidc.es/jag/dropboxes"
+	"davidc.es/jag/html"
+	"davidc.es/jag/library"
+	"davidc.es/jag/search"
+	"davidc.es/jag/users"
+)
+
+// Max length of the name the guests can enter in the drop boxes
+const maxUploaderLength int = 100
+
+func dropBoxesPage(libraryPath string, dropBoxStore dropboxes.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderDropBoxes(w, r, libraryPath, dropBoxStore, http.StatusOK, "")
+	}
+}
+
+// createDropBox creates a drop box link to upload files to an album with the optional expiration and quotas of the form
+func createDropBox(libraryPath string, dropBoxStore dropboxes.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dropBox := dropboxes.DropBox{
+			Title:     strings.TrimSpace(r.FormValue("title")),
+			Folder:    r.FormValue("album"),
+			CreatedBy: currentUser(r).Username,
+		}
+		if !slices.Contains(albumFolders(r, libraryPath), dropBox.Folder) {
+			renderDropBoxes(w, r, libraryPath, dropBoxStore, http.StatusBadRequest, "Unknown album "+dropBox.Folder)
+			return
+		}
+		if dropBox.Title == "" {
+			dropBox.Title = dropBox.Folder
+		}
+		if expiration := r.FormValue("expiration"); expiration != "" {
+			date, err := time.ParseInLocation(dateLayout, expiration, time.Local)
+			if err != nil {
+				renderDropBoxes(w, r, libraryPath, dropBoxStore, http.StatusBadRequest, "The expiration must be a date like 2006-01-02")
+				return
+			}
+			// The drop box is open the whole day of the expiration
+			dropBox.Expiration = date.AddDate(0, 0, 1).UTC()
+			if dropBox.Expired() {
+				renderDropBoxes(w, r, libraryPath, dropBoxStore, http.StatusBadRequest, "The expiration must not be in the past")
+				return
+			}
+		}
+		maxFiles, err := quota(r.FormValue("maxFiles"))
+		if err != nil {
+			renderDropBoxes(w, r, libraryPath, dropBoxStore, http.StatusBadRequest, "The max files must be a positive number")
+			return
+		}
+		maxMB, err := quota(r.FormValue("maxMB"))
+		if err != nil {
+			renderDropBoxes(w, r, libraryPath, dropBoxStore, http.StatusBadRequest, "The max size must be a positive number")
+			return
+		}
+		dropBox.MaxFiles = maxFiles
+		dropBox.MaxBytes = int64(maxMB) << 20
+
+		dropBox, err = dropBoxStore.Create(dropBox)
+		if err != nil {
+			log.Printf("error creating drop box. %v", err)
+			html.InternalError(w)
+			return
+		}
+		log.Printf("%s created the drop box %s for %s", actor(r), dropBox.Title, dropBox.Folder)
+
+		http.Redirect(w, r, "/dropboxes", http.StatusSeeOther)
+	}
+}
+
+// quota parses an optional limit of the form, zero when it is empty
+func quota(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid quota %s", value)
+	}
+	return n, nil
+}
+
+func revokeDropBox(dropBoxStore dropboxes.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dropBox, err := dropBoxStore.DropBox(r.PathValue("token"))
+		if err != nil || !canManageDropBox(currentUser(r), dropBox) {
+			http.NotFound(w, r)
+			return
+		}
+		err = dropBoxStore.Revoke(dropBox.Token)
+		if err != nil && !errors.Is(err, dropboxes.ErrNotFound) {
+			log.Printf("error revoking drop box %s. %v", dropBox.Title, err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s revoked the drop box %s", actor(r), dropBox.Title)
+
+		http.Redirect(w, r, "/dropboxes", http.StatusSeeOther)
+	}
+}
+
+func canManageDropBox(user users.User, dropBox dropboxes.DropBox) bool {
+	return user.IsAdmin() || strings.EqualFold(dropBox.CreatedBy, user.Username)
+}
+
+func renderDropBoxes(w http.ResponseWriter, r *http.Request, libraryPath string, dropBoxStore dropboxes.Store, status int, message string) {
+	user := currentUser(r)
+	list := slices.DeleteFunc(dropBoxStore.DropBoxes(), func(dropBox dropboxes.DropBox) bool { return !canManageDropBox(user, dropBox) })
+
+	w.WriteHeader(status)
+	err := html.DropBoxes(w, user, list, albumFolders(r, libraryPath), absoluteURL(r, "/d/"), message)
+	if err != nil {
+		log.Printf("error serving drop boxes. %v", err)
+	}
+}
+
+func moderationPage(dropBoxStore dropboxes.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := html.Moderation(w, currentUser(r), dropBoxStore.Uploads())
+		if err != nil {
+			html.InternalError(w)
+			log.Printf("error serving moderation. %v", err)
+			return
+		}
+	}
+}
+
+// uploadedFile serves the file of an upload waiting for moderation so it can be reviewed
+func uploadedFile(dropBoxStore dropboxes.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		upload, err := dropBoxStore.Upload(r.PathValue("id"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		// The files come from guests so they are never rendered as pages of the gallery
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeFile(w, r, dropBoxStore.UploadPath(upload))
+	}
+}
+
+// approveUploads imports the uploads of the id form values into the folders of their drop boxes
+func approveUploads(libraryPath string, thumbnailsPath string, dropBoxStore dropboxes.Store, searchIndex *search.Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		for _, id := range r.Form["id"] {
+			upload, err := dropBoxStore.Upload(id)
+			if err != nil {
+				continue
+			}
+			image, err := library.Import(libraryPath, thumbnailsPath, dropBoxStore.UploadPath(upload), upload.Name, upload.Folder)
+			if err != nil {
+				log.Printf("could not import %s of the drop box %s. %v", upload.Name, upload.DropBoxTitle, err)
+				continue
+			}
+			err = dropBoxStore.RemoveUpload(upload.ID)
+			if err != nil {
+				log.Printf("could not remove %s from the moderation queue. %v", upload.Name, err)
+			}
+			log.Printf("%s approved %s uploaded by %s", actor(r), image.Path, uploaderName(upload))
+		}
+		searchIndex.Refresh(libraryPath)
+
+		http.Redirect(w, r, "/moderation", http.StatusSeeOther)
+	}
+}
+
+// rejectUploads deletes the uploads of the id form values
+func rejectUploads(dropBoxStore dropboxes.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		for _, id := range r.Form["id"] {
+			upload, err := dropBoxStore.Upload(id)
+			if err != nil {
+				continue
+			}
+			err = dropBoxStore.RemoveUpload(upload.ID)
+			if err != nil {
+				log.Printf("could not remove %s from the moderation queue. %v", upload.Name, err)
+				continue
+			}
+			log.Printf("%s rejected %s uploaded by %s", actor(r), upload.Name, uploaderName(upload))
+		}
+
+		http.Redirect(w, r, "/moderation", http.StatusSeeOther)
+	}
+}
+
+func uploaderName(upload dropboxes.Upload) string {
+	if upload.Uploader == "" {
+		return "a guest"
+	}
+	return upload.Uploader
+}
+
+// dropBoxPage shows the form to upload files to the drop box to anyone with the link
+func dropBoxPage(dropBoxStore dropboxes.Store, userStore users.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dropBox, ok := openDropBox(w, r, dropBoxStore, userStore)
+		if !ok {
+			return
+		}
+		err := html.DropBox(w, dropBox, nil)
+		if err != nil {
+			html.InternalError(w)
+			log.Printf("error serving drop box %s. %v", dropBox.Title, err)
+			return
+		}
+	}
+}
+
+// dropBoxUpload receives the files of a multipart form into the moderation queue of the drop box. The files are
+// streamed to the staging path one by one and rejected as soon as they exceed the size left in the drop box.
+func dropBoxUpload(stagingPath string, maxUploadSizeMB int, dropBoxStore dropboxes.Store, userStore users.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dropBox, ok := openDropBox(w, r, dropBoxStore, userStore)
+		if !ok {
+			return
+		}
+		reader, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, "request must be a multipart form", http.StatusBadRequest)
+			return
+		}
+		err = os.MkdirAll(stagingPath, os.ModePerm)
+		if err != nil {
+			log.Printf("error creating staging directory %s. %v", stagingPath, err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+
+		var uploader string
+		var results []html.UploadResult
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				http.Error(w, "invalid multipart form", http.StatusBadRequest)
+				return
+			}
+			// The uploader field must be sent before the files to be applied to them
+			if part.FormName() == "uploader" {
+				b, err := io.ReadAll(io.LimitReader(part, int64(maxUploaderLength)))
+				if err != nil {
+					http.Error(w, "invalid name", http.StatusBadRequest)
+					return
+				}
+				uploader = strings.TrimSpace(string(b))
+				continue
+			}
+			if part.FormName() != "files" || part.FileName() == "" {
+				continue
+			}
+
+			result := html.UploadResult{Name: part.FileName()}
+			upload, err := receivePart(dropBoxStore, dropBox.Token, stagingPath, int64(maxUploadSizeMB)<<20, part, uploader)
+			if err != nil {
+				result.Error = err.Error()
+				if !errors.Is(err, library.ErrUnsupportedMedia) && !errors.Is(err, dropboxes.ErrQuotaExceeded) && !errors.Is(err, dropboxes.ErrTooBig) {
+					log.Printf("could not receive %s in the drop box %s. %v", part.FileName(), dropBox.Title, err)
+					result.Error = "unexpected error"
+				}
+			} else {
+				log.Printf("%s uploaded %s to the drop box %s", cmp.Or(uploader, actor(r)), upload.Name, dropBox.Title)
+				result.Path = upload.Name
+			}
+			results = append(results, result)
+		}
+
+		dropBox, err = dropBoxStore.DropBox(dropBox.Token)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			html.NotFound(w)
+			return
+		}
+		err = html.DropBox(w, dropBox, results)
+		if err != nil {
+			html.InternalError(w)
+			log.Printf("error serving drop box %s. %v", dropBox.Title, err)
+			return
+		}
+	}
+}
+
+func receivePart(dropBoxStore dropboxes.Store, token string, stagingPath string, maxSize int64, part *multipart.Part, uploader string) (dropboxes.Upload, error) {
+	dropBox, err := dropBoxStore.DropBox(token)
+	if err != nil {
+		return dropboxes.Upload{}, err
+	}
+	if dropBox.RemainingFiles() == 0 {
+		return dropboxes.Upload{}, dropboxes.ErrQuotaExceeded
+	}
+	if remaining := dropBox.RemainingBytes(); remaining >= 0 {
+		maxSize = min(maxSize, remaining)
+	}
+
+	f, err := os.CreateTemp(stagingPath, "dropbox-*")
+	if err != nil {
+		return dropboxes.Upload{}, err
+	}
+	// AddUpload moves the file so the removal only matters when it fails
+	defer os.Remove(f.Name())
+
+	n, err := io.Copy(f, io.LimitReader(part, maxSize+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return dropboxes.Upload{}, err
+	}
+	if n > maxSize {
+		return dropboxes.Upload{}, dropboxes.ErrTooBig
+	}
+	err = library.ValidateMedia(f.Name(), part.FileName())
+	if err != nil {
+		return dropboxes.Upload{}, err
+	}
+	return dropBoxStore.AddUpload(token, f.Name(), part.FileName(), uploader)
+}
+
+// openDropBox returns the drop box of the token writing a not found page when it does not exist, it expired
+// or the user who created it was disabled
+func openDropBox(w http.ResponseWriter, r *http.Request, dropBoxStore dropboxes.Store, userStore users.Store) (dropboxes.DropBox, bool) {
+	dropBox, err := dropBoxStore.DropBox(r.PathValue("token"))
+	if err == nil {
+		creator, err := userStore.User(dropBox.CreatedBy)
+		if err == nil && !creator.Disabled {
+			return dropBox, true
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+	html.NotFound(w)
+	return dropboxes.DropBox{}, false
+}
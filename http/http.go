@@ -1,51 +1,198 @@
 package http
 
 import (
+	"cmp"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"path"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"davidc.es/jag/catalog"
 	"davidc.es/jag/configuration"
+	"davidc.es/jag/dropboxes"
 	"davidc.es/jag/html"
 	"davidc.es/jag/library"
+	"davidc.es/jag/search"
+	"davidc.es/jag/shares"
 	"davidc.es/jag/static"
-	"golang.org/x/crypto/bcrypt"
+	"davidc.es/jag/tus"
+	"davidc.es/jag/users"
 )
 
 const cookieName string = "session"
 
-func Serve(configuration configuration.Configuration) *http.Server {
-	sessionService := inMemorySessionService{
-		sessions:             make(map[string]time.Time),
-		maxSessionAgeSeconds: configuration.MaxSessionAgeSeconds(),
+// Layout of the value of the datetime-local inputs
+const dateTimeLocalLayout string = "2006-01-02T15:04"
+
+func Serve(configuration configuration.Configuration, searchIndex *search.Index, itemCatalog catalog.Catalog, userStore users.Store, shareStore shares.Store, dropBoxStore dropboxes.Store) *http.Server {
+	var sessionService sessionService
+	if configuration.SessionStore() == "signed" {
+		sessionService = &signedSessionService{userStore: userStore, maxSessionAgeSeconds: configuration.MaxSessionAgeSeconds()}
+	} else {
+		sessionsFilePath := ""
+		if configuration.SessionStore() == "file" {
+			sessionsFilePath = path.Join(configuration.DataPath(), sessionsFileName)
+		}
+		sessionManager, err := newSessionManager(sessionsFilePath, configuration.MaxSessionAgeSeconds())
+		if err != nil {
+			log.Fatalf("error loading sessions. %v", err)
+		}
+		sessionService = sessionManager
+		go sweepSessions(sessionService, 10*time.Minute)
+	}
+	rememberFilePath := ""
+	if configuration.SessionStore() != "memory" {
+		rememberFilePath = path.Join(configuration.DataPath(), rememberFileName)
+	}
+	rememberStore, err := newRememberStore(rememberFilePath, configuration.RememberDays())
+	if err != nil {
+		log.Fatalf("error loading remembered devices. %v", err)
+	}
+	err = logoutAdminsWithout2FA(configuration.DataPath(), configuration.RequireAdmin2FA(), userStore, sessionService, rememberStore)
+	if err != nil {
+		log.Fatalf("error requiring two-factor authentication for the admins. %v", err)
+	}
+	// The cookies are signed with the signing key and verified with it or any of the previous keys
+	signingKeys := append([]string{configuration.SigningKey()}, configuration.VerificationKeys()...)
+	singleSignOn, err := newSingleSignOn(configuration)
+	if err != nil {
+		log.Fatalf("error configuring single sign-on. %v", err)
+	}
+
+	// The servers sharing the data path share the used challenges unless the sessions are only kept in memory
+	usedChallengesFilePath := ""
+	if configuration.SessionStore() != "memory" {
+		usedChallengesFilePath = path.Join(configuration.DataPath(), usedChallengesFileName)
 	}
+	usedChallenges := newUsedChallenges(usedChallengesFilePath)
 
 	html.ParseTemplates()
 
 	serveMux := http.NewServeMux()
 
-	serveMux.HandleFunc("GET /login", func(w http.ResponseWriter, r *http.Request) { html.Login(w) })
-	serveMux.HandleFunc("POST /login", login(configuration.SigningKey(), configuration.EncryptedPassword(), configuration.MaxSessionAgeSeconds(), sessionService))
-	serveMux.HandleFunc("POST /logout", auth(configuration.SigningKey(), sessionService, logout(sessionService)))
+	serveMux.HandleFunc("GET /login", func(w http.ResponseWriter, r *http.Request) {
+		renderLogin(w, http.StatusOK, rememberStore, singleSignOn, "")
+	})
+	serveMux.HandleFunc("POST /login", login(signingKeys[0], userStore, configuration.MaxSessionAgeSeconds(), sessionService, rememberStore, configuration.RequireAdmin2FA()))
+	serveMux.HandleFunc("POST /login/passkey/options", passkeyLoginOptions(signingKeys[0], configuration.PublicURL()))
+	serveMux.HandleFunc("POST /login/passkey", passkeyLogin(signingKeys, configuration.PublicURL(), userStore, configuration.MaxSessionAgeSeconds(), sessionService, rememberStore, usedChallenges))
+	if singleSignOn != nil {
+		serveMux.HandleFunc("GET /login/oidc", oidcLogin(signingKeys[0], configuration.PublicURL(), singleSignOn, rememberStore))
+		serveMux.HandleFunc("GET "+oidcCallbackPath, oidcCallback(signingKeys, configuration.PublicURL(), singleSignOn, userStore, configuration.MaxSessionAgeSeconds(), sessionService, rememberStore))
+	}
+	serveMux.HandleFunc("GET /login/2fa", secondFactorPage(signingKeys, userStore))
+	serveMux.HandleFunc("POST /login/2fa", verifySecondFactor(signingKeys, userStore, configuration.MaxSessionAgeSeconds(), sessionService, rememberStore))
+	serveMux.HandleFunc("POST /logout", auth(signingKeys, sessionService, rememberStore, userStore, logout(sessionService, rememberStore)))
+	serveMux.HandleFunc("GET /devices", auth(signingKeys, sessionService, rememberStore, userStore, devicesPage(sessionService, rememberStore)))
+	serveMux.HandleFunc("POST /devices/{id}/revoke", auth(signingKeys, sessionService, rememberStore, userStore, revokeDevice(sessionService)))
+	serveMux.HandleFunc("POST /devices/remembered/{id}/forget", auth(signingKeys, sessionService, rememberStore, userStore, forgetDevice(rememberStore)))
+	serveMux.HandleFunc("GET /2fa", auth(signingKeys, sessionService, rememberStore, userStore, twoFactorPage(configuration.RequireAdmin2FA())))
+	serveMux.HandleFunc("POST /2fa/setup", auth(signingKeys, sessionService, rememberStore, userStore, setupTwoFactor(userStore, configuration.RequireAdmin2FA())))
+	serveMux.HandleFunc("POST /2fa/enable", auth(signingKeys, sessionService, rememberStore, userStore, enableTwoFactor(userStore, configuration.RequireAdmin2FA())))
+	serveMux.HandleFunc("POST /2fa/disable", auth(signingKeys, sessionService, rememberStore, userStore, disableTwoFactor(userStore, configuration.RequireAdmin2FA())))
+	serveMux.HandleFunc("GET /passkeys", auth(signingKeys, sessionService, rememberStore, userStore, passkeysPage()))
+	serveMux.HandleFunc("POST /passkeys/options", auth(signingKeys, sessionService, rememberStore, userStore, passkeyRegistrationOptions(signingKeys[0], configuration.PublicURL(), userStore)))
+	serveMux.HandleFunc("POST /passkeys", auth(signingKeys, sessionService, rememberStore, userStore, registerPasskey(signingKeys, configuration.PublicURL(), userStore, usedChallenges)))
+	serveMux.HandleFunc("POST /passkeys/{id}/remove", auth(signingKeys, sessionService, rememberStore, userStore, removePasskey(userStore)))
+	serveMux.HandleFunc("POST /devices/logout", auth(signingKeys, sessionService, rememberStore, userStore, logoutEverywhere(sessionService, rememberStore)))
 
 	library := http.FileServer(http.Dir(configuration.LibraryPath()))
-	serveMux.HandleFunc("GET /library/", auth(configuration.SigningKey(), sessionService, http.StripPrefix("/library/", library).ServeHTTP))
+	serveMux.HandleFunc("GET /library/", auth(signingKeys, sessionService, rememberStore, userStore, http.StripPrefix("/library/", accessibleFiles(library)).ServeHTTP))
 	thumbnails := http.FileServer(http.Dir(configuration.ThumbnailsPath()))
-	serveMux.Handle("GET /thumbnails/", auth(configuration.SigningKey(), sessionService, http.StripPrefix("/thumbnails/", thumbnails).ServeHTTP))
+	serveMux.Handle("GET /thumbnails/", auth(signingKeys, sessionService, rememberStore, userStore, http.StripPrefix("/thumbnails/", accessibleFiles(thumbnails)).ServeHTTP))
 
 	resources := http.FileServerFS(static.Resources())
 	serveMux.Handle("GET /resources/", resources)
 
 	serveMux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) { html.NotFound(w) })
-	serveMux.HandleFunc("GET /{$}", auth(configuration.SigningKey(), sessionService, index(configuration.LibraryPath())))
-	serveMux.HandleFunc("GET /{year}", auth(configuration.SigningKey(), sessionService, year(configuration.LibraryPath())))
+	serveMux.HandleFunc("GET /{$}", auth(signingKeys, sessionService, rememberStore, userStore, index(configuration.LibraryPath())))
+	serveMux.HandleFunc("GET /{folder}", auth(signingKeys, sessionService, rememberStore, userStore, folder(configuration.LibraryPath(), configuration.AllowDelete())))
+
+	serveMux.HandleFunc("GET /view/{path...}", auth(signingKeys, sessionService, rememberStore, userStore, detail(configuration.LibraryPath(), itemCatalog, configuration.AllowDelete())))
+	serveMux.HandleFunc("POST /favourite/{path...}", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, favourite(configuration.LibraryPath(), itemCatalog, searchIndex))))
+	serveMux.HandleFunc("POST /rating/{path...}", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, rating(configuration.LibraryPath(), itemCatalog, searchIndex, configuration.WriteXMPSidecars()))))
+	serveMux.HandleFunc("POST /edit/{path...}", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, edit(configuration.LibraryPath(), itemCatalog, searchIndex))))
+	serveMux.HandleFunc("POST /archive/{path...}", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, archive(configuration.LibraryPath(), itemCatalog, searchIndex))))
+	serveMux.HandleFunc("GET /archive", auth(signingKeys, sessionService, rememberStore, userStore, archived(configuration.LibraryPath(), configuration.AllowDelete())))
+	serveMux.HandleFunc("GET /download/{folder}", auth(signingKeys, sessionService, rememberStore, userStore, downloadFolder(configuration.LibraryPath())))
+	serveMux.HandleFunc("POST /download", auth(signingKeys, sessionService, rememberStore, userStore, downloadSelection(configuration.LibraryPath())))
+	serveMux.HandleFunc("POST /bulk/favourite", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, bulkFavourite(configuration.LibraryPath(), itemCatalog, searchIndex))))
+	serveMux.HandleFunc("POST /bulk/archive", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, bulkArchive(configuration.LibraryPath(), itemCatalog, searchIndex))))
+	serveMux.HandleFunc("POST /bulk/move", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, bulkMove(configuration.LibraryPath(), configuration.ThumbnailsPath(), searchIndex))))
+	serveMux.HandleFunc("POST /bulk/delete", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, bulkDelete(configuration.LibraryPath(), configuration.ThumbnailsPath(), configuration.TrashPath(), configuration.AllowDelete(), searchIndex))))
+	serveMux.HandleFunc("GET /upload", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, uploadPage(configuration.LibraryPath()))))
+	serveMux.HandleFunc("POST /upload", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, upload(configuration.LibraryPath(), configuration.ThumbnailsPath(), configuration.StagingPath(), searchIndex))))
+	uploadExpiration := time.Duration(configuration.UploadExpirationHours()) * time.Hour
+	tusHandler, err := tus.New("/tus/", path.Join(configuration.StagingPath(), "tus"), int64(configuration.MaxUploadSizeMB())<<20, uploadExpiration, importUpload(configuration.LibraryPath(), configuration.ThumbnailsPath(), searchIndex))
+	if err != nil {
+		log.Fatalf("error creating resumable upload handler. %v", err)
+	}
+	if uploadExpiration > 0 {
+		go sweepUploads(tusHandler, 10*time.Minute)
+	}
+	for _, method := range []string{"OPTIONS", "POST", "HEAD", "PATCH", "DELETE"} {
+		serveMux.HandleFunc(method+" /tus/", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, tusHandler.ServeHTTP)))
+	}
+	webDAVHandler := newWebDAVHandler(configuration.LibraryPath(), configuration.ThumbnailsPath(), configuration.StagingPath(), configuration.TrashPath(), configuration.WebDAVWritable(), configuration.AllowDelete(), searchIndex)
+	for _, method := range []string{"OPTIONS", "GET", "PUT", "DELETE", "MKCOL", "COPY", "MOVE", "PROPFIND", "PROPPATCH", "LOCK", "UNLOCK"} {
+		serveMux.HandleFunc(method+" /webdav/", davAuth(signingKeys, sessionService, rememberStore, userStore, configuration.RequireAdmin2FA(), webDAVHandler.ServeHTTP))
+	}
+	trashRetention := time.Duration(configuration.TrashRetentionDays()) * 24 * time.Hour
+	serveMux.HandleFunc("POST /delete/{path...}", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, deleteItem(configuration.LibraryPath(), configuration.ThumbnailsPath(), configuration.TrashPath(), configuration.AllowDelete(), searchIndex))))
+	serveMux.HandleFunc("GET /trash", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, trash(configuration.TrashPath(), configuration.AllowDelete(), trashRetention))))
+	serveMux.HandleFunc("GET /trash/{id}/thumbnail", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, trashedThumbnail(configuration.TrashPath()))))
+	serveMux.HandleFunc("POST /trash/{id}/restore", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, restore(configuration.LibraryPath(), configuration.ThumbnailsPath(), configuration.TrashPath(), configuration.AllowDelete(), searchIndex))))
+	serveMux.HandleFunc("POST /trash/{id}/purge", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleAdmin, purge(configuration.TrashPath(), configuration.AllowDelete()))))
+	serveMux.HandleFunc("POST /trash/purge", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleAdmin, emptyTrash(configuration.TrashPath(), configuration.AllowDelete()))))
+	serveMux.HandleFunc("GET /users", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleAdmin, usersPage(userStore, configuration.AdminUsername()))))
+	serveMux.HandleFunc("POST /users", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleAdmin, inviteUser(userStore, configuration.AdminUsername()))))
+	serveMux.HandleFunc("POST /users/{username}/role", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleAdmin, changeRole(userStore, configuration.AdminUsername()))))
+	serveMux.HandleFunc("POST /users/{username}/disable", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleAdmin, disableUser(userStore, sessionService, rememberStore, configuration.AdminUsername(), true))))
+	serveMux.HandleFunc("POST /users/{username}/enable", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleAdmin, disableUser(userStore, sessionService, rememberStore, configuration.AdminUsername(), false))))
+	serveMux.HandleFunc("POST /users/{username}/reset", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleAdmin, resetUser(userStore, sessionService, rememberStore, configuration.AdminUsername()))))
+	serveMux.HandleFunc("POST /users/{username}/groups", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleAdmin, changeGroups(userStore))))
+	serveMux.HandleFunc("GET /access", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleAdmin, accessPage(configuration.LibraryPath(), userStore))))
+	serveMux.HandleFunc("POST /access", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleAdmin, setRule(configuration.LibraryPath(), userStore))))
+	serveMux.HandleFunc("POST /access/delete", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleAdmin, deleteRule(userStore))))
+	serveMux.HandleFunc("GET /invitation/{token}", invitation(userStore))
+	serveMux.HandleFunc("POST /invitation/{token}", acceptInvitation(userStore))
+
+	serveMux.HandleFunc("GET /shares", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, sharesPage(configuration.PublicURL(), shareStore))))
+	serveMux.HandleFunc("POST /shares", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, createShare(configuration.LibraryPath(), shareStore))))
+	serveMux.HandleFunc("POST /shares/{token}/revoke", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, revokeShare(shareStore))))
+	serveMux.HandleFunc("GET /dropboxes", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, dropBoxesPage(configuration.LibraryPath(), dropBoxStore))))
+	serveMux.HandleFunc("POST /dropboxes", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, createDropBox(configuration.LibraryPath(), dropBoxStore))))
+	serveMux.HandleFunc("POST /dropboxes/{token}/revoke", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleContributor, revokeDropBox(dropBoxStore))))
+	serveMux.HandleFunc("GET /moderation", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleAdmin, moderationPage(dropBoxStore))))
+	serveMux.HandleFunc("GET /moderation/{id}/file", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleAdmin, uploadedFile(dropBoxStore))))
+	serveMux.HandleFunc("POST /moderation/approve", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleAdmin, approveUploads(configuration.LibraryPath(), configuration.ThumbnailsPath(), dropBoxStore, searchIndex))))
+	serveMux.HandleFunc("POST /moderation/reject", auth(signingKeys, sessionService, rememberStore, userStore, requireRole(users.RoleAdmin, rejectUploads(dropBoxStore))))
+	// The drop box links are public, the uploads wait for the approval of an admin
+	serveMux.HandleFunc("GET /d/{token}", dropBoxPage(dropBoxStore, userStore))
+	serveMux.HandleFunc("POST /d/{token}", dropBoxUpload(configuration.StagingPath(), configuration.MaxUploadSizeMB(), dropBoxStore, userStore))
+	// The share links are public, the handlers only serve the items of the share of the token
+	serveMux.HandleFunc("GET /s/{token}", sharePage(configuration.LibraryPath(), signingKeys, shareStore, userStore))
+	serveMux.HandleFunc("POST /s/{token}", unlockShare(signingKeys[0], shareStore, newShareGuesses()))
+	serveMux.HandleFunc("GET /s/{token}/view/{path...}", sharedItemPage(configuration.LibraryPath(), signingKeys, shareStore, userStore))
+	serveMux.HandleFunc("GET /s/{token}/thumbnails/{path...}", sharedThumbnail(configuration.LibraryPath(), configuration.ThumbnailsPath(), signingKeys, shareStore, userStore))
+	serveMux.HandleFunc("GET /s/{token}/display/{path...}", sharedDisplay(configuration.LibraryPath(), signingKeys, shareStore, userStore))
+	serveMux.HandleFunc("GET /s/{token}/original/{path...}", sharedOriginal(configuration.LibraryPath(), signingKeys, shareStore, userStore))
+	serveMux.HandleFunc("GET /s/{token}/download", downloadShare(configuration.LibraryPath(), signingKeys, shareStore, userStore))
+	serveMux.HandleFunc("GET /favourites", auth(signingKeys, sessionService, rememberStore, userStore, favourites(configuration.LibraryPath(), configuration.AllowDelete())))
+	serveMux.HandleFunc("GET /tags", auth(signingKeys, sessionService, rememberStore, userStore, tags(searchIndex)))
+	serveMux.HandleFunc("GET /search", auth(signingKeys, sessionService, rememberStore, userStore, searchPage(searchIndex)))
+	serveMux.HandleFunc("GET /api/search", auth(signingKeys, sessionService, rememberStore, userStore, searchAPI(searchIndex)))
 
 	serveMux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -69,145 +216,671 @@ func Serve(configuration configuration.Configuration) *http.Server {
 	return server
 }
 
-func login(signingKey string, encryptedPassword string, maxSessionAgeSeconds int, sessionService sessionService) http.HandlerFunc {
+func login(signingKey string, userStore users.Store, maxSessionAgeSeconds int, sessionService sessionService, rememberStore *rememberStore, requireAdmin2FA bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := r.ParseForm()
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		formPassword := r.FormValue("password")
-		err = bcrypt.CompareHashAndPassword([]byte(encryptedPassword), []byte(formPassword))
+		user, err := userStore.Authenticate(r.FormValue("username"), r.FormValue("password"))
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		remember := r.FormValue("remember") == "true"
+		if needsSecondFactor(user, requireAdmin2FA) {
+			setPendingLogin(w, signingKey, user, remember)
+			http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+			return
+		}
+
+		err = startSession(w, r, signingKey, maxSessionAgeSeconds, sessionService, rememberStore, user, remember)
 		if err != nil {
+			log.Printf("unable to create session: %v", err)
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+// renderLogin renders the login form with the message of a failed login
+func renderLogin(w http.ResponseWriter, status int, rememberStore *rememberStore, singleSignOn *singleSignOn, message string) {
+	name := ""
+	if singleSignOn != nil {
+		name = singleSignOn.name
+	}
+	w.WriteHeader(status)
+	err := html.Login(w, rememberStore.enabled(), name, message)
+	if err != nil {
+		log.Printf("error serving login. %v", err)
+	}
+}
+
+// logoutAdminsWithout2FA closes the sessions the admins opened before the two-factor authentication was required.
+// It is only done the first time the server starts with it required, which is recorded in the data path.
+// The admins of the single sign-on are not logged out since their provider is in charge of the second factor.
+func logoutAdminsWithout2FA(dataPath string, requireAdmin2FA bool, userStore users.Store, sessionService sessionService, rememberStore *rememberStore) error {
+	markerPath := path.Join(dataPath, requireAdmin2FAFileName)
+	if !requireAdmin2FA {
+		err := os.Remove(markerPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error removing %s. %w", markerPath, err)
+		}
+		return nil
+	}
+	if _, err := os.Stat(markerPath); err == nil {
+		return nil
+	}
+
+	for _, user := range userStore.Users() {
+		if user.IsAdmin() && !user.HasTOTP() && user.OIDCSubject == "" {
+			logoutUser(sessionService, rememberStore, userStore, user.Username)
+		}
+	}
+	err := os.WriteFile(markerPath, nil, 0600)
+	if err != nil {
+		return fmt.Errorf("error writing %s. %w", markerPath, err)
+	}
+	return nil
+}
+
+// startSession creates a session for the user that logged in and sets its cookie, remembering the device when asked
+func startSession(w http.ResponseWriter, r *http.Request, signingKey string, maxSessionAgeSeconds int, sessionService sessionService, rememberStore *rememberStore, user users.User, remember bool) error {
+	session, err := sessionService.createSession(user.Username, r.UserAgent(), remoteIP(r))
+	if err != nil {
+		return err
+	}
+	setSessionCookie(w, signingKey, session.token, maxSessionAgeSeconds)
+	if remember && rememberStore.enabled() {
+		token, err := rememberStore.remember(user.Username, user.SessionGeneration, r.UserAgent(), remoteIP(r))
+		if err != nil {
+			log.Printf("unable to remember device: %v", err)
 		} else {
-			session, err := sessionService.createSession()
-			if err != nil {
-				log.Printf("unable to create session: %v", err)
-				http.Redirect(w, r, "/login", http.StatusSeeOther)
-				return
-			}
+			setRememberCookie(w, token, rememberStore.maxAge)
+		}
+	}
+	return nil
+}
+
+func auth(signingKeys []string, sessionService sessionService, rememberStore *rememberStore, userStore users.Store, authenticatedHandlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, user, ok := authenticate(w, r, signingKeys, sessionService, userStore)
+		if !ok {
+			// The remembered devices get a new session instead of logging in again
+			session, user, ok = refreshSession(w, r, signingKeys[0], sessionService, rememberStore, userStore)
+		}
+		if !ok {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		authenticatedHandlerFunc(w, withUser(withSessionID(r, session.id), userStore, user))
+	}
+}
+
+// authenticate returns the session of the cookie and its user, extending the cookie when the session was extended
+func authenticate(w http.ResponseWriter, r *http.Request, signingKeys []string, sessionService sessionService, userStore users.Store) (*session, users.User, bool) {
+	cookie, err := r.Cookie(cookieName)
+	if err != nil {
+		return nil, users.User{}, false
+	}
+
+	signedToken, err := base64.URLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil, users.User{}, false
+	}
+
+	// Check that the signed token is at least the size of the signature
+	if len(signedToken) < sha256.Size {
+		return nil, users.User{}, false
+	}
+
+	// Split apart the signature and the token.
+	signature := signedToken[:sha256.Size]
+	token := signedToken[sha256.Size:]
+
+	// Recalculate the HMAC signature of the cookie name and the token with every key
+	key := slices.IndexFunc(signingKeys, func(signingKey string) bool {
+		mac := hmac.New(sha256.New, []byte(signingKey))
+		mac.Write([]byte(cookieName))
+		mac.Write([]byte(token))
+		return hmac.Equal(signature, mac.Sum(nil))
+	})
+	if key < 0 {
+		return nil, users.User{}, false
+	}
+
+	session, err := sessionService.session(string(token))
+	if err != nil {
+		return nil, users.User{}, false
+	}
+
+	if string(token) != session.token || session.expirationTimestamp.Before(time.Now().UTC()) {
+		err = sessionService.deleteSession(string(token))
+		if err != nil {
+			log.Printf("could not delete session: %v", err)
+		}
+		return nil, users.User{}, false
+	}
+
+	// The user could have been disabled after logging in
+	user, err := userStore.User(session.username)
+	if err != nil || user.Disabled {
+		err = sessionService.deleteSession(string(token))
+		if err != nil {
+			log.Printf("could not delete session: %v", err)
+		}
+		return nil, users.User{}, false
+	}
+
+	// Extend the cookie together with the session so it does not expire while the session is used
+	expiration, err := sessionService.touchSession(string(token))
+	if err != nil {
+		log.Printf("could not extend session: %v", err)
+	}
+	// The cookies signed with a previous key are signed again with the current one
+	if expiration.IsZero() && key > 0 {
+		expiration = session.expirationTimestamp
+	}
+	if !expiration.IsZero() {
+		setSessionCookie(w, signingKeys[0], string(token), int(time.Until(expiration).Seconds()))
+	}
+	return session, user, true
+}
 
-			token := session.token
-			// Calculate a HMAC signature of the cookie name and value, using SHA256 and a secret key.
-			mac := hmac.New(sha256.New, []byte(signingKey))
-			mac.Write([]byte(cookieName))
-			mac.Write([]byte(token))
-			signature := mac.Sum(nil)
+// refreshSession creates a new session for the remembered device of the request rotating its token
+func refreshSession(w http.ResponseWriter, r *http.Request, signingKey string, sessionService sessionService, rememberStore *rememberStore, userStore users.Store) (*session, users.User, bool) {
+	cookie, err := r.Cookie(rememberCookieName)
+	if err != nil {
+		return nil, users.User{}, false
+	}
+	device, token, err := rememberStore.refresh(cookie.Value, r.UserAgent(), remoteIP(r))
+	if err != nil {
+		if errors.Is(err, errRememberReused) {
+			log.Printf("the token of a remembered device of %s was reused from %s, the device was forgotten", device.Username, remoteIP(r))
+		}
+		http.SetCookie(w, &http.Cookie{Name: rememberCookieName, Path: "/", MaxAge: -1})
+		return nil, users.User{}, false
+	}
 
-			// Prepend the token with the HMAC signature and encode it to base64.
-			cookieValue := base64.URLEncoding.EncodeToString([]byte(string(signature) + token))
+	// The user could have been disabled or logged out everywhere after remembering the device
+	user, err := userStore.User(device.Username)
+	if err != nil || user.Disabled || user.SessionGeneration != device.Generation {
+		err = rememberStore.forgetByID(device.id)
+		if err != nil {
+			log.Printf("could not forget remembered device: %v", err)
+		}
+		http.SetCookie(w, &http.Cookie{Name: rememberCookieName, Path: "/", MaxAge: -1})
+		return nil, users.User{}, false
+	}
+
+	session, err := sessionService.createSession(user.Username, r.UserAgent(), remoteIP(r))
+	if err != nil {
+		log.Printf("unable to create session: %v", err)
+		return nil, users.User{}, false
+	}
+	setSessionCookie(w, signingKey, session.token, int(time.Until(session.expirationTimestamp).Seconds()))
+	if token != "" {
+		setRememberCookie(w, token, rememberStore.maxAge)
+	}
+	return session, user, true
+}
+
+// setSessionCookie sets the cookie with the token signed with the signing key
+func setSessionCookie(w http.ResponseWriter, signingKey string, token string, maxSessionAgeSeconds int) {
+	// Calculate a HMAC signature of the cookie name and value, using SHA256 and a secret key.
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(cookieName))
+	mac.Write([]byte(token))
+	signature := mac.Sum(nil)
+
+	// Prepend the token with the HMAC signature and encode it to base64.
+	cookieValue := base64.URLEncoding.EncodeToString([]byte(string(signature) + token))
+
+	cookie := &http.Cookie{
+		Name:     cookieName,
+		Value:    cookieValue,
+		Path:     "/",
+		MaxAge:   maxSessionAgeSeconds,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		HttpOnly: true,
+	}
+	http.SetCookie(w, cookie)
+}
+
+// setRememberCookie sets the cookie with the token of the remembered device
+func setRememberCookie(w http.ResponseWriter, token string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     rememberCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		HttpOnly: true,
+	})
+}
 
-			cookie := &http.Cookie{
-				Name:     cookieName,
-				Value:    cookieValue,
-				MaxAge:   maxSessionAgeSeconds,
-				Secure:   true,
-				SameSite: http.SameSiteStrictMode,
-				HttpOnly: true,
+func index(libraryPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var years, albums []library.Album
+		for _, folder := range library.Years(libraryPath) {
+			if !canAccess(r, folder) {
+				continue
+			}
+			album, err := library.Summary(libraryPath, folder)
+			if err != nil {
+				log.Printf("error summarizing folder %s. %v", folder, err)
+				continue
+			}
+			if album.MetadataError != nil {
+				log.Printf("%v", album.MetadataError)
 			}
-			http.SetCookie(w, cookie)
+			if library.IsYear(folder) {
+				years = append(years, album)
+			} else {
+				albums = append(albums, album)
+			}
+		}
 
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+		// Sort years in descending natural sort order
+		slices.SortFunc(years, func(a, b library.Album) int {
+			return cmp.Or(compareOrder(a, b), strings.Compare(b.Name, a.Name))
+		})
+		// Sort albums alphabetically by title
+		slices.SortFunc(albums, func(a, b library.Album) int {
+			return cmp.Or(compareOrder(a, b), strings.Compare(strings.ToLower(a.DisplayName()), strings.ToLower(b.DisplayName())))
+		})
+
+		err := html.Index(w, currentUser(r), years, albums)
+		if err != nil {
+			html.InternalError(w)
+			log.Printf("error serving index. %v", err)
+			return
 		}
 	}
 }
 
-func auth(signingKey string, sessionService sessionService, authenticatedHandlerFunc http.HandlerFunc) http.HandlerFunc {
+// Folders with an order in the album file go first
+func compareOrder(a, b library.Album) int {
+	switch {
+	case a.Metadata.Order == b.Metadata.Order:
+		return 0
+	case a.Metadata.Order == 0:
+		return 1
+	case b.Metadata.Order == 0:
+		return -1
+	default:
+		return cmp.Compare(a.Metadata.Order, b.Metadata.Order)
+	}
+}
+
+func folder(libraryPath string, allowDelete bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie(cookieName)
+		folder := r.PathValue("folder")
+		// Hidden folders are not found so their names cannot be guessed
+		if !canAccess(r, folder) {
+			html.NotFound(w)
+			return
+		}
+
+		album, images, err := library.Folder(libraryPath, folder)
 		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			if errors.Is(err, library.ErrNotExist) {
+				html.NotFound(w)
+				return
+			}
+			html.InternalError(w)
 			return
 		}
+		if album.MetadataError != nil {
+			log.Printf("%v", album.MetadataError)
+		}
 
-		signedToken, err := base64.URLEncoding.DecodeString(cookie.Value)
+		filter := parseFilter(r)
+		options := selection(r, libraryPath, allowDelete)
+		options.Folder = folder
+		if library.IsYear(folder) {
+			err = html.Year(w, currentUser(r), album, images, filter, options)
+		} else {
+			err = html.Album(w, currentUser(r), album, images, filter, options)
+		}
 		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			html.InternalError(w)
+			log.Printf("error serving folder %s. %v", folder, err)
 			return
 		}
+	}
+}
 
-		// Check that the signed token is at least the size of the signature
-		if len(signedToken) < sha256.Size {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+func detail(libraryPath string, itemCatalog catalog.Catalog, allowDelete bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemPath := r.PathValue("path")
+		if !canAccess(r, itemPath) {
+			html.NotFound(w)
 			return
 		}
 
-		// Split apart the signature and the token.
-		signature := signedToken[:sha256.Size]
-		token := signedToken[sha256.Size:]
+		image, err := library.Item(libraryPath, itemPath)
+		if err != nil {
+			if errors.Is(err, library.ErrNotExist) {
+				html.NotFound(w)
+				return
+			}
+			html.InternalError(w)
+			log.Printf("error reading item %s. %v", itemPath, err)
+			return
+		}
 
-		// Recalculate the HMAC signature of the cookie name and the token.
-		mac := hmac.New(sha256.New, []byte(signingKey))
-		mac.Write([]byte(cookieName))
-		mac.Write([]byte(token))
-		expectedSignature := mac.Sum(nil)
+		var exif library.Exif
+		if !image.IsVideo() {
+			exif, err = library.ReadExif(path.Join(libraryPath, image.Path))
+			if err != nil {
+				log.Printf("could not read exif data of %s. %v", image.Path, err)
+			}
+		}
 
-		if !hmac.Equal(signature, expectedSignature) {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+		var history []catalog.AuditEvent
+		if image.Hash != "" {
+			history, err = itemCatalog.History(image.Hash)
+			if err != nil {
+				log.Printf("could not read history of %s. %v", image.Path, err)
+			}
+		}
+
+		err = html.Detail(w, currentUser(r), image, exif, history, allowDelete && currentUser(r).IsContributor())
+		if err != nil {
+			html.InternalError(w)
+			log.Printf("error serving detail. %v", err)
 			return
 		}
+	}
+}
+
+func parseFilter(r *http.Request) html.Filter {
+	values := r.URL.Query()
+	filter := html.Filter{Tag: values.Get("tag")}
+	filter.Favourite, _ = strconv.ParseBool(values.Get("favourite"))
+	filter.MinRating, _ = strconv.Atoi(values.Get("rating"))
+	return filter
+}
 
-		session, err := sessionService.session(string(token))
+func favourite(libraryPath string, itemCatalog catalog.Catalog, searchIndex *search.Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		favourite, err := strconv.ParseBool(r.FormValue("favourite"))
 		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			http.Error(w, "favourite must be a boolean", http.StatusBadRequest)
+			return
+		}
+
+		updateItem(w, r, libraryPath, itemCatalog, searchIndex, func(entry *catalog.Entry) { entry.Favourite = favourite })
+	}
+}
+
+func rating(libraryPath string, itemCatalog catalog.Catalog, searchIndex *search.Index, writeXMPSidecars bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rating, err := strconv.Atoi(r.FormValue("rating"))
+		if err != nil || rating < 0 || rating > 5 {
+			http.Error(w, "rating must be a number from 0 to 5", http.StatusBadRequest)
 			return
 		}
 
-		if string(token) != session.token || session.expirationTimestamp.Before(time.Now().UTC()) {
-			err = sessionService.deleteSession(string(token))
+		ok := updateItem(w, r, libraryPath, itemCatalog, searchIndex, func(entry *catalog.Entry) { entry.Rating = rating })
+		if ok && writeXMPSidecars {
+			err = library.WriteSidecarRating(libraryPath, r.PathValue("path"), rating)
 			if err != nil {
-				log.Printf("could not delete session: %v", err)
+				log.Printf("could not write rating to sidecar. %v", err)
 			}
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
 		}
-		authenticatedHandlerFunc(w, r)
 	}
 }
 
-func index(libraryPath string) http.HandlerFunc {
+// updateItem updates the catalog entry of the item of the path and redirects to its detail page
+func updateItem(w http.ResponseWriter, r *http.Request, libraryPath string, itemCatalog catalog.Catalog, searchIndex *search.Index, update func(entry *catalog.Entry)) bool {
+	itemPath := r.PathValue("path")
+	if !canAccess(r, itemPath) {
+		http.NotFound(w, r)
+		return false
+	}
+	image, err := library.Item(libraryPath, itemPath)
+	if err != nil {
+		if errors.Is(err, library.ErrNotExist) {
+			http.NotFound(w, r)
+			return false
+		}
+		log.Printf("error reading item %s. %v", itemPath, err)
+		http.Error(w, "unexpected error", http.StatusInternalServerError)
+		return false
+	}
+	if image.Hash == "" {
+		http.Error(w, "item could not be hashed", http.StatusInternalServerError)
+		return false
+	}
+
+	err = itemCatalog.Update(image.Hash, actor(r), itemPath, update)
+	if err != nil {
+		log.Printf("error updating catalog entry of %s. %v", itemPath, err)
+		http.Error(w, "unexpected error", http.StatusInternalServerError)
+		return false
+	}
+	// The search index contains the data of the catalog
+	err = searchIndex.Update(libraryPath, itemPath)
+	if err != nil {
+		log.Printf("could not update %s in the search index. %v", itemPath, err)
+	}
+
+	http.Redirect(w, r, "/view/"+itemPath, http.StatusSeeOther)
+	return true
+}
+
+func edit(libraryPath string, itemCatalog catalog.Catalog, searchIndex *search.Index) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		years := library.Years(libraryPath)
+		caption := strings.TrimSpace(r.FormValue("caption"))
+		timeZone := strings.TrimSpace(r.FormValue("timezone"))
+		date := r.FormValue("date")
 
-		// Sort years in descending natural sort order
-		slices.SortFunc(years, func(a, b string) int { return strings.Compare(b, a) })
+		location, err := time.LoadLocation(timeZone)
+		if err != nil {
+			http.Error(w, "unknown time zone "+timeZone, http.StatusBadRequest)
+			return
+		}
+		// An empty date removes the override
+		var creationTime time.Time
+		if date != "" {
+			creationTime, err = time.ParseInLocation(dateTimeLocalLayout, date, location)
+			if err != nil {
+				http.Error(w, "date must be a date and time like 2006-01-02T15:04", http.StatusBadRequest)
+				return
+			}
+		} else {
+			timeZone = ""
+		}
 
-		err := html.Index(w, years)
+		updateItem(w, r, libraryPath, itemCatalog, searchIndex, func(entry *catalog.Entry) {
+			entry.Caption = caption
+			entry.CreationTime = creationTime
+			entry.TimeZone = timeZone
+		})
+	}
+}
+
+func archive(libraryPath string, itemCatalog catalog.Catalog, searchIndex *search.Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		archived, err := strconv.ParseBool(r.FormValue("archived"))
 		if err != nil {
-			html.InternalError(w)
-			log.Printf("error serving index. %v", err)
+			http.Error(w, "archived must be a boolean", http.StatusBadRequest)
 			return
 		}
+
+		updateItem(w, r, libraryPath, itemCatalog, searchIndex, func(entry *catalog.Entry) { entry.Archived = archived })
 	}
 }
 
-func year(libraryPath string) http.HandlerFunc {
+func archived(libraryPath string, allowDelete bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		year := r.PathValue("year")
+		var images []library.Image
+		for _, folder := range library.Years(libraryPath) {
+			if !canAccess(r, folder) {
+				continue
+			}
+			folderImages, err := library.YearWithArchived(libraryPath, folder)
+			if err != nil {
+				html.InternalError(w)
+				log.Printf("error reading folder %s. %v", folder, err)
+				return
+			}
+			for _, image := range folderImages {
+				if image.Archived {
+					images = append(images, image)
+				}
+			}
+		}
+		slices.SortFunc(images, func(a, b library.Image) int { return b.CreationTime.Compare(a.CreationTime) })
 
-		images, err := library.Year(libraryPath, year)
+		err := html.Album(w, currentUser(r), library.Album{Name: "Archive"}, images, parseFilter(r), selection(r, libraryPath, allowDelete))
 		if err != nil {
-			if errors.Is(err, library.ErrNotExist) {
-				html.NotFound(w)
+			html.InternalError(w)
+			log.Printf("error serving archive. %v", err)
+			return
+		}
+	}
+}
+
+// actor identifies who made a request in the audit log
+func actor(r *http.Request) string {
+	if user := currentUser(r); user.Username != "" {
+		return user.Username
+	}
+	return remoteIP(r)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func favourites(libraryPath string, allowDelete bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var images []library.Image
+		for _, folder := range library.Years(libraryPath) {
+			if !canAccess(r, folder) {
+				continue
+			}
+			folderImages, err := library.Year(libraryPath, folder)
+			if err != nil {
+				html.InternalError(w)
+				log.Printf("error reading folder %s. %v", folder, err)
 				return
 			}
+			for _, image := range folderImages {
+				if image.Favourite {
+					images = append(images, image)
+				}
+			}
+		}
+		slices.SortFunc(images, func(a, b library.Image) int { return b.CreationTime.Compare(a.CreationTime) })
+
+		err := html.Album(w, currentUser(r), library.Album{Name: "Favourites"}, images, parseFilter(r), selection(r, libraryPath, allowDelete))
+		if err != nil {
 			html.InternalError(w)
+			log.Printf("error serving favourites. %v", err)
 			return
 		}
+	}
+}
 
-		slices.SortFunc(images, func(a, b library.Image) int { return b.ModTime.Compare(a.ModTime) })
+func tags(searchIndex *search.Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := html.Tags(w, currentUser(r), searchIndex.Tags(accessFromContext(r.Context()).CanAccess))
+		if err != nil {
+			html.InternalError(w)
+			log.Printf("error serving tags. %v", err)
+			return
+		}
+	}
+}
 
-		err = html.Year(w, images)
+func searchPage(searchIndex *search.Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var result search.Result
+		query, err := parseSearchQuery(r)
+		if err == nil {
+			result = searchIndex.Search(query)
+		}
+
+		err = html.Search(w, currentUser(r), r.URL.Query(), result, err)
 		if err != nil {
 			html.InternalError(w)
-			log.Printf("error serving year. %v", err)
+			log.Printf("error serving search. %v", err)
 			return
 		}
 	}
 }
 
-func logout(sessionService sessionService) http.HandlerFunc {
+func searchAPI(searchIndex *search.Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query, err := parseSearchQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(searchIndex.Search(query))
+		if err != nil {
+			log.Printf("error encoding search result. %v", err)
+		}
+	}
+}
+
+func parseSearchQuery(r *http.Request) (search.Query, error) {
+	values := r.URL.Query()
+	query := search.Query{
+		Text:        values.Get("q"),
+		Year:        values.Get("year"),
+		MediaType:   values.Get("type"),
+		Camera:      values.Get("camera"),
+		Tag:         values.Get("tag"),
+		HasLocation: values.Get("location"),
+		Visible:     accessFromContext(r.Context()).CanAccess,
+	}
+
+	var err error
+	if from := values.Get("from"); from != "" {
+		query.From, err = time.Parse(time.DateOnly, from)
+		if err != nil {
+			return search.Query{}, fmt.Errorf("from must be a date like 2006-01-02. %w", err)
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		query.To, err = time.Parse(time.DateOnly, to)
+		if err != nil {
+			return search.Query{}, fmt.Errorf("to must be a date like 2006-01-02. %w", err)
+		}
+		// Include the whole day
+		query.To = query.To.Add(24*time.Hour - time.Nanosecond)
+	}
+	if offset := values.Get("offset"); offset != "" {
+		query.Offset, err = strconv.Atoi(offset)
+		if err != nil {
+			return search.Query{}, fmt.Errorf("offset must be a number. %w", err)
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			return search.Query{}, fmt.Errorf("limit must be a number. %w", err)
+		}
+	}
+	return query, nil
+}
+
+func logout(sessionService sessionService, rememberStore *rememberStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		cookie, err := r.Cookie(cookieName)
 		if err != nil {
@@ -233,9 +906,18 @@ func logout(sessionService sessionService) http.HandlerFunc {
 		if err != nil {
 			log.Printf("could not delete session. %v", err)
 		}
+		// Logging out also forgets the device
+		if remember, err := r.Cookie(rememberCookieName); err == nil {
+			err = rememberStore.forget(remember.Value)
+			if err != nil {
+				log.Printf("could not forget remembered device. %v", err)
+			}
+			http.SetCookie(w, &http.Cookie{Name: rememberCookieName, Path: "/", MaxAge: -1})
+		}
 
 		cookie = &http.Cookie{
 			Name:   cookieName,
+			Path:   "/",
 			MaxAge: -1,
 		}
 		http.SetCookie(w, cookie)
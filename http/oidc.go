@@ -0,0 +1,206 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"davidc.es/jag/configuration"
+	"davidc.es/jag/html"
+	"davidc.es/jag/oidc"
+	"davidc.es/jag/users"
+)
+
+// Name of the cookie with the state, the nonce and the code verifier of the login with the identity provider in progress
+const oidcCookieName string = "oidc"
+
+// Time to log in with the identity provider
+const oidcLoginTTL time.Duration = 10 * time.Minute
+
+const oidcCallbackPath string = "/login/oidc/callback"
+
+// singleSignOn logs in the users of an OpenID Connect provider, creating their accounts the first time
+type singleSignOn struct {
+	provider      *oidc.Provider
+	name          string
+	usernameClaim string
+	groupsClaim   string
+	groupRoles    map[string]users.Role
+	defaultRole   users.Role
+}
+
+// newSingleSignOn returns the single sign-on of the configuration, nil when it is disabled
+func newSingleSignOn(configuration configuration.Configuration) (*singleSignOn, error) {
+	if configuration.OIDCIssuer() == "" {
+		return nil, nil
+	}
+	s := &singleSignOn{
+		provider:      oidc.New(configuration.OIDCIssuer(), configuration.OIDCClientID(), configuration.OIDCClientSecret(), configuration.OIDCScopes()),
+		name:          configuration.OIDCName(),
+		usernameClaim: configuration.OIDCUsernameClaim(),
+		groupsClaim:   configuration.OIDCGroupsClaim(),
+		groupRoles:    make(map[string]users.Role),
+	}
+	for group, name := range configuration.OIDCGroupRoles() {
+		role, err := users.ParseRole(name)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing role of group %s. %w", group, err)
+		}
+		s.groupRoles[group] = role
+	}
+	if configuration.OIDCDefaultRole() != "" {
+		role, err := users.ParseRole(configuration.OIDCDefaultRole())
+		if err != nil {
+			return nil, fmt.Errorf("error parsing default role. %w", err)
+		}
+		s.defaultRole = role
+	}
+	return s, nil
+}
+
+// role returns the highest role of the groups, the default role when none of them has one
+func (s *singleSignOn) role(groups []string) users.Role {
+	role := s.defaultRole
+	for _, group := range groups {
+		if groupRole, ok := s.groupRoles[group]; ok && (role == "" || groupRole.Allows(role)) {
+			role = groupRole
+		}
+	}
+	return role
+}
+
+// oidcLogin redirects the user to the identity provider
+func oidcLogin(signingKey string, publicURL string, singleSignOn *singleSignOn, rememberStore *rememberStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state, nonce, codeVerifier := oidc.NewRandom(), oidc.NewRandom(), oidc.NewRandom()
+		authURL, err := singleSignOn.provider.AuthURL(r.Context(), relyingPartyOrigin(r, publicURL)+oidcCallbackPath, state, nonce, codeVerifier)
+		if err != nil {
+			log.Printf("error starting login with %s. %v", singleSignOn.name, err)
+			renderLogin(w, http.StatusBadGateway, rememberStore, singleSignOn, "Unable to reach "+singleSignOn.name+", try again later.")
+			return
+		}
+		setOIDCLogin(w, signingKey, state, nonce, codeVerifier)
+		http.Redirect(w, r, authURL, http.StatusSeeOther)
+	}
+}
+
+// oidcCallback logs in the user the identity provider redirected back with the code. The identity provider
+// is in charge of the second factor, so the two-factor authentication of the gallery is skipped.
+func oidcCallback(signingKeys []string, publicURL string, singleSignOn *singleSignOn, userStore users.Store, maxSessionAgeSeconds int, sessionService sessionService, rememberStore *rememberStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state, nonce, codeVerifier, ok := oidcLoginState(r, signingKeys)
+		http.SetCookie(w, &http.Cookie{Name: oidcCookieName, Path: "/login/oidc", MaxAge: -1})
+		if !ok || !hmac.Equal([]byte(r.FormValue("state")), []byte(state)) {
+			renderLogin(w, http.StatusBadRequest, rememberStore, singleSignOn, "The login expired, try again.")
+			return
+		}
+		if r.FormValue("error") != "" {
+			log.Printf("login with %s from %s failed. %s %s", singleSignOn.name, remoteIP(r), r.FormValue("error"), r.FormValue("error_description"))
+			renderLogin(w, http.StatusUnauthorized, rememberStore, singleSignOn, "The login with "+singleSignOn.name+" was not completed.")
+			return
+		}
+
+		claims, err := singleSignOn.provider.Exchange(r.Context(), relyingPartyOrigin(r, publicURL)+oidcCallbackPath, r.FormValue("code"), codeVerifier, nonce)
+		if err != nil {
+			log.Printf("invalid login with %s from %s. %v", singleSignOn.name, remoteIP(r), err)
+			renderLogin(w, http.StatusUnauthorized, rememberStore, singleSignOn, "The login with "+singleSignOn.name+" failed, try again.")
+			return
+		}
+		username := claims.String(singleSignOn.usernameClaim)
+		role := singleSignOn.role(claims.Strings(singleSignOn.groupsClaim))
+		if role == "" {
+			log.Printf("%s of %s has no role", username, singleSignOn.name)
+			renderLogin(w, http.StatusForbidden, rememberStore, singleSignOn, "Your account has no access to the gallery.")
+			return
+		}
+		// The subjects are only unique in their issuer
+		user, err := userStore.OIDCUser(claims.String("iss")+" "+claims.String("sub"), username, role)
+		if errors.Is(err, users.ErrAlreadyExists) {
+			log.Printf("%s of %s is already a user of the gallery", username, singleSignOn.name)
+			renderLogin(w, http.StatusConflict, rememberStore, singleSignOn, "The username "+username+" is already used by another account of the gallery.")
+			return
+		}
+		if errors.Is(err, users.ErrInvalidUsername) {
+			log.Printf("invalid username %q of %s", username, singleSignOn.name)
+			renderLogin(w, http.StatusForbidden, rememberStore, singleSignOn, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("error creating user %s of %s. %v", username, singleSignOn.name, err)
+			renderLogin(w, http.StatusInternalServerError, rememberStore, singleSignOn, "Unexpected error, try again.")
+			return
+		}
+		if user.Disabled {
+			renderLogin(w, http.StatusForbidden, rememberStore, singleSignOn, "Your account is disabled.")
+			return
+		}
+
+		err = startSession(w, r, signingKeys[0], maxSessionAgeSeconds, sessionService, rememberStore, user, false)
+		if err != nil {
+			log.Printf("unable to create session: %v", err)
+			renderLogin(w, http.StatusInternalServerError, rememberStore, singleSignOn, "Unexpected error, try again.")
+			return
+		}
+		// A redirect would be part of the cross-site navigation from the identity provider, without the strict session cookie
+		err = html.LoggedIn(w)
+		if err != nil {
+			log.Printf("error serving logged in page. %v", err)
+		}
+	}
+}
+
+// setOIDCLogin sets the cookie that binds the redirect back from the identity provider to this browser.
+// It is sent with the redirect from the identity provider, which is a cross-site navigation.
+func setOIDCLogin(w http.ResponseWriter, signingKey string, state string, nonce string, codeVerifier string) {
+	payload := state + "\n" + nonce + "\n" + codeVerifier + "\n" + strconv.FormatInt(time.Now().Add(oidcLoginTTL).Unix(), 10)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + oidcLoginSignature(signingKey, payload),
+		Path:     "/login/oidc",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		HttpOnly: true,
+	})
+}
+
+// oidcLoginState returns the state, the nonce and the code verifier of the login in progress
+func oidcLoginState(r *http.Request, signingKeys []string) (string, string, string, bool) {
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		return "", "", "", false
+	}
+	encoded, signature, _ := strings.Cut(cookie.Value, ".")
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", "", false
+	}
+	payload := string(b)
+	valid := slices.ContainsFunc(signingKeys, func(signingKey string) bool {
+		return hmac.Equal([]byte(signature), []byte(oidcLoginSignature(signingKey, payload)))
+	})
+	fields := strings.Split(payload, "\n")
+	if !valid || len(fields) != 4 {
+		return "", "", "", false
+	}
+	expiration, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil || time.Now().Unix() > expiration {
+		return "", "", "", false
+	}
+	return fields[0], fields[1], fields[2], true
+}
+
+func oidcLoginSignature(signingKey string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(oidcCookieName))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,397 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"davidc.es/jag/html"
+	"davidc.es/jag/jsonfile"
+	"davidc.es/jag/users"
+	"davidc.es/jag/webauthn"
+)
+
+// Name of the cookie with the challenge of the passkey ceremony in progress
+const ceremonyCookieName string = "webauthn"
+
+// Name of the file of the challenges of the completed ceremonies in the data path
+const usedChallengesFileName string = "challenges.json"
+
+// Time to complete a passkey ceremony, also passed to the browser
+const ceremonyTTL time.Duration = 5 * time.Minute
+
+// Purposes of the ceremonies so the challenge of one cannot be used for the other
+const (
+	ceremonyRegistration string = "registration"
+	ceremonyLogin        string = "login"
+)
+
+// Relying party name shown by the authenticators
+const relyingPartyName string = "jag"
+
+type passkeyRegistration struct {
+	Name              string `json:"name"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+}
+
+type passkeyAssertion struct {
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle"`
+	Remember          bool   `json:"remember"`
+}
+
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// usedChallenges keeps the challenges of the completed ceremonies until their cookies expire,
+// so a ceremony cannot be completed again with a copy of the cookie. They are kept in a file of the data path
+// so the ceremony cannot be completed again in another server either.
+type usedChallenges struct {
+	mu sync.Mutex
+	// Empty to keep them only in memory
+	filePath   string
+	expiration map[string]time.Time
+}
+
+func newUsedChallenges(filePath string) *usedChallenges {
+	return &usedChallenges{filePath: filePath, expiration: make(map[string]time.Time)}
+}
+
+// use records the challenge and returns false when it was already used or it could not be recorded
+func (u *usedChallenges) use(challenge string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.filePath != "" {
+		unlock, err := jsonfile.Lock(u.filePath)
+		if err != nil {
+			log.Printf("could not lock the used challenges. %v", err)
+			return false
+		}
+		defer unlock()
+		expiration, err := readUsedChallenges(u.filePath)
+		if err != nil {
+			log.Printf("could not read the used challenges. %v", err)
+			return false
+		}
+		u.expiration = expiration
+	}
+
+	now := time.Now()
+	for used, expiration := range u.expiration {
+		if now.After(expiration) {
+			delete(u.expiration, used)
+		}
+	}
+	if _, ok := u.expiration[challenge]; ok {
+		return false
+	}
+	// The cookie of the challenge expires at most the time of the ceremony after it was set
+	u.expiration[challenge] = now.Add(ceremonyTTL)
+
+	if u.filePath != "" {
+		err := jsonfile.Write(u.filePath, u.expiration)
+		if err != nil {
+			log.Printf("could not record the used challenge. %v", err)
+			return false
+		}
+	}
+	return true
+}
+
+func readUsedChallenges(filePath string) (map[string]time.Time, error) {
+	expiration := make(map[string]time.Time)
+	b, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return expiration, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s. %w", filePath, err)
+	}
+	err = json.Unmarshal(b, &expiration)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s. %w", filePath, err)
+	}
+	return expiration, nil
+}
+
+// passkeysPage lists the passkeys of the user
+func passkeysPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := html.Passkeys(w, currentUser(r))
+		if err != nil {
+			html.InternalError(w)
+			log.Printf("error serving passkeys. %v", err)
+			return
+		}
+	}
+}
+
+// passkeyRegistrationOptions returns the options of navigator.credentials.create for a discoverable credential
+// verified by the authenticator, so the passkey can log in without the username nor the password
+func passkeyRegistrationOptions(signingKey string, publicURL string, userStore users.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		userHandle, err := userStore.WebAuthnID(user.Username)
+		if err != nil {
+			log.Printf("error creating user handle of %s. %v", user.Username, err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		challenge := webauthn.NewChallenge()
+		setCeremony(w, signingKey, ceremonyRegistration, challenge, user.Username)
+
+		var params []map[string]any
+		for _, alg := range webauthn.Algorithms {
+			params = append(params, map[string]any{"type": "public-key", "alg": alg})
+		}
+		// The authenticators refuse to register a second passkey of the same user
+		exclude := []credentialDescriptor{}
+		for _, passkey := range user.Passkeys {
+			exclude = append(exclude, credentialDescriptor{Type: "public-key", ID: passkey.ID})
+		}
+		writeJSON(w, map[string]any{
+			"challenge": challenge,
+			"rp":        map[string]string{"id": relyingPartyID(r, publicURL), "name": relyingPartyName},
+			"user": map[string]string{
+				"id":          userHandle,
+				"name":        user.Username,
+				"displayName": user.Username,
+			},
+			"pubKeyCredParams": params,
+			"timeout":          ceremonyTTL.Milliseconds(),
+			"attestation":      "none",
+			"authenticatorSelection": map[string]any{
+				"residentKey":        "required",
+				"requireResidentKey": true,
+				"userVerification":   "required",
+			},
+			"excludeCredentials": exclude,
+		})
+	}
+}
+
+func registerPasskey(signingKeys []string, publicURL string, userStore users.Store, usedChallenges *usedChallenges) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		challenge, ok := ceremony(r, signingKeys, ceremonyRegistration, user.Username)
+		if !ok || !usedChallenges.use(challenge) {
+			http.Error(w, "the registration expired, try again", http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: ceremonyCookieName, Path: "/", MaxAge: -1})
+
+		var registration passkeyRegistration
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&registration)
+		if err != nil {
+			http.Error(w, "invalid registration", http.StatusBadRequest)
+			return
+		}
+		clientDataJSON, err1 := base64.RawURLEncoding.DecodeString(registration.ClientDataJSON)
+		attestationObject, err2 := base64.RawURLEncoding.DecodeString(registration.AttestationObject)
+		if err1 != nil || err2 != nil {
+			http.Error(w, "invalid registration", http.StatusBadRequest)
+			return
+		}
+		credential, err := webauthn.VerifyRegistration(relyingPartyID(r, publicURL), relyingPartyOrigin(r, publicURL), challenge, clientDataJSON, attestationObject)
+		if err != nil {
+			log.Printf("invalid passkey registration of %s. %v", user.Username, err)
+			http.Error(w, "invalid registration", http.StatusBadRequest)
+			return
+		}
+
+		err = userStore.AddPasskey(user.Username, users.Passkey{
+			ID:        base64.RawURLEncoding.EncodeToString(credential.ID),
+			Name:      registration.Name,
+			PublicKey: credential.PublicKey,
+			SignCount: credential.SignCount,
+		})
+		if errors.Is(err, users.ErrPasskeyExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("error adding passkey of %s. %v", user.Username, err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s added a passkey", actor(r))
+
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func removePasskey(userStore users.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := userStore.RemovePasskey(currentUser(r).Username, r.PathValue("id"))
+		if errors.Is(err, users.ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("error removing passkey. %v", err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s removed a passkey", actor(r))
+
+		http.Redirect(w, r, "/passkeys", http.StatusSeeOther)
+	}
+}
+
+// passkeyLoginOptions returns the options of navigator.credentials.get without allowed credentials
+// so the authenticator offers the discoverable passkeys of the gallery
+func passkeyLoginOptions(signingKey string, publicURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		challenge := webauthn.NewChallenge()
+		setCeremony(w, signingKey, ceremonyLogin, challenge, "")
+		writeJSON(w, map[string]any{
+			"challenge":        challenge,
+			"rpId":             relyingPartyID(r, publicURL),
+			"timeout":          ceremonyTTL.Milliseconds(),
+			"userVerification": "required",
+			"allowCredentials": []credentialDescriptor{},
+		})
+	}
+}
+
+// passkeyLogin logs in the user of the passkey. The authenticator verified the user with a PIN or biometrics,
+// so the passkey replaces both the password and the second factor.
+func passkeyLogin(signingKeys []string, publicURL string, userStore users.Store, maxSessionAgeSeconds int, sessionService sessionService, rememberStore *rememberStore, usedChallenges *usedChallenges) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		challenge, ok := ceremony(r, signingKeys, ceremonyLogin, "")
+		if !ok || !usedChallenges.use(challenge) {
+			http.Error(w, "the login expired, try again", http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: ceremonyCookieName, Path: "/", MaxAge: -1})
+
+		var assertion passkeyAssertion
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&assertion)
+		if err != nil {
+			http.Error(w, "invalid passkey", http.StatusBadRequest)
+			return
+		}
+		clientDataJSON, err1 := base64.RawURLEncoding.DecodeString(assertion.ClientDataJSON)
+		authenticatorData, err2 := base64.RawURLEncoding.DecodeString(assertion.AuthenticatorData)
+		signature, err3 := base64.RawURLEncoding.DecodeString(assertion.Signature)
+		if err1 != nil || err2 != nil || err3 != nil {
+			http.Error(w, "invalid passkey", http.StatusBadRequest)
+			return
+		}
+
+		user, passkey, err := userStore.PasskeyUser(assertion.ID)
+		if err != nil || user.Disabled || (assertion.UserHandle != "" && assertion.UserHandle != user.WebAuthnID) {
+			log.Printf("login with unknown passkey from %s", remoteIP(r))
+			http.Error(w, "unknown passkey", http.StatusUnauthorized)
+			return
+		}
+		signCount, err := webauthn.VerifyAssertion(relyingPartyID(r, publicURL), relyingPartyOrigin(r, publicURL), challenge, passkey.PublicKey, passkey.SignCount, clientDataJSON, authenticatorData, signature)
+		if err != nil {
+			log.Printf("invalid passkey login of %s from %s. %v", user.Username, remoteIP(r), err)
+			http.Error(w, "invalid passkey", http.StatusUnauthorized)
+			return
+		}
+		err = userStore.UsePasskey(user.Username, passkey.ID, signCount)
+		if err != nil {
+			log.Printf("error updating passkey of %s. %v", user.Username, err)
+		}
+
+		err = startSession(w, r, signingKeys[0], maxSessionAgeSeconds, sessionService, rememberStore, user, assertion.Remember)
+		if err != nil {
+			log.Printf("unable to create session: %v", err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]string{"redirect": "/"})
+	}
+}
+
+// setCeremony sets the cookie with the challenge of the ceremony signed with the purpose and the username
+func setCeremony(w http.ResponseWriter, signingKey string, purpose string, challenge string, username string) {
+	payload := purpose + "\n" + challenge + "\n" + strconv.FormatInt(time.Now().Add(ceremonyTTL).Unix(), 10) + "\n" + username
+	http.SetCookie(w, &http.Cookie{
+		Name:     ceremonyCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + ceremonySignature(signingKey, payload),
+		Path:     "/",
+		MaxAge:   int(ceremonyTTL.Seconds()),
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		HttpOnly: true,
+	})
+}
+
+// ceremony returns the challenge of the ceremony of the purpose started by the user
+func ceremony(r *http.Request, signingKeys []string, purpose string, username string) (string, bool) {
+	cookie, err := r.Cookie(ceremonyCookieName)
+	if err != nil {
+		return "", false
+	}
+	encoded, signature, _ := strings.Cut(cookie.Value, ".")
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	payload := string(b)
+	valid := slices.ContainsFunc(signingKeys, func(signingKey string) bool {
+		return hmac.Equal([]byte(signature), []byte(ceremonySignature(signingKey, payload)))
+	})
+	fields := strings.Split(payload, "\n")
+	if !valid || len(fields) != 4 || fields[0] != purpose || fields[3] != username {
+		return "", false
+	}
+	expiration, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || time.Now().Unix() > expiration {
+		return "", false
+	}
+	return fields[1], true
+}
+
+func ceremonySignature(signingKey string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(ceremonyCookieName))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// relyingPartyOrigin is the origin the browser reports in the ceremonies, the public URL or the one of the request
+func relyingPartyOrigin(r *http.Request, publicURL string) string {
+	if publicURL != "" {
+		return publicURL
+	}
+	return absoluteURL(r, "")
+}
+
+// relyingPartyID is the host name the passkeys are bound to
+func relyingPartyID(r *http.Request, publicURL string) string {
+	u, err := url.Parse(relyingPartyOrigin(r, publicURL))
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Printf("error encoding response. %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+package http
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"davidc.es/jag/jsonfile"
+)
+
+const rememberFileName string = "remember.json"
+
+// Name of the cookie with the refresh token of the remembered devices
+const rememberCookieName string = "remember"
+
+// The previous token of a remembered device is still accepted during this time after rotating it,
+// so the parallel requests of the browser sent before receiving the new token do not look like a reuse
+const rememberGracePeriod time.Duration = 30 * time.Second
+
+var (
+	errRememberNotFound = errors.New("remembered device not found")
+	// errRememberReused is returned when an old token is used again, which means it was stolen
+	errRememberReused = errors.New("remembered device token reused")
+)
+
+// rememberStore keeps the refresh tokens of the devices remembered at login. Every time a token is used
+// to create a new session it is replaced by a new one, and using an old token again forgets the device.
+// The tokens are stored by their hash in a file when it has a file path, otherwise only in memory.
+type rememberStore struct {
+	mu       sync.Mutex
+	filePath string
+	devices  map[string]rememberedDevice
+	// Modification time of the file when it was last read or written, other servers sharing the data path can change it
+	modTime time.Time
+	maxAge  time.Duration
+}
+
+type rememberedDevice struct {
+	id                string
+	Username          string    `json:"username"`
+	TokenHash         string    `json:"tokenHash"`
+	PreviousTokenHash string    `json:"previousTokenHash,omitempty"`
+	RotationTimestamp time.Time `json:"rotationTimestamp"`
+	// Session generation of the user when the device was remembered
+	Generation          int       `json:"generation"`
+	ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+	CreationTimestamp   time.Time `json:"creationTimestamp"`
+	LastSeenTimestamp   time.Time `json:"lastSeenTimestamp"`
+	UserAgent           string    `json:"userAgent,omitempty"`
+	IP                  string    `json:"ip,omitempty"`
+}
+
+func newRememberStore(filePath string, rememberDays int) (*rememberStore, error) {
+	s := &rememberStore{
+		filePath: filePath,
+		devices:  make(map[string]rememberedDevice),
+		maxAge:   time.Duration(rememberDays) * 24 * time.Hour,
+	}
+	if filePath == "" {
+		return s, nil
+	}
+	err := os.MkdirAll(path.Dir(filePath), os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("error creating data directory %s. %w", path.Dir(filePath), err)
+	}
+	err = s.reload()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// enabled returns whether the devices can be remembered
+func (s *rememberStore) enabled() bool {
+	return s.maxAge > 0
+}
+
+// remember stores a new remembered device returning its token
+func (s *rememberStore) remember(username string, generation int, userAgent string, ip string) (string, error) {
+	id := newToken(16)
+	secret := newToken(32)
+	now := time.Now().UTC()
+	err := s.update(func(devices map[string]rememberedDevice) error {
+		devices[id] = rememberedDevice{
+			Username:            username,
+			TokenHash:           hashSecret(secret),
+			RotationTimestamp:   now,
+			Generation:          generation,
+			ExpirationTimestamp: now.Add(s.maxAge),
+			CreationTimestamp:   now,
+			LastSeenTimestamp:   now,
+			UserAgent:           userAgent,
+			IP:                  ip,
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return id + "." + secret, nil
+}
+
+// refresh checks the token of a remembered device and replaces it with a new one, which is empty when the previous
+// token was used again during the grace period. Any other reuse forgets the device and returns errRememberReused.
+func (s *rememberStore) refresh(token string, userAgent string, ip string) (rememberedDevice, string, error) {
+	id, secret, _ := strings.Cut(token, ".")
+	hash := hashSecret(secret)
+	var device rememberedDevice
+	var newSecret string
+	reused := false
+	err := s.update(func(devices map[string]rememberedDevice) error {
+		stored, ok := devices[id]
+		if !ok {
+			return errRememberNotFound
+		}
+		now := time.Now().UTC()
+		switch {
+		case hmac.Equal([]byte(hash), []byte(stored.TokenHash)):
+			newSecret = newToken(32)
+			stored.PreviousTokenHash = stored.TokenHash
+			stored.TokenHash = hashSecret(newSecret)
+			stored.RotationTimestamp = now
+			stored.ExpirationTimestamp = now.Add(s.maxAge)
+		case hmac.Equal([]byte(hash), []byte(stored.PreviousTokenHash)) && now.Sub(stored.RotationTimestamp) < rememberGracePeriod:
+		default:
+			// Forget the device so neither the thief nor the owner can use it
+			delete(devices, id)
+			reused = true
+			device = stored
+			return nil
+		}
+		stored.LastSeenTimestamp = now
+		stored.UserAgent = userAgent
+		stored.IP = ip
+		devices[id] = stored
+		device = stored
+		device.id = id
+		return nil
+	})
+	if err != nil {
+		return rememberedDevice{}, "", err
+	}
+	if reused {
+		return device, "", errRememberReused
+	}
+	if newSecret == "" {
+		return device, "", nil
+	}
+	return device, id + "." + newSecret, nil
+}
+
+// userDevices returns the remembered devices of the user, most recently seen first
+func (s *rememberStore) userDevices(username string) []rememberedDevice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reload()
+	var devices []rememberedDevice
+	for id, device := range s.devices {
+		if device.Username == username && !expiredDevice(device) {
+			device.id = id
+			devices = append(devices, device)
+		}
+	}
+	slices.SortFunc(devices, func(a, b rememberedDevice) int {
+		return cmp.Or(b.LastSeenTimestamp.Compare(a.LastSeenTimestamp), b.CreationTimestamp.Compare(a.CreationTimestamp))
+	})
+	return devices
+}
+
+// forget removes the remembered device of the token
+func (s *rememberStore) forget(token string) error {
+	id, _, _ := strings.Cut(token, ".")
+	return s.forgetByID(id)
+}
+
+func (s *rememberStore) forgetByID(id string) error {
+	return s.update(func(devices map[string]rememberedDevice) error {
+		delete(devices, id)
+		return nil
+	})
+}
+
+// forgetUser removes all the remembered devices of the user
+func (s *rememberStore) forgetUser(username string) error {
+	return s.update(func(devices map[string]rememberedDevice) error {
+		for id, device := range devices {
+			if device.Username == username {
+				delete(devices, id)
+			}
+		}
+		return nil
+	})
+}
+
+// update modifies a copy of the remembered devices without the expired ones and writes them to disk before replacing the ones in memory
+func (s *rememberStore) update(update func(devices map[string]rememberedDevice) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Do not overwrite the changes of other servers
+	err := s.reload()
+	if err != nil {
+		return err
+	}
+
+	devices := make(map[string]rememberedDevice, len(s.devices))
+	for id, device := range s.devices {
+		if !expiredDevice(device) {
+			devices[id] = device
+		}
+	}
+	err = update(devices)
+	if err != nil {
+		return err
+	}
+
+	if s.filePath != "" {
+		err := jsonfile.Write(s.filePath, devices)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Stat(s.filePath); err == nil {
+			s.modTime = info.ModTime()
+		}
+	}
+	s.devices = devices
+	return nil
+}
+
+// reload reads the file again when it changed since it was last read or written. It must be called with the lock held.
+func (s *rememberStore) reload() error {
+	if s.filePath == "" {
+		return nil
+	}
+	info, err := os.Stat(s.filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading %s. %w", s.filePath, err)
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	b, err := os.ReadFile(s.filePath)
+	if err != nil {
+		return fmt.Errorf("error reading %s. %w", s.filePath, err)
+	}
+	devices := make(map[string]rememberedDevice)
+	err = json.Unmarshal(b, &devices)
+	if err != nil {
+		return fmt.Errorf("error decoding %s. %w", s.filePath, err)
+	}
+	s.devices = devices
+	s.modTime = info.ModTime()
+	return nil
+}
+
+func expiredDevice(device rememberedDevice) bool {
+	return !device.ExpirationTimestamp.After(time.Now())
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newToken(size int) string {
+	b := make([]byte, size)
+	// Ignore the error since it cannot fail. See source for more details
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,29 +1,103 @@
 package http
 
 import (
+	"cmp"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"sync"
 	"time"
+
+	"davidc.es/jag/jsonfile"
+	"davidc.es/jag/users"
 )
 
+const sessionsFileName string = "sessions.json"
+
+// The last seen time of the sessions is only updated after this time so the sessions are not written on every request
+const touchInterval time.Duration = time.Minute
+
 type session struct {
-	token               string
+	token string
+	// id identifies the session in the devices page without revealing the token
+	id                  string
+	username            string
 	expirationTimestamp time.Time
+	creationTimestamp   time.Time
+	lastSeenTimestamp   time.Time
+	userAgent           string
+	ip                  string
 }
 
 type sessionService interface {
-	createSession() (*session, error)
+	createSession(username string, userAgent string, ip string) (*session, error)
 	session(token string) (*session, error)
+	// touchSession extends the expiration of the session returning the new expiration, zero when it was not extended
+	touchSession(token string) (time.Time, error)
+	// userSessions returns the sessions of the user, most recently seen first
+	userSessions(username string) []session
 	deleteSession(token string) error
+	deleteSessionByID(id string) error
+	// deleteSessions logs out the user from all the devices
+	deleteSessions(username string) error
+	deleteExpiredSessions() error
 }
 
-type inMemorySessionService struct {
-	sessions             map[string]time.Time
+// sessionManager keeps the sessions in memory and, when it has a file path, in a file so the users stay logged in
+// across restarts. The sessions are stored by the hash of their token so the file cannot be used to impersonate the users.
+type sessionManager struct {
+	mu                   sync.RWMutex
+	filePath             string
+	sessions             map[string]storedSession
 	maxSessionAgeSeconds int
 }
 
-func (s inMemorySessionService) createSession() (*session, error) {
+type storedSession struct {
+	Username            string    `json:"username"`
+	ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+	CreationTimestamp   time.Time `json:"creationTimestamp"`
+	LastSeenTimestamp   time.Time `json:"lastSeenTimestamp"`
+	UserAgent           string    `json:"userAgent,omitempty"`
+	IP                  string    `json:"ip,omitempty"`
+}
+
+// newSessionManager loads the sessions of the file path, the sessions are only kept in memory if it is empty
+func newSessionManager(filePath string, maxSessionAgeSeconds int) (*sessionManager, error) {
+	s := &sessionManager{
+		filePath:             filePath,
+		sessions:             make(map[string]storedSession),
+		maxSessionAgeSeconds: maxSessionAgeSeconds,
+	}
+	if filePath == "" {
+		return s, nil
+	}
+
+	err := os.MkdirAll(path.Dir(filePath), os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("error creating data directory %s. %w", path.Dir(filePath), err)
+	}
+	b, err := os.ReadFile(filePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading %s. %w", filePath, err)
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &s.sessions)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s. %w", filePath, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *sessionManager) createSession(username string, userAgent string, ip string) (*session, error) {
 	// Make a byte array of size 32
 	b := make([]byte, 32)
 	// Populate the array with random numbers
@@ -31,24 +105,269 @@ func (s inMemorySessionService) createSession() (*session, error) {
 	rand.Read(b)
 	// Encode the byte array to an string with hexadecimal encoding
 	token := hex.EncodeToString(b)
-	expirationTimestamp := time.Now().UTC().Add(time.Duration(s.maxSessionAgeSeconds) * time.Second)
-	s.sessions[token] = expirationTimestamp
+	now := time.Now().UTC()
+	stored := storedSession{
+		Username:            username,
+		ExpirationTimestamp: now.Add(s.maxSessionAge()),
+		CreationTimestamp:   now,
+		LastSeenTimestamp:   now,
+		UserAgent:           userAgent,
+		IP:                  ip,
+	}
 
-	// Maintain the error in the interface in case the implementation changes and can return an actual error in the future
-	return &session{token: token, expirationTimestamp: expirationTimestamp}, nil
+	err := s.update(func(sessions map[string]storedSession) error {
+		sessions[sessionID(token)] = stored
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toSession(token, sessionID(token), stored), nil
 }
 
-func (s inMemorySessionService) session(token string) (*session, error) {
-	expirationTime, ok := s.sessions[token]
+func (s *sessionManager) session(token string) (*session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id := sessionID(token)
+	stored, ok := s.sessions[id]
 	if !ok {
 		return nil, errors.New("session not found")
 	}
+	return toSession(token, id, stored), nil
+}
+
+// touchSession implements a sliding expiration, the sessions expire after the max session age without being used
+func (s *sessionManager) touchSession(token string) (time.Time, error) {
+	id := sessionID(token)
+	s.mu.RLock()
+	stored, ok := s.sessions[id]
+	s.mu.RUnlock()
+	if !ok {
+		return time.Time{}, errors.New("session not found")
+	}
+	if time.Since(stored.LastSeenTimestamp) < touchInterval {
+		return time.Time{}, nil
+	}
+
+	now := time.Now().UTC()
+	err := s.update(func(sessions map[string]storedSession) error {
+		stored, ok := sessions[id]
+		if !ok {
+			return errors.New("session not found")
+		}
+		stored.LastSeenTimestamp = now
+		stored.ExpirationTimestamp = now.Add(s.maxSessionAge())
+		sessions[id] = stored
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now.Add(s.maxSessionAge()), nil
+}
+
+func (s *sessionManager) userSessions(username string) []session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var userSessions []session
+	for id, stored := range s.sessions {
+		if stored.Username == username && stored.ExpirationTimestamp.After(time.Now()) {
+			userSessions = append(userSessions, *toSession("", id, stored))
+		}
+	}
+	slices.SortFunc(userSessions, func(a, b session) int {
+		return cmp.Or(b.lastSeenTimestamp.Compare(a.lastSeenTimestamp), b.creationTimestamp.Compare(a.creationTimestamp))
+	})
+	return userSessions
+}
+
+func (s *sessionManager) deleteSession(token string) error {
+	return s.deleteSessionByID(sessionID(token))
+}
+
+func (s *sessionManager) deleteSessionByID(id string) error {
+	return s.update(func(sessions map[string]storedSession) error {
+		delete(sessions, id)
+		return nil
+	})
+}
+
+func (s *sessionManager) deleteSessions(username string) error {
+	return s.update(func(sessions map[string]storedSession) error {
+		for id, session := range sessions {
+			if session.Username == username {
+				delete(sessions, id)
+			}
+		}
+		return nil
+	})
+}
+
+// deleteExpiredSessions removes the sessions that were not used before they expired
+func (s *sessionManager) deleteExpiredSessions() error {
+	s.mu.RLock()
+	expired := false
+	for _, session := range s.sessions {
+		expired = expired || expiredSession(session)
+	}
+	s.mu.RUnlock()
+	if !expired {
+		return nil
+	}
+	// update already leaves out the expired sessions
+	return s.update(func(sessions map[string]storedSession) error { return nil })
+}
+
+// update modifies a copy of the sessions without the expired ones and writes them to disk before replacing the ones in memory
+func (s *sessionManager) update(update func(sessions map[string]storedSession) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := make(map[string]storedSession, len(s.sessions))
+	for id, session := range s.sessions {
+		if !expiredSession(session) {
+			sessions[id] = session
+		}
+	}
+	err := update(sessions)
+	if err != nil {
+		return err
+	}
+
+	if s.filePath != "" {
+		err := jsonfile.Write(s.filePath, sessions)
+		if err != nil {
+			return err
+		}
+	}
+	s.sessions = sessions
+	return nil
+}
+
+func (s *sessionManager) maxSessionAge() time.Duration {
+	return time.Duration(s.maxSessionAgeSeconds) * time.Second
+}
+
+// sweepSessions removes the expired sessions every interval so the sessions that are never used again do not pile up
+func sweepSessions(sessionService sessionService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		err := sessionService.deleteExpiredSessions()
+		if err != nil {
+			log.Printf("could not delete the expired sessions. %v", err)
+		}
+	}
+}
+
+func expiredSession(session storedSession) bool {
+	return !session.ExpirationTimestamp.After(time.Now())
+}
+
+func toSession(token string, id string, stored storedSession) *session {
+	return &session{
+		token:               token,
+		id:                  id,
+		username:            stored.Username,
+		expirationTimestamp: stored.ExpirationTimestamp,
+		creationTimestamp:   stored.CreationTimestamp,
+		lastSeenTimestamp:   stored.LastSeenTimestamp,
+		userAgent:           stored.UserAgent,
+		ip:                  stored.IP,
+	}
+}
+
+// sessionID is the hash of the token
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Version of the payload of the signed sessions, the sessions of other versions are rejected
+const signedSessionVersion int = 1
+
+// signedSessionService keeps the sessions in the signed cookies so any server with the signing keys can verify them
+// without sharing state. The token is only trusted after auth verified the signature of the cookie.
+// The sessions cannot be listed nor closed one by one, deleteSessions increments the session generation of the user
+// which invalidates all the sessions issued before.
+type signedSessionService struct {
+	userStore            users.Store
+	maxSessionAgeSeconds int
+}
+
+type signedSession struct {
+	Version    int    `json:"v"`
+	Username   string `json:"u"`
+	IssuedAt   int64  `json:"iat"`
+	Expiration int64  `json:"exp"`
+	Generation int    `json:"gen"`
+}
+
+func (s *signedSessionService) createSession(username string, userAgent string, ip string) (*session, error) {
+	user, err := s.userStore.User(username)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	b, err := json.Marshal(signedSession{
+		Version:    signedSessionVersion,
+		Username:   user.Username,
+		IssuedAt:   now.Unix(),
+		Expiration: now.Add(time.Duration(s.maxSessionAgeSeconds) * time.Second).Unix(),
+		Generation: user.SessionGeneration,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error encoding session. %w", err)
+	}
+	return s.session(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (s *signedSessionService) session(token string) (*session, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("session not found")
+	}
+	var payload signedSession
+	err = json.Unmarshal(b, &payload)
+	if err != nil || payload.Version != signedSessionVersion {
+		return nil, errors.New("session not found")
+	}
+	user, err := s.userStore.User(payload.Username)
+	if err != nil || user.SessionGeneration != payload.Generation {
+		return nil, errors.New("session revoked")
+	}
+	issued := time.Unix(payload.IssuedAt, 0).UTC()
+	return &session{
+		token:               token,
+		id:                  sessionID(token),
+		username:            payload.Username,
+		expirationTimestamp: time.Unix(payload.Expiration, 0).UTC(),
+		creationTimestamp:   issued,
+		lastSeenTimestamp:   issued,
+	}, nil
+}
+
+// touchSession does not extend the signed sessions, they expire after the max session age since the login
+func (s *signedSessionService) touchSession(token string) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+func (s *signedSessionService) userSessions(username string) []session {
+	return nil
+}
+
+// deleteSession does nothing, the cookie is removed from the browser but the token stays valid until it expires
+func (s *signedSessionService) deleteSession(token string) error {
+	return nil
+}
+
+func (s *signedSessionService) deleteSessionByID(id string) error {
+	return errors.New("signed sessions cannot be deleted one by one")
+}
 
-	return &session{token: token, expirationTimestamp: expirationTime}, nil
+func (s *signedSessionService) deleteSessions(username string) error {
+	return s.userStore.RevokeSessions(username)
 }
 
-func (s inMemorySessionService) deleteSession(token string) error {
-	delete(s.sessions, token)
-	// Maintain the error in the interface in case the implementation changes and can return an actual error in the future
+func (s *signedSessionService) deleteExpiredSessions() error {
 	return nil
 }
@@ -0,0 +1,407 @@
+package http
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"davidc.es/jag/html"
+	"davidc.es/jag/library"
+	"davidc.es/jag/shares"
+	"davidc.es/jag/users"
+)
+
+// Name of the cookie of the shares unlocked with their password
+const shareCookieName string = "share"
+
+// Layout of the value of the date inputs
+const dateLayout string = "2006-01-02"
+
+// Wrong passwords of the shares a client can enter during the guess window before it has to wait for the rest of it
+const (
+	maxShareGuesses  int           = 5
+	shareGuessWindow time.Duration = 15 * time.Minute
+)
+
+// shareGuesses counts the wrong passwords of the shares entered by every client so they cannot be guessed
+type shareGuesses struct {
+	mu       sync.Mutex
+	failures map[string]guesses
+}
+
+type guesses struct {
+	count int
+	reset time.Time
+}
+
+func newShareGuesses() *shareGuesses {
+	return &shareGuesses{failures: make(map[string]guesses)}
+}
+
+// allowed returns whether the client can enter another password
+func (g *shareGuesses) allowed(client string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	failures, ok := g.failures[client]
+	return !ok || failures.count < maxShareGuesses || time.Now().After(failures.reset)
+}
+
+// fail records a wrong password of the client
+func (g *shareGuesses) fail(client string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for other, failures := range g.failures {
+		if now.After(failures.reset) {
+			delete(g.failures, other)
+		}
+	}
+	failures, ok := g.failures[client]
+	if !ok {
+		failures.reset = now.Add(shareGuessWindow)
+	}
+	failures.count++
+	g.failures[client] = failures
+}
+
+// createShare creates a share link of the folder form value or the items of the path form values
+func createShare(libraryPath string, shareStore shares.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		share := shares.Share{
+			Title:         strings.TrimSpace(r.FormValue("name")),
+			CreatedBy:     currentUser(r).Username,
+			AllowDownload: r.FormValue("download") == "true",
+		}
+		if expiration := r.FormValue("expiration"); expiration != "" {
+			date, err := time.ParseInLocation(dateLayout, expiration, time.Local)
+			if err != nil {
+				http.Error(w, "expiration must be a date like 2006-01-02", http.StatusBadRequest)
+				return
+			}
+			// The share is valid the whole day of the expiration
+			share.Expiration = date.AddDate(0, 0, 1).UTC()
+			if share.Expired() {
+				http.Error(w, "expiration must not be in the past", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if folder := r.FormValue("folder"); folder != "" {
+			if !canAccess(r, folder) {
+				http.Error(w, "folder not found "+folder, http.StatusNotFound)
+				return
+			}
+			album, _, err := library.Folder(libraryPath, folder)
+			if err != nil {
+				if errors.Is(err, library.ErrNotExist) {
+					http.Error(w, "folder not found "+folder, http.StatusNotFound)
+					return
+				}
+				log.Printf("error reading folder %s. %v", folder, err)
+				http.Error(w, "unexpected error", http.StatusInternalServerError)
+				return
+			}
+			share.Folder = folder
+			if share.Title == "" {
+				share.Title = album.DisplayName()
+			}
+		} else {
+			images, ok := formItems(w, r, libraryPath)
+			if !ok {
+				return
+			}
+			for _, image := range images {
+				share.Paths = append(share.Paths, image.Path)
+			}
+			if share.Title == "" {
+				share.Title = images[0].Name
+			}
+		}
+
+		share, err := shareStore.Create(share, r.FormValue("password"))
+		if err != nil {
+			log.Printf("error creating share. %v", err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s shared %s", actor(r), share.Title)
+
+		http.Redirect(w, r, "/shares", http.StatusSeeOther)
+	}
+}
+
+// sharesPage lists the shares of the user, all of them for the admins
+func sharesPage(publicURL string, shareStore shares.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		list := slices.DeleteFunc(shareStore.Shares(), func(share shares.Share) bool { return !canRevoke(user, share) })
+
+		// The links are sent to other people so they use the public URL instead of the host the user is browsing
+		err := html.Shares(w, user, list, cmp.Or(publicURL, absoluteURL(r, ""))+"/s/")
+		if err != nil {
+			html.InternalError(w)
+			log.Printf("error serving shares. %v", err)
+			return
+		}
+	}
+}
+
+func revokeShare(shareStore shares.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		share, err := shareStore.Share(r.PathValue("token"))
+		if err != nil || !canRevoke(currentUser(r), share) {
+			http.NotFound(w, r)
+			return
+		}
+		err = shareStore.Revoke(share.Token)
+		if err != nil && !errors.Is(err, shares.ErrNotFound) {
+			log.Printf("error revoking share %s. %v", share.Title, err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s revoked the share %s", actor(r), share.Title)
+
+		http.Redirect(w, r, "/shares", http.StatusSeeOther)
+	}
+}
+
+func canRevoke(user users.User, share shares.Share) bool {
+	return user.IsAdmin() || strings.EqualFold(share.CreatedBy, user.Username)
+}
+
+// sharePage shows the items of the share to anyone with the link, asking for the password first when it has one
+func sharePage(libraryPath string, signingKeys []string, shareStore shares.Store, userStore users.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		share, err := shareStore.Share(r.PathValue("token"))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			html.NotFound(w)
+			return
+		}
+		if !unlocked(r, signingKeys, share) {
+			html.SharePassword(w, share.Token, share.Title, "")
+			return
+		}
+
+		err = shareStore.AddView(share.Token)
+		if err != nil {
+			log.Printf("error counting view of share %s. %v", share.Title, err)
+		}
+		err = html.Share(w, share.Token, share.Title, sharedItems(libraryPath, userStore, share), share.AllowDownload)
+		if err != nil {
+			html.InternalError(w)
+			log.Printf("error serving share %s. %v", share.Title, err)
+			return
+		}
+	}
+}
+
+func unlockShare(signingKey string, shareStore shares.Store, shareGuesses *shareGuesses) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		share, err := shareStore.Share(r.PathValue("token"))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			html.NotFound(w)
+			return
+		}
+		if share.HasPassword() {
+			client := remoteIP(r)
+			if !shareGuesses.allowed(client) {
+				log.Printf("too many wrong passwords of shares from %s", client)
+				w.WriteHeader(http.StatusTooManyRequests)
+				html.SharePassword(w, share.Token, share.Title, "Too many wrong passwords, try again later")
+				return
+			}
+			if !share.CheckPassword(r.FormValue("password")) {
+				shareGuesses.fail(client)
+				w.WriteHeader(http.StatusUnauthorized)
+				html.SharePassword(w, share.Token, share.Title, "Wrong password")
+				return
+			}
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     shareCookieName,
+			Value:    shareSignature(signingKey, share),
+			Path:     "/s/" + share.Token,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+			HttpOnly: true,
+		})
+		http.Redirect(w, r, "/s/"+share.Token, http.StatusSeeOther)
+	}
+}
+
+func sharedItemPage(libraryPath string, signingKeys []string, shareStore shares.Store, userStore users.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		share, image, ok := sharedItem(w, r, libraryPath, signingKeys, shareStore, userStore)
+		if !ok {
+			return
+		}
+		err := html.SharedItem(w, share.Token, share.Title, image, share.AllowDownload)
+		if err != nil {
+			html.InternalError(w)
+			log.Printf("error serving shared item %s. %v", image.Path, err)
+			return
+		}
+	}
+}
+
+func sharedThumbnail(libraryPath string, thumbnailsPath string, signingKeys []string, shareStore shares.Store, userStore users.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, image, ok := sharedItem(w, r, libraryPath, signingKeys, shareStore, userStore)
+		if !ok {
+			return
+		}
+		http.ServeFile(w, r, path.Join(thumbnailsPath, image.ThumbnailPath))
+	}
+}
+
+// sharedDisplay serves the display size version of the images so the originals cannot be downloaded without permission
+func sharedDisplay(libraryPath string, signingKeys []string, shareStore shares.Store, userStore users.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, image, ok := sharedItem(w, r, libraryPath, signingKeys, shareStore, userStore)
+		if !ok {
+			return
+		}
+		if image.IsVideo() {
+			http.ServeFile(w, r, path.Join(libraryPath, image.Path))
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		err := library.EncodeDisplayImage(w, path.Join(libraryPath, image.Path))
+		if err != nil {
+			log.Printf("error encoding display image of %s. %v", image.Path, err)
+		}
+	}
+}
+
+func sharedOriginal(libraryPath string, signingKeys []string, shareStore shares.Store, userStore users.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		share, image, ok := sharedItem(w, r, libraryPath, signingKeys, shareStore, userStore)
+		if !ok {
+			return
+		}
+		if !share.AllowDownload {
+			http.Error(w, "downloads are not allowed", http.StatusForbidden)
+			return
+		}
+		http.ServeFile(w, r, path.Join(libraryPath, image.Path))
+	}
+}
+
+func downloadShare(libraryPath string, signingKeys []string, shareStore shares.Store, userStore users.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		share, err := shareStore.Share(r.PathValue("token"))
+		if err != nil || !unlocked(r, signingKeys, share) {
+			http.NotFound(w, r)
+			return
+		}
+		if !share.AllowDownload {
+			http.Error(w, "downloads are not allowed", http.StatusForbidden)
+			return
+		}
+
+		writeZip(w, libraryPath, share.Title, sharedItems(libraryPath, userStore, share), r.URL.Query().Get("variant"))
+	}
+}
+
+// sharedItem returns the item of the path of the request writing a not found error when it is not part of the share
+func sharedItem(w http.ResponseWriter, r *http.Request, libraryPath string, signingKeys []string, shareStore shares.Store, userStore users.Store) (shares.Share, library.Image, bool) {
+	share, err := shareStore.Share(r.PathValue("token"))
+	if err != nil || !unlocked(r, signingKeys, share) {
+		http.NotFound(w, r)
+		return shares.Share{}, library.Image{}, false
+	}
+	// Only the requested item is read instead of the whole share, the pages of the folders request every thumbnail
+	itemPath := r.PathValue("path")
+	shared := slices.Contains(share.Paths, itemPath) || (share.Folder != "" && path.Dir(itemPath) == share.Folder)
+	access, ok := creatorAccess(userStore, share)
+	if !shared || !ok {
+		http.NotFound(w, r)
+		return shares.Share{}, library.Image{}, false
+	}
+	image, err := library.Item(libraryPath, itemPath)
+	if err != nil || image.Archived || !access.CanAccess(image.Path) {
+		http.NotFound(w, r)
+		return shares.Share{}, library.Image{}, false
+	}
+	return share, image, true
+}
+
+// sharedItems returns the items of the share that still exist and the user who created it can still see.
+// The shares of the users that are disabled or removed do not show anything.
+func sharedItems(libraryPath string, userStore users.Store, share shares.Share) []library.Image {
+	access, ok := creatorAccess(userStore, share)
+	if !ok {
+		return nil
+	}
+
+	var images []library.Image
+	var err error
+	if share.Folder != "" {
+		_, images, err = library.Folder(libraryPath, share.Folder)
+		if err != nil && !errors.Is(err, library.ErrNotExist) {
+			log.Printf("error reading shared folder %s. %v", share.Folder, err)
+		}
+	}
+	for _, itemPath := range share.Paths {
+		image, err := library.Item(libraryPath, itemPath)
+		if err != nil {
+			continue
+		}
+		images = append(images, image)
+	}
+	return slices.DeleteFunc(images, func(image library.Image) bool { return image.Archived || !access.CanAccess(image.Path) })
+}
+
+// creatorAccess returns the folders the user who created the share can see, false when they are disabled or removed
+func creatorAccess(userStore users.Store, share shares.Share) (users.Access, bool) {
+	creator, err := userStore.User(share.CreatedBy)
+	if err != nil || creator.Disabled {
+		return users.Access{}, false
+	}
+	return userStore.Access(creator), true
+}
+
+// unlocked returns whether the share has no password or the request has the cookie set after entering it,
+// signed with any of the signing keys so the cookies survive the rotation of the key
+func unlocked(r *http.Request, signingKeys []string, share shares.Share) bool {
+	if !share.HasPassword() {
+		return true
+	}
+	cookie, err := r.Cookie(shareCookieName)
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(signingKeys, func(signingKey string) bool {
+		return hmac.Equal([]byte(cookie.Value), []byte(shareSignature(signingKey, share)))
+	})
+}
+
+// shareSignature signs the token and the password hash so the cookie is only valid for the share and its password
+func shareSignature(signingKey string, share shares.Share) string {
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(shareCookieName))
+	mac.Write([]byte(share.Token))
+	mac.Write([]byte(share.PasswordHash))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// absoluteURL returns the URL of the path in the host of the request to send it to other people
+func absoluteURL(r *http.Request, urlPath string) string {
+	scheme := "https"
+	if r.TLS == nil && r.Header.Get("X-Forwarded-Proto") != "https" {
+		scheme = "http"
+	}
+	return scheme + "://" + r.Host + urlPath
+}
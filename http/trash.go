@@ -0,0 +1,156 @@
+package http
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"time"
+
+	"davidc.es/jag/html"
+	"davidc.es/jag/library"
+	"davidc.es/jag/search"
+)
+
+func deleteItem(libraryPath string, thumbnailsPath string, trashPath string, allowDelete bool, searchIndex *search.Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowDelete {
+			http.Error(w, "deleting items is not allowed", http.StatusForbidden)
+			return
+		}
+
+		itemPath := r.PathValue("path")
+		if !canAccess(r, itemPath) {
+			http.NotFound(w, r)
+			return
+		}
+		item, err := library.Trash(libraryPath, thumbnailsPath, trashPath, itemPath, actor(r))
+		if err != nil {
+			if errors.Is(err, library.ErrNotExist) {
+				http.NotFound(w, r)
+				return
+			}
+			log.Printf("error moving %s to the trash. %v", itemPath, err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s moved %s to the trash", item.DeletedBy, item.Path)
+		searchIndex.Refresh(libraryPath)
+
+		http.Redirect(w, r, "/"+path.Dir(item.Path), http.StatusSeeOther)
+	}
+}
+
+func trash(trashPath string, allowDelete bool, retention time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		items, err := library.TrashedItems(trashPath)
+		if err != nil {
+			html.InternalError(w)
+			log.Printf("error reading trash. %v", err)
+			return
+		}
+		items = slices.DeleteFunc(items, func(item library.TrashedItem) bool { return !canAccess(r, item.Path) })
+
+		err = html.Trash(w, currentUser(r), items, allowDelete, retention)
+		if err != nil {
+			html.InternalError(w)
+			log.Printf("error serving trash. %v", err)
+			return
+		}
+	}
+}
+
+func trashedThumbnail(trashPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		item, err := library.TrashedItemByID(trashPath, r.PathValue("id"))
+		if err != nil || item.ThumbnailName == "" || !canAccess(r, item.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, library.TrashedThumbnailPath(trashPath, item))
+	}
+}
+
+func restore(libraryPath string, thumbnailsPath string, trashPath string, allowDelete bool, searchIndex *search.Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowDelete {
+			http.Error(w, "restoring items is not allowed", http.StatusForbidden)
+			return
+		}
+
+		trashed, err := library.TrashedItemByID(trashPath, r.PathValue("id"))
+		if err != nil || !canAccess(r, trashed.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		item, err := library.Restore(libraryPath, thumbnailsPath, trashPath, r.PathValue("id"))
+		if err != nil {
+			switch {
+			case errors.Is(err, library.ErrNotExist):
+				http.NotFound(w, r)
+			case errors.Is(err, library.ErrAlreadyExists):
+				http.Error(w, "another file with the same name exists in the library", http.StatusConflict)
+			default:
+				log.Printf("error restoring %s. %v", r.PathValue("id"), err)
+				http.Error(w, "unexpected error", http.StatusInternalServerError)
+			}
+			return
+		}
+		log.Printf("%s restored %s from the trash", actor(r), item.Path)
+		searchIndex.Refresh(libraryPath)
+
+		http.Redirect(w, r, "/view/"+item.Path, http.StatusSeeOther)
+	}
+}
+
+func purge(trashPath string, allowDelete bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowDelete {
+			http.Error(w, "purging items is not allowed", http.StatusForbidden)
+			return
+		}
+
+		id := r.PathValue("id")
+		err := library.Purge(trashPath, id)
+		if err != nil {
+			if errors.Is(err, library.ErrNotExist) {
+				http.NotFound(w, r)
+				return
+			}
+			log.Printf("error purging %s. %v", id, err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s purged %s from the trash", actor(r), id)
+
+		http.Redirect(w, r, "/trash", http.StatusSeeOther)
+	}
+}
+
+func emptyTrash(trashPath string, allowDelete bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowDelete {
+			http.Error(w, "purging items is not allowed", http.StatusForbidden)
+			return
+		}
+
+		items, err := library.TrashedItems(trashPath)
+		if err != nil {
+			log.Printf("error reading trash. %v", err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		for _, item := range items {
+			err := library.Purge(trashPath, item.ID)
+			if err != nil {
+				log.Printf("error purging %s. %v", item.ID, err)
+				http.Error(w, "unexpected error", http.StatusInternalServerError)
+				return
+			}
+		}
+		log.Printf("%s emptied the trash", actor(r))
+
+		http.Redirect(w, r, "/trash", http.StatusSeeOther)
+	}
+}
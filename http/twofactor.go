@@ -0,0 +1,263 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"davidc.es/jag/html"
+	"davidc.es/jag/users"
+)
+
+// Name of the cookie of the logins waiting for the second factor
+const pendingLoginCookieName string = "login"
+
+// Time to enter the code of the second factor after the password
+const pendingLoginTTL time.Duration = 5 * time.Minute
+
+// Issuer shown in the authenticator apps
+const totpIssuer string = "jag"
+
+// File of the data path that records the admins were logged out when the two-factor authentication was required
+const requireAdmin2FAFileName string = "require-admin-2fa"
+
+// needsSecondFactor returns whether the user must enter a code after the password,
+// the admins must set it up first when it is required for them
+func needsSecondFactor(user users.User, requireAdmin2FA bool) bool {
+	return user.HasTOTP() || (requireAdmin2FA && user.IsAdmin())
+}
+
+// secondFactorPage asks for the code of the login of the request, or to set up the TOTP when it is required
+func secondFactorPage(signingKeys []string, userStore users.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _, ok := pendingLogin(r, signingKeys, userStore)
+		if !ok {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		renderSecondFactor(w, userStore, user, http.StatusOK, "")
+	}
+}
+
+func verifySecondFactor(signingKeys []string, userStore users.Store, maxSessionAgeSeconds int, sessionService sessionService, rememberStore *rememberStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, remember, ok := pendingLogin(r, signingKeys, userStore)
+		if !ok {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		var recoveryCodes []string
+		var err error
+		if user.HasTOTP() {
+			err = userStore.VerifySecondFactor(user.Username, r.FormValue("code"))
+		} else {
+			recoveryCodes, err = userStore.EnableTOTP(user.Username, r.FormValue("code"))
+		}
+		if errors.Is(err, users.ErrInvalidCode) || errors.Is(err, users.ErrTooManyAttempts) {
+			log.Printf("wrong second factor code of %s from %s", user.Username, remoteIP(r))
+			renderSecondFactor(w, userStore, user, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("error verifying second factor of %s. %v", user.Username, err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+
+		err = startSession(w, r, signingKeys[0], maxSessionAgeSeconds, sessionService, rememberStore, user, remember)
+		if err != nil {
+			log.Printf("unable to create session: %v", err)
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: pendingLoginCookieName, Path: "/login", MaxAge: -1})
+		if recoveryCodes != nil {
+			log.Printf("%s enabled two-factor authentication", user.Username)
+			err = html.SecondFactor(w, nil, recoveryCodes, "")
+			if err != nil {
+				log.Printf("error serving recovery codes. %v", err)
+			}
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+func renderSecondFactor(w http.ResponseWriter, userStore users.Store, user users.User, status int, message string) {
+	var setup *html.TOTPSetup
+	if !user.HasTOTP() {
+		// Keep the secret being set up so the app does not have to scan a new one after a wrong code
+		secret := user.PendingTOTPSecret
+		var err error
+		if secret == "" {
+			secret, err = userStore.SetupTOTP(user.Username)
+		}
+		if err != nil {
+			log.Printf("error setting up two-factor authentication of %s. %v", user.Username, err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		setup = &html.TOTPSetup{Secret: secret, URI: users.TOTPURI(totpIssuer, user.Username, secret)}
+	}
+	w.WriteHeader(status)
+	err := html.SecondFactor(w, setup, nil, message)
+	if err != nil {
+		log.Printf("error serving second factor. %v", err)
+	}
+}
+
+// setPendingLogin sets the cookie that lets the user enter the second factor without the password again.
+// It is bound to the password hash so it is no longer valid when the password changes.
+func setPendingLogin(w http.ResponseWriter, signingKey string, user users.User, remember bool) {
+	payload := user.Username + "\n" + strconv.FormatInt(time.Now().Add(pendingLoginTTL).Unix(), 10) + "\n" + strconv.FormatBool(remember)
+	http.SetCookie(w, &http.Cookie{
+		Name:     pendingLoginCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + pendingLoginSignature(signingKey, payload, user),
+		Path:     "/login",
+		MaxAge:   int(pendingLoginTTL.Seconds()),
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		HttpOnly: true,
+	})
+}
+
+// pendingLogin returns the user of the login waiting for the second factor and whether to remember the device
+func pendingLogin(r *http.Request, signingKeys []string, userStore users.Store) (users.User, bool, bool) {
+	cookie, err := r.Cookie(pendingLoginCookieName)
+	if err != nil {
+		return users.User{}, false, false
+	}
+	encoded, signature, _ := strings.Cut(cookie.Value, ".")
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return users.User{}, false, false
+	}
+	payload := string(b)
+	fields := strings.Split(payload, "\n")
+	if len(fields) != 3 {
+		return users.User{}, false, false
+	}
+	expiration, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || time.Now().Unix() > expiration {
+		return users.User{}, false, false
+	}
+	user, err := userStore.User(fields[0])
+	if err != nil || user.Disabled {
+		return users.User{}, false, false
+	}
+	valid := slices.ContainsFunc(signingKeys, func(signingKey string) bool {
+		return hmac.Equal([]byte(signature), []byte(pendingLoginSignature(signingKey, payload, user)))
+	})
+	if !valid {
+		return users.User{}, false, false
+	}
+	return user, fields[2] == "true", true
+}
+
+func pendingLoginSignature(signingKey string, payload string, user users.User) string {
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(pendingLoginCookieName))
+	mac.Write([]byte(payload))
+	mac.Write([]byte(user.PasswordHash))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// twoFactorPage shows the two-factor authentication settings of the user
+func twoFactorPage(requireAdmin2FA bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderTwoFactor(w, r, requireAdmin2FA, nil, nil, http.StatusOK, "")
+	}
+}
+
+func setupTwoFactor(userStore users.Store, requireAdmin2FA bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		secret, err := userStore.SetupTOTP(user.Username)
+		if errors.Is(err, users.ErrTOTPAlreadyEnabled) {
+			http.Redirect(w, r, "/2fa", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Printf("error setting up two-factor authentication of %s. %v", user.Username, err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		setup := &html.TOTPSetup{Secret: secret, URI: users.TOTPURI(totpIssuer, user.Username, secret)}
+		renderTwoFactor(w, r, requireAdmin2FA, setup, nil, http.StatusOK, "")
+	}
+}
+
+func enableTwoFactor(userStore users.Store, requireAdmin2FA bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		recoveryCodes, err := userStore.EnableTOTP(user.Username, r.FormValue("code"))
+		if errors.Is(err, users.ErrInvalidCode) {
+			// Show the same secret again so the user can retry with the app already set up
+			user, err = userStore.User(user.Username)
+			if err != nil {
+				http.Redirect(w, r, "/2fa", http.StatusSeeOther)
+				return
+			}
+			setup := &html.TOTPSetup{Secret: user.PendingTOTPSecret, URI: users.TOTPURI(totpIssuer, user.Username, user.PendingTOTPSecret)}
+			renderTwoFactor(w, r, requireAdmin2FA, setup, nil, http.StatusBadRequest, "Wrong code, check the clock of the device and try again")
+			return
+		}
+		if errors.Is(err, users.ErrTOTPNotSetUp) || errors.Is(err, users.ErrTOTPAlreadyEnabled) {
+			http.Redirect(w, r, "/2fa", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Printf("error enabling two-factor authentication of %s. %v", user.Username, err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s enabled two-factor authentication", actor(r))
+
+		renderTwoFactor(w, r, requireAdmin2FA, nil, recoveryCodes, http.StatusOK, "")
+	}
+}
+
+// disableTwoFactor disables the two-factor authentication of the user after checking a code,
+// so it cannot be disabled from a session left open
+func disableTwoFactor(userStore users.Store, requireAdmin2FA bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if requireAdmin2FA && user.IsAdmin() {
+			http.Error(w, "two-factor authentication is required for the admins", http.StatusForbidden)
+			return
+		}
+		err := userStore.VerifySecondFactor(user.Username, r.FormValue("code"))
+		if errors.Is(err, users.ErrInvalidCode) || errors.Is(err, users.ErrTooManyAttempts) {
+			renderTwoFactor(w, r, requireAdmin2FA, nil, nil, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err == nil {
+			err = userStore.DisableTOTP(user.Username)
+		}
+		if err != nil {
+			log.Printf("error disabling two-factor authentication of %s. %v", user.Username, err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s disabled two-factor authentication", actor(r))
+
+		http.Redirect(w, r, "/2fa", http.StatusSeeOther)
+	}
+}
+
+func renderTwoFactor(w http.ResponseWriter, r *http.Request, requireAdmin2FA bool, setup *html.TOTPSetup, recoveryCodes []string, status int, message string) {
+	user := currentUser(r)
+	w.WriteHeader(status)
+	err := html.TwoFactor(w, user, requireAdmin2FA && user.IsAdmin(), setup, recoveryCodes, message)
+	if err != nil {
+		log.Printf("error serving two-factor authentication. %v", err)
+	}
+}
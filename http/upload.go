@@ -0,0 +1,192 @@
+package http
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"davidc.es/jag/html"
+	"davidc.es/jag/library"
+	"davidc.es/jag/search"
+	"davidc.es/jag/tus"
+)
+
+var errForbiddenFolder = errors.New("not allowed to import into the folder")
+
+func uploadPage(libraryPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := html.Upload(w, currentUser(r), albumFolders(r, libraryPath), nil)
+		if err != nil {
+			html.InternalError(w)
+			log.Printf("error serving upload. %v", err)
+			return
+		}
+	}
+}
+
+// upload imports the files of a multipart form into the library. The files are streamed to the staging
+// path one by one so big videos are not kept in memory.
+func upload(libraryPath string, thumbnailsPath string, stagingPath string, searchIndex *search.Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, "request must be a multipart form", http.StatusBadRequest)
+			return
+		}
+		err = os.MkdirAll(stagingPath, os.ModePerm)
+		if err != nil {
+			log.Printf("error creating staging directory %s. %v", stagingPath, err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+
+		var folder string
+		var results []html.UploadResult
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				http.Error(w, "invalid multipart form", http.StatusBadRequest)
+				return
+			}
+			// The album field must be sent before the files to be applied to them
+			if part.FormName() == "album" {
+				b, err := io.ReadAll(io.LimitReader(part, 1024))
+				if err != nil {
+					http.Error(w, "invalid album", http.StatusBadRequest)
+					return
+				}
+				folder = string(b)
+				if folder != "" && !slices.Contains(albumFolders(r, libraryPath), folder) {
+					http.Error(w, "unknown album "+folder, http.StatusBadRequest)
+					return
+				}
+				continue
+			}
+			if part.FormName() != "files" || part.FileName() == "" {
+				continue
+			}
+
+			result := html.UploadResult{Name: part.FileName()}
+			image, err := importPart(r, libraryPath, thumbnailsPath, stagingPath, part, folder)
+			if errors.Is(err, errForbiddenFolder) {
+				log.Printf("%s cannot upload %s. %v", actor(r), part.FileName(), err)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				log.Printf("could not import %s. %v", part.FileName(), err)
+				result.Error = err.Error()
+				if !errors.Is(err, library.ErrUnsupportedMedia) {
+					result.Error = "unexpected error"
+				}
+			} else {
+				log.Printf("%s uploaded %s", actor(r), image.Path)
+				result.Path = image.Path
+			}
+			results = append(results, result)
+		}
+		searchIndex.Refresh(libraryPath)
+
+		err = html.Upload(w, currentUser(r), albumFolders(r, libraryPath), results)
+		if err != nil {
+			html.InternalError(w)
+			log.Printf("error serving upload. %v", err)
+			return
+		}
+	}
+}
+
+func importPart(r *http.Request, libraryPath string, thumbnailsPath string, stagingPath string, part *multipart.Part, folder string) (library.Image, error) {
+	f, err := os.CreateTemp(stagingPath, "upload-*")
+	if err != nil {
+		return library.Image{}, err
+	}
+	// Import moves the file so the removal only matters when it fails
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, part)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return library.Image{}, err
+	}
+	folder, err = importFolder(r, f.Name(), part.FileName(), folder)
+	if err != nil {
+		return library.Image{}, err
+	}
+	return library.Import(libraryPath, thumbnailsPath, f.Name(), part.FileName(), folder)
+}
+
+// importFolder returns the folder the file is imported into, the one of the year it was taken when no album is given.
+// The year folder could be hidden from the user, who would learn it exists from the path of the imported file.
+func importFolder(r *http.Request, filePath string, name string, folder string) (string, error) {
+	if folder == "" {
+		folder = library.ImportFolder(filePath, name)
+	}
+	if !canAccess(r, folder) {
+		return "", fmt.Errorf("%w %s", errForbiddenFolder, folder)
+	}
+	return folder, nil
+}
+
+// importUpload imports the completed resumable uploads into the library. The name of the file is sent in the
+// filename metadata of the upload and the optional album in the album metadata.
+func importUpload(libraryPath string, thumbnailsPath string, searchIndex *search.Index) tus.CompleteFunc {
+	return func(r *http.Request, filePath string, metadata map[string]string) (string, error) {
+		name := cmp.Or(metadata["filename"], metadata["name"])
+		folder := metadata["album"]
+		if folder != "" && !slices.Contains(albumFolders(r, libraryPath), folder) {
+			return "", fmt.Errorf("unknown album %s", folder)
+		}
+
+		folder, err := importFolder(r, filePath, name, folder)
+		if err != nil {
+			log.Printf("%s cannot upload %s. %v", actor(r), name, err)
+			return "", tus.ErrForbidden
+		}
+		image, err := library.Import(libraryPath, thumbnailsPath, filePath, name, folder)
+		if err != nil {
+			log.Printf("could not import %s. %v", name, err)
+			if !errors.Is(err, library.ErrUnsupportedMedia) {
+				return "", errors.New("unexpected error")
+			}
+			return "", err
+		}
+		log.Printf("%s uploaded %s", actor(r), image.Path)
+		searchIndex.Refresh(libraryPath)
+		return "/view/" + image.Path, nil
+	}
+}
+
+// albumFolders returns the folders of the library that are not years and the user can see
+func albumFolders(r *http.Request, libraryPath string) []string {
+	var albums []string
+	for _, folder := range library.Years(libraryPath) {
+		if !library.IsYear(folder) && canAccess(r, folder) {
+			albums = append(albums, folder)
+		}
+	}
+	return albums
+}
+
+// sweepUploads removes the abandoned resumable uploads every interval
+func sweepUploads(tusHandler *tus.Handler, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		err := tusHandler.RemoveExpired()
+		if err != nil {
+			log.Printf("could not remove the expired uploads. %v", err)
+		}
+	}
+}
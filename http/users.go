@@ -0,0 +1,317 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"davidc.es/jag/html"
+	"davidc.es/jag/library"
+	"davidc.es/jag/users"
+)
+
+type userContextKey struct{}
+
+type accessContextKey struct{}
+
+// withUser stores the authenticated user and the folders they can see in the context of the request
+func withUser(r *http.Request, userStore users.Store, user users.User) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey{}, user)
+	ctx = context.WithValue(ctx, accessContextKey{}, userStore.Access(user))
+	return r.WithContext(ctx)
+}
+
+// currentUser returns the authenticated user of the request, the zero user when it is not authenticated
+func currentUser(r *http.Request) users.User {
+	return userFromContext(r.Context())
+}
+
+func userFromContext(ctx context.Context) users.User {
+	user, _ := ctx.Value(userContextKey{}).(users.User)
+	return user
+}
+
+// canAccess returns whether the user of the request can see the item or folder of the path relative to the library
+func canAccess(r *http.Request, itemPath string) bool {
+	return accessFromContext(r.Context()).CanAccess(itemPath)
+}
+
+// accessFromContext returns the access of the user, the zero access that cannot see anything when there is no user
+func accessFromContext(ctx context.Context) users.Access {
+	access, _ := ctx.Value(accessContextKey{}).(users.Access)
+	return access
+}
+
+// accessibleFiles only serves the files of the folders the user can see. The thumbnails have the same folders as the library.
+// The listings of the folders are not served since they would show the names of the hidden folders.
+func accessibleFiles(fileServer http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "" || strings.HasSuffix(r.URL.Path, "/") || !canAccess(r, r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// requireRole only lets the authenticated users with at least the role through
+func requireRole(role users.Role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !currentUser(r).Role.Allows(role) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func usersPage(userStore users.Store, adminUsername string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderUsers(w, r, userStore, adminUsername, http.StatusOK, "", "")
+	}
+}
+
+func inviteUser(userStore users.Store, adminUsername string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.FormValue("username")
+		role, err := users.ParseRole(r.FormValue("role"))
+		if err != nil {
+			renderUsers(w, r, userStore, adminUsername, http.StatusBadRequest, "", err.Error())
+			return
+		}
+		token, err := userStore.Invite(username, role)
+		if err != nil {
+			if errors.Is(err, users.ErrInvalidUsername) || errors.Is(err, users.ErrAlreadyExists) {
+				renderUsers(w, r, userStore, adminUsername, http.StatusBadRequest, "", err.Error())
+				return
+			}
+			log.Printf("error inviting %s. %v", username, err)
+			html.InternalError(w)
+			return
+		}
+		log.Printf("%s invited %s as %s", actor(r), username, role)
+
+		renderUsers(w, r, userStore, adminUsername, http.StatusOK, invitationURL(r, token), "")
+	}
+}
+
+func changeRole(userStore users.Store, adminUsername string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.PathValue("username")
+		if !canManage(w, r, username, adminUsername) {
+			return
+		}
+		role, err := users.ParseRole(r.FormValue("role"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = userStore.SetRole(username, role)
+		if !userUpdated(w, r, err) {
+			return
+		}
+		log.Printf("%s changed the role of %s to %s", actor(r), username, role)
+
+		http.Redirect(w, r, "/users", http.StatusSeeOther)
+	}
+}
+
+func disableUser(userStore users.Store, sessionService sessionService, rememberStore *rememberStore, adminUsername string, disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.PathValue("username")
+		if !canManage(w, r, username, adminUsername) {
+			return
+		}
+		err := userStore.SetDisabled(username, disabled)
+		if !userUpdated(w, r, err) {
+			return
+		}
+		if disabled {
+			logoutUser(sessionService, rememberStore, userStore, username)
+			log.Printf("%s disabled %s", actor(r), username)
+		} else {
+			log.Printf("%s enabled %s", actor(r), username)
+		}
+
+		http.Redirect(w, r, "/users", http.StatusSeeOther)
+	}
+}
+
+func resetUser(userStore users.Store, sessionService sessionService, rememberStore *rememberStore, adminUsername string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.PathValue("username")
+		if !canManage(w, r, username, adminUsername) {
+			return
+		}
+		token, err := userStore.Reset(username)
+		if !userUpdated(w, r, err) {
+			return
+		}
+		logoutUser(sessionService, rememberStore, userStore, username)
+		log.Printf("%s reset the password of %s", actor(r), username)
+
+		renderUsers(w, r, userStore, adminUsername, http.StatusOK, invitationURL(r, token), "")
+	}
+}
+
+func changeGroups(userStore users.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.PathValue("username")
+		err := userStore.SetGroups(username, strings.Split(r.FormValue("groups"), ","))
+		if !userUpdated(w, r, err) {
+			return
+		}
+		log.Printf("%s changed the groups of %s to %s", actor(r), username, r.FormValue("groups"))
+
+		http.Redirect(w, r, "/users", http.StatusSeeOther)
+	}
+}
+
+func accessPage(libraryPath string, userStore users.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderAccess(w, r, libraryPath, userStore, http.StatusOK, "")
+	}
+}
+
+func setRule(libraryPath string, userStore users.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rule := users.Rule{
+			Folder: r.FormValue("folder"),
+			Users:  strings.Split(r.FormValue("users"), ","),
+			Groups: strings.Split(r.FormValue("groups"), ","),
+		}
+		err := userStore.SetRule(rule)
+		if err != nil {
+			if errors.Is(err, users.ErrInvalidFolder) {
+				renderAccess(w, r, libraryPath, userStore, http.StatusBadRequest, err.Error())
+				return
+			}
+			log.Printf("error saving the access rule of %s. %v", rule.Folder, err)
+			html.InternalError(w)
+			return
+		}
+		log.Printf("%s restricted %s to the users %s and the groups %s", actor(r), rule.Folder, r.FormValue("users"), r.FormValue("groups"))
+
+		http.Redirect(w, r, "/access", http.StatusSeeOther)
+	}
+}
+
+func deleteRule(userStore users.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		folder := r.FormValue("folder")
+		err := userStore.DeleteRule(folder)
+		if err != nil {
+			log.Printf("error removing the access rule of %s. %v", folder, err)
+			html.InternalError(w)
+			return
+		}
+		log.Printf("%s removed the access rule of %s", actor(r), folder)
+
+		http.Redirect(w, r, "/access", http.StatusSeeOther)
+	}
+}
+
+func renderAccess(w http.ResponseWriter, r *http.Request, libraryPath string, userStore users.Store, status int, message string) {
+	w.WriteHeader(status)
+	err := html.Access(w, currentUser(r), userStore.Rules(), library.Years(libraryPath), message)
+	if err != nil {
+		log.Printf("error serving access. %v", err)
+	}
+}
+
+func invitation(userStore users.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := userStore.Invitation(r.PathValue("token"))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			html.Invitation(w, "", err.Error())
+			return
+		}
+		html.Invitation(w, user.Username, "")
+	}
+}
+
+func acceptInvitation(userStore users.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.PathValue("token")
+		user, err := userStore.Invitation(token)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			html.Invitation(w, "", err.Error())
+			return
+		}
+		if r.FormValue("password") != r.FormValue("confirmation") {
+			w.WriteHeader(http.StatusBadRequest)
+			html.Invitation(w, user.Username, "The passwords do not match")
+			return
+		}
+		_, err = userStore.AcceptInvitation(token, r.FormValue("password"))
+		if err != nil {
+			if errors.Is(err, users.ErrShortPassword) {
+				w.WriteHeader(http.StatusBadRequest)
+				html.Invitation(w, user.Username, err.Error())
+				return
+			}
+			log.Printf("error setting the password of %s. %v", user.Username, err)
+			html.InternalError(w)
+			return
+		}
+		log.Printf("%s set their password", user.Username)
+
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+}
+
+func renderUsers(w http.ResponseWriter, r *http.Request, userStore users.Store, adminUsername string, status int, invitationURL string, message string) {
+	w.WriteHeader(status)
+	err := html.Users(w, currentUser(r), userStore.Users(), adminUsername, invitationURL, message)
+	if err != nil {
+		log.Printf("error serving users. %v", err)
+	}
+}
+
+// canManage writes an error when the user cannot be changed from the admin page. The admin of the encrypted password
+// is managed with the configuration and the admins cannot change themselves so they do not lock themselves out.
+func canManage(w http.ResponseWriter, r *http.Request, username string, adminUsername string) bool {
+	if strings.EqualFold(username, adminUsername) || strings.EqualFold(username, currentUser(r).Username) {
+		http.Error(w, "this user cannot be changed", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func userUpdated(w http.ResponseWriter, r *http.Request, err error) bool {
+	if err == nil {
+		return true
+	}
+	if errors.Is(err, users.ErrNotFound) {
+		http.NotFound(w, r)
+		return false
+	}
+	log.Printf("error updating user %s. %v", r.PathValue("username"), err)
+	http.Error(w, "unexpected error", http.StatusInternalServerError)
+	return false
+}
+
+func logoutUser(sessionService sessionService, rememberStore *rememberStore, userStore users.Store, username string) {
+	// The sessions store the username as it was written in the invitation
+	user, err := userStore.User(username)
+	if err != nil {
+		return
+	}
+	err = sessionService.deleteSessions(user.Username)
+	if err != nil {
+		log.Printf("could not delete the sessions of %s. %v", username, err)
+	}
+	err = rememberStore.forgetUser(user.Username)
+	if err != nil {
+		log.Printf("could not forget the remembered devices of %s. %v", username, err)
+	}
+}
+
+// invitationURL is the link to set the password the admin sends to the user
+func invitationURL(r *http.Request, token string) string {
+	return absoluteURL(r, "/invitation/"+token)
+}
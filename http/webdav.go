@@ -0,0 +1,270 @@
+package http
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"davidc.es/jag/library"
+	"davidc.es/jag/search"
+	"davidc.es/jag/users"
+	"golang.org/x/net/webdav"
+)
+
+// Time the credentials verified by the basic authentication are not verified again
+const credentialsCacheTTL time.Duration = 5 * time.Minute
+
+// verifiedCredentials is a cached verification of the basic authentication, valid while the user does not change
+type verifiedCredentials struct {
+	expiration        time.Time
+	passwordHash      string
+	sessionGeneration int
+}
+
+// libraryFileSystem exposes the library through WebDAV. When it is writable the new files are imported
+// like the uploads and the deleted files are moved to the trash. Existing files are never modified.
+type libraryFileSystem struct {
+	webdav.Dir
+	libraryPath    string
+	thumbnailsPath string
+	stagingPath    string
+	trashPath      string
+	writable       bool
+	allowDelete    bool
+	searchIndex    *search.Index
+}
+
+func newWebDAVHandler(libraryPath string, thumbnailsPath string, stagingPath string, trashPath string, writable bool, allowDelete bool, searchIndex *search.Index) *webdav.Handler {
+	return &webdav.Handler{
+		Prefix: "/webdav",
+		FileSystem: libraryFileSystem{
+			Dir:            webdav.Dir(libraryPath),
+			libraryPath:    libraryPath,
+			thumbnailsPath: thumbnailsPath,
+			stagingPath:    stagingPath,
+			trashPath:      trashPath,
+			writable:       writable,
+			allowDelete:    allowDelete,
+			searchIndex:    searchIndex,
+		},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("webdav %s %s. %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+}
+
+func (fs libraryFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = strings.Trim(name, "/")
+	// Only the top-level folders of the library can contain items
+	if !fs.writable || !userFromContext(ctx).IsContributor() || name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+		return os.ErrPermission
+	}
+	return fs.Dir.Mkdir(ctx, name, perm)
+}
+
+func (fs libraryFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	access := accessFromContext(ctx)
+	if !visible(access, name) {
+		return nil, os.ErrNotExist
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		f, err := fs.Dir.OpenFile(ctx, name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return accessibleFile{File: f, name: name, access: access}, nil
+	}
+
+	if !fs.writable || !userFromContext(ctx).IsContributor() || flag&os.O_CREATE == 0 {
+		return nil, os.ErrPermission
+	}
+	itemPath := strings.Trim(name, "/")
+	folder, fileName := path.Split(itemPath)
+	folder = strings.Trim(folder, "/")
+	if strings.Contains(folder, "/") || strings.HasPrefix(fileName, ".") {
+		return nil, os.ErrPermission
+	}
+	if _, err := fs.Dir.Stat(ctx, name); err == nil {
+		return nil, os.ErrPermission
+	}
+
+	err := os.MkdirAll(fs.stagingPath, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(fs.stagingPath, "webdav-*")
+	if err != nil {
+		return nil, err
+	}
+	return &importFile{File: f, fs: fs, name: fileName, folder: folder, username: userFromContext(ctx).Username, access: access}, nil
+}
+
+func (fs libraryFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if !visible(accessFromContext(ctx), name) {
+		return nil, os.ErrNotExist
+	}
+	return fs.Dir.Stat(ctx, name)
+}
+
+func (fs libraryFileSystem) RemoveAll(ctx context.Context, name string) error {
+	if !fs.writable || !fs.allowDelete || !userFromContext(ctx).IsContributor() {
+		return os.ErrPermission
+	}
+	// Only items can be deleted since they are moved to the trash one by one
+	info, err := fs.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return os.ErrPermission
+	}
+
+	item, err := library.Trash(fs.libraryPath, fs.thumbnailsPath, fs.trashPath, strings.Trim(name, "/"), userFromContext(ctx).Username)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s moved %s to the trash through webdav", item.DeletedBy, item.Path)
+	fs.searchIndex.Refresh(fs.libraryPath)
+	return nil
+}
+
+func (fs libraryFileSystem) Rename(ctx context.Context, oldName string, newName string) error {
+	// The thumbnails would not match the items anymore
+	return os.ErrPermission
+}
+
+// visible returns whether the user can see the file of the WebDAV name, the root is always visible
+func visible(access users.Access, name string) bool {
+	name = strings.Trim(name, "/")
+	return name == "" || access.CanAccess(name)
+}
+
+// accessibleFile hides the folders the user cannot see from the listings
+type accessibleFile struct {
+	webdav.File
+	name   string
+	access users.Access
+}
+
+func (f accessibleFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	return slices.DeleteFunc(infos, func(info os.FileInfo) bool { return !visible(f.access, path.Join(f.name, info.Name())) }), err
+}
+
+// importFile stores the contents written by a WebDAV client in the staging path and imports them into the library when it is closed
+type importFile struct {
+	*os.File
+	fs       libraryFileSystem
+	name     string
+	folder   string
+	username string
+	access   users.Access
+}
+
+func (f *importFile) Close() error {
+	defer os.Remove(f.File.Name())
+	err := f.File.Close()
+	if err != nil {
+		return err
+	}
+
+	// The files written in the root go to the folder of the year they were taken, which could be hidden from the user
+	folder := f.folder
+	if folder == "" {
+		folder = library.ImportFolder(f.File.Name(), f.name)
+	}
+	if !f.access.CanAccess(folder) {
+		log.Printf("%s cannot upload %s through webdav into %s", f.username, f.name, folder)
+		return os.ErrPermission
+	}
+	image, err := library.Import(f.fs.libraryPath, f.fs.thumbnailsPath, f.File.Name(), f.name, folder)
+	if err != nil {
+		log.Printf("could not import %s from webdav. %v", f.name, err)
+		return err
+	}
+	log.Printf("%s uploaded %s through webdav", f.username, image.Path)
+	f.fs.searchIndex.Refresh(f.fs.libraryPath)
+	return nil
+}
+
+// davAuth authenticates the WebDAV clients, which cannot log in with the form, with the username and password through basic authentication.
+// Requests with a session cookie like the ones of the browser are authenticated with the session.
+// The users that log in with a second factor cannot use basic authentication, which would skip it.
+func davAuth(signingKeys []string, sessionService sessionService, rememberStore *rememberStore, userStore users.Store, requireAdmin2FA bool, handler http.HandlerFunc) http.HandlerFunc {
+	sessionHandler := auth(signingKeys, sessionService, rememberStore, userStore, handler)
+	var mu sync.Mutex
+	// Verified credentials by the hash of the authorization header
+	verified := make(map[[sha256.Size]byte]verifiedCredentials)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, sessionErr := r.Cookie(cookieName)
+		_, rememberErr := r.Cookie(rememberCookieName)
+		if sessionErr == nil || rememberErr == nil {
+			sessionHandler(w, r)
+			return
+		}
+
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="jag"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		key := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+		mu.Lock()
+		credentials, cached := verified[key]
+		if cached && time.Now().After(credentials.expiration) {
+			delete(verified, key)
+			cached = false
+		}
+		mu.Unlock()
+		var user users.User
+		var err error
+		if cached {
+			// The user could have been disabled, changed its password or logged out everywhere after the credentials were verified
+			user, err = userStore.User(username)
+			if err == nil && (user.Disabled || user.PasswordHash != credentials.passwordHash || user.SessionGeneration != credentials.sessionGeneration) {
+				mu.Lock()
+				delete(verified, key)
+				mu.Unlock()
+				cached = false
+			}
+		}
+		if !cached {
+			// bcrypt is slow on purpose and the clients send many requests
+			user, err = userStore.Authenticate(username, password)
+			if err == nil {
+				mu.Lock()
+				verified[key] = verifiedCredentials{
+					expiration:        time.Now().Add(credentialsCacheTTL),
+					passwordHash:      user.PasswordHash,
+					sessionGeneration: user.SessionGeneration,
+				}
+				mu.Unlock()
+			}
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="jag"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if needsSecondFactor(user, requireAdmin2FA) {
+			log.Printf("%s cannot use webdav with basic authentication from %s since it has two-factor authentication", user.Username, remoteIP(r))
+			http.Error(w, "two-factor authentication is enabled, basic authentication is not allowed", http.StatusForbidden)
+			return
+		}
+
+		handler(w, withUser(r, userStore, user))
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"davidc.es/jag/configuration"
+	"davidc.es/jag/library"
+	"davidc.es/jag/search"
+)
+
+// Folder of the inbox where the files that cannot be imported are moved so they are not retried
+const skippedFolderName string = ".skipped"
+
+// importCommand imports the files of a folder into the library after printing the plan and asking for confirmation.
+func importCommand(configuration configuration.Configuration, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	copyFiles := flags.Bool("copy", false, "Copy the files instead of moving them")
+	dryRun := flags.Bool("dry-run", false, "Print the plan without importing anything")
+	yes := flags.Bool("yes", false, "Import without asking for confirmation")
+	album := flags.String("album", "", "Folder of the library to import the files into instead of the folder of the year they were taken")
+	namePattern := flags.String("name-pattern", configuration.ImportNamePattern(), "Pattern to rename the files like IMG_{date}_{time}. Empty keeps the original names")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: jag [flags] import [import flags] <folder>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("the folder to import is required")
+	}
+
+	files, err := library.InboxFiles(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	options := library.ImportOptions{Folder: *album, NamePattern: *namePattern, Copy: *copyFiles}
+	plan, err := library.PlanImport(configuration.LibraryPath(), files, options)
+	if err != nil {
+		return err
+	}
+
+	pending := printPlan(os.Stdout, plan)
+	if *dryRun || pending == 0 {
+		return nil
+	}
+	if !*yes {
+		fmt.Printf("Import %d files? [y/N] ", pending)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if !strings.EqualFold(strings.TrimSpace(answer), "y") {
+			return nil
+		}
+	}
+
+	failed := 0
+	for _, planned := range library.ExecuteImport(configuration.LibraryPath(), configuration.ThumbnailsPath(), plan, options) {
+		if planned.Path != "" && planned.Err != nil {
+			fmt.Printf("error importing %s. %v\n", planned.SourcePath, planned.Err)
+			failed++
+		}
+	}
+	fmt.Printf("Imported %d files\n", pending-failed)
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be imported", failed)
+	}
+	return nil
+}
+
+// printPlan writes a line for every file of the plan and returns the number of files to import
+func printPlan(w io.Writer, plan []library.PlannedImport) int {
+	pending := 0
+	for _, planned := range plan {
+		switch {
+		case planned.Err != nil:
+			fmt.Fprintf(w, "skip      %s: %v\n", planned.SourcePath, planned.Err)
+		case planned.Duplicate != "":
+			fmt.Fprintf(w, "duplicate %s: same as %s\n", planned.SourcePath, planned.Duplicate)
+		default:
+			fmt.Fprintf(w, "import    %s -> %s\n", planned.SourcePath, planned.Path)
+			pending++
+		}
+	}
+	return pending
+}
+
+type inboxFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// watchInbox imports the files of the inbox every minute. Only the files that did not change since the previous
+// check are imported so the files that are still being copied into the inbox are left alone.
+func watchInbox(configuration configuration.Configuration, searchIndex *search.Index) {
+	inboxPath := configuration.InboxPath()
+	options := library.ImportOptions{NamePattern: configuration.ImportNamePattern()}
+	previous := make(map[string]inboxFile)
+
+	ticker := time.NewTicker(1 * time.Minute)
+	for range ticker.C {
+		files, err := library.InboxFiles(inboxPath)
+		if err != nil {
+			log.Printf("error reading inbox. %v", err)
+			continue
+		}
+		current := make(map[string]inboxFile, len(files))
+		var stable []string
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil {
+				continue
+			}
+			current[file] = inboxFile{size: info.Size(), modTime: info.ModTime()}
+			if previous[file] == current[file] {
+				stable = append(stable, file)
+			}
+		}
+		previous = current
+		if len(stable) == 0 {
+			continue
+		}
+
+		plan, err := library.PlanImport(configuration.LibraryPath(), stable, options)
+		if err != nil {
+			log.Printf("error planning the import of the inbox. %v", err)
+			continue
+		}
+		imported := 0
+		for _, planned := range library.ExecuteImport(configuration.LibraryPath(), configuration.ThumbnailsPath(), plan, options) {
+			switch {
+			case planned.Path == "":
+				// Duplicates and unsupported files would be skipped again on every check
+				reason := fmt.Sprintf("same as %s", planned.Duplicate)
+				if planned.Err != nil {
+					reason = planned.Err.Error()
+				}
+				log.Printf("Skipped %s from the inbox. %s", planned.SourcePath, reason)
+				skipInboxFile(inboxPath, planned.SourcePath)
+			case planned.Err != nil:
+				log.Printf("error importing %s from the inbox. %v", planned.SourcePath, planned.Err)
+			default:
+				log.Printf("Imported %s from the inbox to %s", planned.SourcePath, planned.Path)
+				imported++
+			}
+		}
+		if imported > 0 {
+			searchIndex.Refresh(configuration.LibraryPath())
+		}
+	}
+}
+
+func skipInboxFile(inboxPath string, filePath string) {
+	rel, err := filepath.Rel(inboxPath, filePath)
+	if err != nil {
+		return
+	}
+	skippedPath := path.Join(inboxPath, skippedFolderName, filepath.ToSlash(rel))
+	err = os.MkdirAll(path.Dir(skippedPath), os.ModePerm)
+	if err == nil {
+		err = os.Rename(filePath, skippedPath)
+	}
+	if err != nil {
+		log.Printf("could not move %s to the skipped folder of the inbox. %v", filePath, err)
+	}
+}
@@ -0,0 +1,79 @@
+// Package jsonfile writes the JSON files of the stores in the data path.
+package jsonfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// Time to wait for the lock of another server before giving up
+	lockTimeout time.Duration = 10 * time.Second
+	// Age of a lock file left by a server that stopped while holding it
+	staleLockAge  time.Duration = 30 * time.Second
+	lockRetryWait time.Duration = 10 * time.Millisecond
+)
+
+var ErrLockTimeout = errors.New("timeout waiting for the lock")
+
+// Write encodes the value as indented JSON and writes it to a temporary file that is renamed to the file path,
+// so the file is never left half written and the other servers sharing the data path never read a partial file
+func Write(filePath string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding %s. %w", filePath, err)
+	}
+	// Every write has its own temporary file so the servers do not write in the file of another one
+	f, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file of %s. %w", filePath, err)
+	}
+	tmpPath := f.Name()
+	_, err = f.Write(b)
+	if err == nil {
+		// The contents must be on disk before the rename or a crash could leave an empty file
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error writing %s. %w", tmpPath, err)
+	}
+	err = os.Rename(tmpPath, filePath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error renaming %s. %w", tmpPath, err)
+	}
+	return nil
+}
+
+// Lock creates the lock file of the file path, waiting while another server holds it, so the servers sharing the data path
+// read and write the file one after the other. The returned function removes the lock file.
+func Lock(filePath string) (func(), error) {
+	lockPath := filePath + ".lock"
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("error creating lock %s. %w", lockPath, err)
+		}
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w %s", ErrLockTimeout, lockPath)
+		}
+		time.Sleep(lockRetryWait)
+	}
+}
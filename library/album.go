@@ -0,0 +1,96 @@
+package library
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Name of the optional file inside a folder with the metadata of the album
+const albumFileName string = "album.json"
+
+const (
+	SortNewest string = "newest"
+	SortOldest string = "oldest"
+	SortName   string = "name"
+)
+
+var ErrInvalidMetadata = errors.New("invalid album metadata")
+
+// AlbumMetadata is the content of the album file of a folder. All the fields are optional.
+type AlbumMetadata struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	// Name of the image to use as cover
+	Cover string `json:"cover"`
+	// Position of the folder in the index. Lower values go first, folders without order go after the ordered ones
+	Order int `json:"order"`
+	// Order of the images inside the folder. One of newest, oldest or name
+	Sort string `json:"sort"`
+}
+
+// ReadAlbumMetadata reads the album file of any folder inside the library.
+// A folder without album file has empty metadata. If the file cannot be parsed or contains invalid values
+// an error wrapping ErrInvalidMetadata is returned.
+func ReadAlbumMetadata(libraryPath string, folder string) (AlbumMetadata, error) {
+	folderPath := path.Join(libraryPath, folder)
+	b, err := os.ReadFile(path.Join(folderPath, albumFileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return AlbumMetadata{}, nil
+		}
+		return AlbumMetadata{}, ErrUnexpected{cause: fmt.Errorf("error reading album file of %s. %v", folderPath, err)}
+	}
+
+	var metadata AlbumMetadata
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&metadata)
+	if err != nil {
+		return AlbumMetadata{}, fmt.Errorf("%w. %s of %s: %v", ErrInvalidMetadata, albumFileName, folder, err)
+	}
+
+	switch metadata.Sort {
+	case "", SortNewest, SortOldest, SortName:
+	default:
+		return AlbumMetadata{}, fmt.Errorf("%w. %s of %s: sort must be one of %s, %s or %s but was %q", ErrInvalidMetadata, albumFileName, folder, SortNewest, SortOldest, SortName, metadata.Sort)
+	}
+
+	if metadata.Cover != "" {
+		if strings.ContainsAny(metadata.Cover, `/\`) {
+			return AlbumMetadata{}, fmt.Errorf("%w. %s of %s: cover must be the name of a file in the folder", ErrInvalidMetadata, albumFileName, folder)
+		}
+		_, err := os.Stat(path.Join(folderPath, metadata.Cover))
+		if err != nil {
+			return AlbumMetadata{}, fmt.Errorf("%w. %s of %s: cover %s does not exist", ErrInvalidMetadata, albumFileName, folder, metadata.Cover)
+		}
+	}
+
+	return metadata, nil
+}
+
+// DisplayName returns the title of the album if present, otherwise the name of the folder.
+func (a Album) DisplayName() string {
+	if a.Metadata.Title != "" {
+		return a.Metadata.Title
+	}
+	return a.Name
+}
+
+// SortImages sorts the images in the order configured in the album file, newest first by default.
+// The dates are the creation times, so the date overrides of the catalog move the images too.
+func SortImages(images []Image, order string) {
+	switch order {
+	case SortOldest:
+		slices.SortFunc(images, func(a, b Image) int { return a.CreationTime.Compare(b.CreationTime) })
+	case SortName:
+		slices.SortFunc(images, func(a, b Image) int { return strings.Compare(a.Name, b.Name) })
+	default:
+		slices.SortFunc(images, func(a, b Image) int { return b.CreationTime.Compare(a.CreationTime) })
+	}
+}
@@ -0,0 +1,304 @@
+package library
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Exif contains the subset of the EXIF data of a JPEG image used by the gallery.
+type Exif struct {
+	Make     string
+	Model    string
+	DateTime time.Time
+	// Only valid when HasLocation is true
+	Latitude    float64
+	Longitude   float64
+	HasLocation bool
+}
+
+// Camera returns the make and model of the camera without repeating the make if it is part of the model.
+func (e Exif) Camera() string {
+	if e.Make == "" || strings.HasPrefix(strings.ToLower(e.Model), strings.ToLower(e.Make)) {
+		return e.Model
+	}
+	if e.Model == "" {
+		return e.Make
+	}
+	return e.Make + " " + e.Model
+}
+
+var errSegmentNotFound = errors.New("jpeg segment not found")
+
+const (
+	tagMake             uint16 = 0x010f
+	tagModel            uint16 = 0x0110
+	tagDateTime         uint16 = 0x0132
+	tagExifIFD          uint16 = 0x8769
+	tagGPSIFD           uint16 = 0x8825
+	tagDateTimeOriginal uint16 = 0x9003
+	tagGPSLatitudeRef   uint16 = 0x0001
+	tagGPSLatitude      uint16 = 0x0002
+	tagGPSLongitudeRef  uint16 = 0x0003
+	tagGPSLongitude     uint16 = 0x0004
+
+	exifDateLayout string = "2006:01:02 15:04:05"
+	exifPrefix     string = "Exif\x00\x00"
+)
+
+// ReadExif reads the EXIF data of a JPEG file. Files without EXIF data return an empty Exif.
+func ReadExif(filePath string) (Exif, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return Exif{}, fmt.Errorf("error opening file %s. %w", filePath, err)
+	}
+	defer f.Close()
+
+	segments, err := readJPEGSegments(bufio.NewReader(f))
+	if err != nil && !errors.Is(err, errSegmentNotFound) {
+		return Exif{}, fmt.Errorf("error reading segments of %s. %w", filePath, err)
+	}
+	segment, err := findSegment(segments, 0xe1, exifPrefix)
+	if err != nil {
+		return Exif{}, nil
+	}
+
+	exif, err := parseTIFF(segment)
+	if err != nil {
+		return Exif{}, fmt.Errorf("error parsing exif data of %s. %w", filePath, err)
+	}
+	return exif, nil
+}
+
+type jpegSegment struct {
+	marker  byte
+	payload []byte
+}
+
+// readJPEGSegments returns the application segments of a JPEG file which contain its metadata.
+func readJPEGSegments(r *bufio.Reader) ([]jpegSegment, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		// Not a JPEG file
+		return nil, errSegmentNotFound
+	}
+
+	var segments []jpegSegment
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+		if b != 0xff {
+			return nil, errors.New("invalid jpeg marker")
+		}
+		m, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+		// Padding bytes
+		if m == 0xff {
+			r.UnreadByte()
+			continue
+		}
+		// Start of scan or end of image, the metadata segments are always before
+		if m == 0xda || m == 0xd9 {
+			break
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint16(size[:])) - 2
+		if length < 0 {
+			return nil, errors.New("invalid jpeg segment length")
+		}
+		// Only APPn segments contain metadata
+		if m < 0xe0 || m > 0xef {
+			if _, err := r.Discard(length); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+		segments = append(segments, jpegSegment{marker: m, payload: payload})
+	}
+	return segments, nil
+}
+
+// findSegment returns the payload of the first segment with the given marker starting with prefix, without the prefix.
+func findSegment(segments []jpegSegment, marker byte, prefix string) ([]byte, error) {
+	for _, segment := range segments {
+		if segment.marker == marker && bytes.HasPrefix(segment.payload, []byte(prefix)) {
+			return segment.payload[len(prefix):], nil
+		}
+	}
+	return nil, errSegmentNotFound
+}
+
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type ifdEntry struct {
+	tag      uint16
+	kind     uint16
+	count    uint32
+	valueRaw []byte
+}
+
+func parseTIFF(data []byte) (Exif, error) {
+	if len(data) < 8 {
+		return Exif{}, errors.New("tiff header too short")
+	}
+	t := tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return Exif{}, errors.New("invalid tiff byte order")
+	}
+
+	var exif Exif
+	ifd0, err := t.ifd(t.order.Uint32(data[4:8]))
+	if err != nil {
+		return Exif{}, err
+	}
+	var dateTime string
+	for _, entry := range ifd0 {
+		switch entry.tag {
+		case tagMake:
+			exif.Make = t.ascii(entry)
+		case tagModel:
+			exif.Model = t.ascii(entry)
+		case tagDateTime:
+			dateTime = t.ascii(entry)
+		case tagExifIFD:
+			exifIFD, err := t.ifd(t.long(entry))
+			if err != nil {
+				continue
+			}
+			for _, exifEntry := range exifIFD {
+				if exifEntry.tag == tagDateTimeOriginal {
+					dateTime = t.ascii(exifEntry)
+				}
+			}
+		case tagGPSIFD:
+			gpsIFD, err := t.ifd(t.long(entry))
+			if err != nil {
+				continue
+			}
+			exif.Latitude, exif.Longitude, exif.HasLocation = t.location(gpsIFD)
+		}
+	}
+
+	if dateTime != "" {
+		// Dates without time zone are in the local time of the camera which is unknown, use UTC like the file name dates
+		parsed, err := time.Parse(exifDateLayout, dateTime)
+		if err == nil {
+			exif.DateTime = parsed
+		}
+	}
+
+	return exif, nil
+}
+
+func (t tiffReader) ifd(offset uint32) ([]ifdEntry, error) {
+	if int(offset)+2 > len(t.data) {
+		return nil, errors.New("ifd offset out of bounds")
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	start := int(offset) + 2
+	if start+count*12 > len(t.data) {
+		return nil, errors.New("ifd entries out of bounds")
+	}
+
+	entries := make([]ifdEntry, 0, count)
+	for i := 0; i < count; i++ {
+		raw := t.data[start+i*12 : start+(i+1)*12]
+		entries = append(entries, ifdEntry{
+			tag:      t.order.Uint16(raw[0:2]),
+			kind:     t.order.Uint16(raw[2:4]),
+			count:    t.order.Uint32(raw[4:8]),
+			valueRaw: raw[8:12],
+		})
+	}
+	return entries, nil
+}
+
+// value returns the bytes of the value of the entry which are inline if they fit in 4 bytes.
+func (t tiffReader) value(entry ifdEntry, size int) []byte {
+	total := size * int(entry.count)
+	if total <= 4 {
+		return entry.valueRaw[:total]
+	}
+	offset := int(t.order.Uint32(entry.valueRaw))
+	if offset < 0 || offset+total > len(t.data) {
+		return nil
+	}
+	return t.data[offset : offset+total]
+}
+
+func (t tiffReader) ascii(entry ifdEntry) string {
+	return strings.TrimSpace(strings.TrimRight(string(t.value(entry, 1)), "\x00"))
+}
+
+func (t tiffReader) long(entry ifdEntry) uint32 {
+	return t.order.Uint32(entry.valueRaw)
+}
+
+func (t tiffReader) rationals(entry ifdEntry) []float64 {
+	value := t.value(entry, 8)
+	var rationals []float64
+	for i := 0; i+8 <= len(value); i += 8 {
+		numerator := t.order.Uint32(value[i:])
+		denominator := t.order.Uint32(value[i+4:])
+		if denominator == 0 {
+			return nil
+		}
+		rationals = append(rationals, float64(numerator)/float64(denominator))
+	}
+	return rationals
+}
+
+func (t tiffReader) location(entries []ifdEntry) (float64, float64, bool) {
+	var latitude, longitude []float64
+	var latitudeRef, longitudeRef string
+	for _, entry := range entries {
+		switch entry.tag {
+		case tagGPSLatitudeRef:
+			latitudeRef = t.ascii(entry)
+		case tagGPSLatitude:
+			latitude = t.rationals(entry)
+		case tagGPSLongitudeRef:
+			longitudeRef = t.ascii(entry)
+		case tagGPSLongitude:
+			longitude = t.rationals(entry)
+		}
+	}
+	if len(latitude) != 3 || len(longitude) != 3 {
+		return 0, 0, false
+	}
+
+	lat := latitude[0] + latitude[1]/60 + latitude[2]/3600
+	if latitudeRef == "S" {
+		lat = -lat
+	}
+	long := longitude[0] + longitude[1]/60 + longitude[2]/3600
+	if longitudeRef == "W" {
+		long = -long
+	}
+	return lat, long, true
+}
@@ -0,0 +1,184 @@
+package library
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUnsupportedMedia = errors.New("unsupported media type")
+
+// Extensions of the files that can be imported into the library
+var supportedExtensions = []string{".jpg", ".jpeg", ".png", ".mp4"}
+
+// Serializes the imports so two files with the same name do not get the same destination
+var importMu sync.Mutex
+
+// Import moves the file of the source path into the library with the given name. The file is placed in the folder
+// of the year it was taken, unless a folder is given, and its thumbnail is generated so it can be browsed right away.
+// If a file with the same name exists in the folder a number is appended to the name.
+func Import(libraryPath string, thumbnailsPath string, sourcePath string, name string, folder string) (Image, error) {
+	name = path.Base(filepath.ToSlash(name))
+	if !filepath.IsLocal(name) || !isItem(name) {
+		return Image{}, fmt.Errorf("%w. invalid name %s", ErrUnsupportedMedia, name)
+	}
+	err := ValidateMedia(sourcePath, name)
+	if err != nil {
+		return Image{}, err
+	}
+
+	captureTime := CaptureTime(sourcePath, name)
+	if folder == "" {
+		folder = yearFolder(captureTime)
+	}
+	if !isValidFolder(folder) {
+		return Image{}, fmt.Errorf("invalid folder %s", folder)
+	}
+
+	importMu.Lock()
+	defer importMu.Unlock()
+
+	folderPath := path.Join(libraryPath, folder)
+	err = os.MkdirAll(folderPath, os.ModePerm)
+	if err != nil {
+		return Image{}, fmt.Errorf("error creating folder %s. %w", folder, err)
+	}
+	name, err = availableName(folderPath, name, nil)
+	if err != nil {
+		return Image{}, err
+	}
+	destinationPath := path.Join(folderPath, name)
+	err = moveFile(sourcePath, destinationPath)
+	if err != nil {
+		return Image{}, fmt.Errorf("error moving %s to the library. %w", name, err)
+	}
+	// The library uses the modification time as creation time when the name does not contain it
+	if !res.MatchString(name) {
+		os.Chtimes(destinationPath, captureTime, captureTime)
+	}
+
+	err = generateImportThumbnail(thumbnailsPath, folder, destinationPath)
+	if err != nil {
+		// The file is already in the library and the next scan will try again
+		log.Printf("could not generate thumbnail of %s. %v", name, err)
+	}
+	return Item(libraryPath, path.Join(folder, name))
+}
+
+// ImportFolder returns the folder the file is imported into when no folder is given, the one of the year it was taken
+func ImportFolder(sourcePath string, name string) string {
+	return yearFolder(CaptureTime(sourcePath, path.Base(filepath.ToSlash(name))))
+}
+
+func yearFolder(captureTime time.Time) string {
+	return strconv.Itoa(captureTime.Year())
+}
+
+// ValidateMedia checks that the file has a supported extension and that its contents match it.
+// Images are decoded to reject corrupt files.
+func ValidateMedia(filePath string, name string) error {
+	ext := strings.ToLower(filepath.Ext(name))
+	supported := false
+	for _, supportedExt := range supportedExtensions {
+		supported = supported || ext == supportedExt
+	}
+	if !supported {
+		return fmt.Errorf("%w. %s", ErrUnsupportedMedia, ext)
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("error opening file %s. %w", filePath, err)
+	}
+	defer f.Close()
+
+	if isVideo(name) {
+		// Every MP4 file starts with a ftyp box
+		header := make([]byte, 8)
+		_, err := io.ReadFull(f, header)
+		if err != nil || string(header[4:8]) != "ftyp" {
+			return fmt.Errorf("%w. %s is not a valid video", ErrUnsupportedMedia, name)
+		}
+		return nil
+	}
+
+	_, _, err = image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("%w. %s could not be decoded. %v", ErrUnsupportedMedia, name, err)
+	}
+	return nil
+}
+
+// CaptureTime returns the date the file was taken from its EXIF data, its name or its modification time in that order.
+func CaptureTime(filePath string, name string) time.Time {
+	if !isVideo(name) {
+		exif, err := ReadExif(filePath)
+		if err == nil && !exif.DateTime.IsZero() {
+			return exif.DateTime
+		}
+	}
+	if matches := res.FindStringSubmatch(name); len(matches) >= 2 {
+		captureTime, err := time.Parse(layout, matches[1])
+		if err == nil {
+			return captureTime
+		}
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return time.Now()
+	}
+	return info.ModTime()
+}
+
+// Only top-level folders of the library can contain items
+func isValidFolder(folder string) bool {
+	return filepath.IsLocal(folder) && !strings.ContainsAny(folder, `/\`) && !strings.HasPrefix(folder, ".")
+}
+
+// availableName appends a number to the name until no file of the folder has it and it is not reserved
+func availableName(folderPath string, name string, reserved map[string]bool) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 1; ; i++ {
+		exists, err := exists(path.Join(folderPath, candidate))
+		if err != nil {
+			return "", err
+		}
+		if !exists && !reserved[path.Join(folderPath, candidate)] {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
+
+func generateImportThumbnail(thumbnailsPath string, folder string, filePath string) error {
+	if isVideo(filePath) {
+		return copyVideoThumbnail(thumbnailsPath)
+	}
+
+	thumbnailFolderPath := path.Join(thumbnailsPath, folder)
+	err := os.MkdirAll(thumbnailFolderPath, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("error creating thumbnails directory. %w", err)
+	}
+	imageFile, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("error opening image file. %w", err)
+	}
+	defer imageFile.Close()
+	_, err = generateThumbnail(imageFile, thumbnailFolderPath)
+	if err != nil {
+		return fmt.Errorf("error generating thumbnail of %s. %w", filePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package library
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"davidc.es/jag/catalog"
+)
+
+// ImportOptions configures the import of the files of an inbox folder into the library.
+type ImportOptions struct {
+	// Folder of the library to import the files into instead of the folder of the year they were taken
+	Folder string
+	// Pattern of the new names of the files, see RenameFile. Empty keeps the original names.
+	NamePattern string
+	// Copy the files instead of moving them
+	Copy bool
+}
+
+// PlannedImport is the destination of a file of the inbox in the library.
+type PlannedImport struct {
+	SourcePath  string
+	CaptureTime time.Time
+	// Path relative to the library, empty when the file is skipped
+	Path string
+	// Path of the item of the library with the same contents when the file is a duplicate
+	Duplicate string
+	// Set when the file cannot be imported or when its import failed
+	Err error
+}
+
+// InboxFiles returns the files of the inbox folder and its subfolders except the hidden ones.
+func InboxFiles(inboxPath string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(inboxPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && filePath != inboxPath {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.Type().IsRegular() {
+			files = append(files, filePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading inbox %s. %w", inboxPath, err)
+	}
+	return files, nil
+}
+
+// PlanImport decides the destination of every file without modifying the library. The files whose contents
+// are already in the library or earlier in the list are skipped as duplicates.
+func PlanImport(libraryPath string, sourcePaths []string, options ImportOptions) ([]PlannedImport, error) {
+	hashFile := catalog.Hash
+	if itemCatalog != nil {
+		hashFile = itemCatalog.Hash
+	}
+	contents, err := libraryHashes(libraryPath, hashFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var plan []PlannedImport
+	// Destinations of the previous files of the plan
+	reserved := make(map[string]bool)
+	for _, sourcePath := range sourcePaths {
+		planned := PlannedImport{SourcePath: sourcePath}
+		plan = append(plan, planned)
+		current := &plan[len(plan)-1]
+
+		name := path.Base(filepath.ToSlash(sourcePath))
+		if !isItem(name) {
+			current.Err = fmt.Errorf("%w. %s", ErrUnsupportedMedia, name)
+			continue
+		}
+		err := ValidateMedia(sourcePath, name)
+		if err != nil {
+			current.Err = err
+			continue
+		}
+
+		hash, err := hashFile(sourcePath)
+		if err != nil {
+			current.Err = err
+			continue
+		}
+		duplicate, err := findDuplicate(sourcePath, contents[hash])
+		if err != nil {
+			current.Err = err
+			continue
+		}
+		if duplicate != "" {
+			current.Duplicate = duplicate
+			// Duplicates of previous files of the plan are outside of the library
+			if rel, err := filepath.Rel(libraryPath, duplicate); err == nil && filepath.IsLocal(rel) {
+				current.Duplicate = filepath.ToSlash(rel)
+			}
+			continue
+		}
+
+		current.CaptureTime = CaptureTime(sourcePath, name)
+		folder := options.Folder
+		if folder == "" {
+			folder = strconv.Itoa(current.CaptureTime.Year())
+		}
+		if !isValidFolder(folder) {
+			return nil, fmt.Errorf("invalid folder %s", folder)
+		}
+		if options.NamePattern != "" {
+			name = RenameFile(options.NamePattern, name, current.CaptureTime)
+		}
+		name, err = availableName(path.Join(libraryPath, folder), name, reserved)
+		if err != nil {
+			current.Err = err
+			continue
+		}
+		current.Path = path.Join(folder, name)
+		reserved[path.Join(libraryPath, current.Path)] = true
+		contents[hash] = append(contents[hash], sourcePath)
+	}
+	return plan, nil
+}
+
+// ExecuteImport moves or copies the files of the plan to their destination and generates their thumbnails.
+// The errors of every file are set in the returned plan.
+func ExecuteImport(libraryPath string, thumbnailsPath string, plan []PlannedImport, options ImportOptions) []PlannedImport {
+	importMu.Lock()
+	defer importMu.Unlock()
+
+	for i, planned := range plan {
+		if planned.Path == "" || planned.Err != nil {
+			continue
+		}
+		folderPath := path.Join(libraryPath, path.Dir(planned.Path))
+		destinationPath := path.Join(libraryPath, planned.Path)
+		err := os.MkdirAll(folderPath, os.ModePerm)
+		if err != nil {
+			plan[i].Err = fmt.Errorf("error creating folder %s. %w", folderPath, err)
+			continue
+		}
+		// The library could have changed since the plan was made
+		if exists, _ := exists(destinationPath); exists {
+			plan[i].Err = fmt.Errorf("%w. %s", ErrAlreadyExists, planned.Path)
+			continue
+		}
+
+		if options.Copy {
+			err = copyFile(planned.SourcePath, destinationPath)
+		} else {
+			err = moveFile(planned.SourcePath, destinationPath)
+		}
+		if err != nil {
+			plan[i].Err = fmt.Errorf("error importing %s. %w", planned.SourcePath, err)
+			continue
+		}
+		if !res.MatchString(path.Base(planned.Path)) {
+			os.Chtimes(destinationPath, planned.CaptureTime, planned.CaptureTime)
+		}
+
+		err = generateImportThumbnail(thumbnailsPath, path.Dir(planned.Path), destinationPath)
+		if err != nil {
+			// The file is already in the library and the next scan will try again
+			plan[i].Err = err
+		}
+	}
+	return plan
+}
+
+// RenameFile replaces the placeholders of the pattern with the capture time and the original name and keeps
+// the extension of the original name. The placeholders are {date} like 20240131, {time} like 150405,
+// {year}, {month}, {day} and {name}, the original name without extension.
+// The pattern IMG_{date}_{time} makes the library read the creation time from the name.
+func RenameFile(pattern string, name string, captureTime time.Time) string {
+	ext := filepath.Ext(name)
+	replacer := strings.NewReplacer(
+		"{date}", captureTime.Format("20060102"),
+		"{time}", captureTime.Format("150405"),
+		"{year}", captureTime.Format("2006"),
+		"{month}", captureTime.Format("01"),
+		"{day}", captureTime.Format("02"),
+		"{name}", strings.TrimSuffix(name, ext),
+	)
+	renamed := path.Base(replacer.Replace(pattern))
+	if renamed == "." || renamed == "/" {
+		return name
+	}
+	return renamed + strings.ToLower(ext)
+}
+
+// libraryHashes returns the paths of the items of the library by hash
+func libraryHashes(libraryPath string, hashFile func(filePath string) (string, error)) (map[string][]string, error) {
+	hashes := make(map[string][]string)
+	for _, folder := range Years(libraryPath) {
+		entries, err := os.ReadDir(path.Join(libraryPath, folder))
+		if err != nil {
+			return nil, fmt.Errorf("error reading folder %s. %w", folder, err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !isItem(entry.Name()) {
+				continue
+			}
+			filePath := path.Join(libraryPath, folder, entry.Name())
+			hash, err := hashFile(filePath)
+			if err != nil {
+				return nil, err
+			}
+			hashes[hash] = append(hashes[hash], filePath)
+		}
+	}
+	return hashes, nil
+}
+
+// findDuplicate returns the candidate with exactly the same contents as the file since the hashes only cover part of it
+func findDuplicate(filePath string, candidates []string) (string, error) {
+	for _, candidate := range candidates {
+		same, err := sameContents(filePath, candidate)
+		if err != nil {
+			return "", err
+		}
+		if same {
+			return candidate, nil
+		}
+	}
+	return "", nil
+}
+
+func sameContents(aPath string, bPath string) (bool, error) {
+	a, err := os.Open(aPath)
+	if err != nil {
+		return false, err
+	}
+	defer a.Close()
+	b, err := os.Open(bPath)
+	if err != nil {
+		return false, err
+	}
+	defer b.Close()
+
+	aBuffer, bBuffer := make([]byte, 64*1024), make([]byte, 64*1024)
+	for {
+		aN, aErr := io.ReadFull(a, aBuffer)
+		bN, bErr := io.ReadFull(b, bBuffer)
+		if aN != bN || !bytes.Equal(aBuffer[:aN], bBuffer[:bN]) {
+			return false, nil
+		}
+		if aErr == io.EOF || aErr == io.ErrUnexpectedEOF {
+			return bErr == io.EOF || bErr == io.ErrUnexpectedEOF, nil
+		}
+		if aErr != nil {
+			return false, aErr
+		}
+		if bErr != nil {
+			return false, bErr
+		}
+	}
+}
+
+func copyFile(sourcePath string, destinationPath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	destination, err := os.OpenFile(destinationPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(destination, source)
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(destinationPath)
+		return err
+	}
+	// Keep the modification time since it is used as creation time when the name does not contain it
+	os.Chtimes(destinationPath, info.ModTime(), info.ModTime())
+	return nil
+}
@@ -6,12 +6,25 @@ import (
 	"log"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"strings"
 	"time"
+
+	"davidc.es/jag/catalog"
 )
 
 var ErrNotExist = os.ErrNotExist
 
+// Catalog with the data of the items managed by the server, see SetCatalog
+var itemCatalog catalog.Catalog
+
+// SetCatalog makes the images returned by the library include the data of the catalog.
+func SetCatalog(c catalog.Catalog) {
+	itemCatalog = c
+}
+
 type ErrUnexpected struct {
 	cause error
 }
@@ -27,13 +40,49 @@ type Image struct {
 	Name          string
 	ThumbnailPath string
 	ThumbnailName string
+	Title         string
+	Description   string
+	Keywords      []string
+	// Rating of the catalog if set, otherwise the one of the image metadata
+	Rating int
+	// Content hash of the file, only set when a catalog is used
+	Hash      string
+	Favourite bool
+	// Caption of the catalog which replaces the description of the metadata when set
+	Caption string
+	// Time zone of the creation time when it was overridden in the catalog
+	TimeZone string
+	Archived bool
 }
 
+// Album summarizes a top-level folder of the library for the index page.
+// A folder named after a year (e.g. 2024) is still an Album, see IsYear.
+type Album struct {
+	Name          string
+	Count         int
+	From          time.Time
+	To            time.Time
+	CoverPath     string
+	ThumbnailPath string
+	Metadata      AlbumMetadata
+	// Set when the album file of the folder is invalid, the rest of the fields are still filled
+	MetadataError error
+}
+
+// Name of the optional file inside a folder containing the name of the image to use as cover
+const coverFileName string = ".cover"
+
 var (
-	res    = regexp.MustCompile(`^.*(\d\d\d\d\d\d\d\d_\d\d\d\d\d\d).*$`)
-	layout = "20060102_150405"
+	res     = regexp.MustCompile(`^.*(\d\d\d\d\d\d\d\d_\d\d\d\d\d\d).*$`)
+	layout  = "20060102_150405"
+	resYear = regexp.MustCompile(`^\d\d\d\d$`)
 )
 
+// IsYear reports whether the folder name is a year like 2024 as opposed to an album like Wedding.
+func IsYear(folder string) bool {
+	return resYear.MatchString(folder)
+}
+
 func Years(libraryPath string) []string {
 	var years []string
 	f, err := os.Open(libraryPath)
@@ -55,7 +104,17 @@ func Years(libraryPath string) []string {
 	return years
 }
 
+// Year returns the images of the folder except the ones archived in the catalog.
 func Year(libraryPath string, year string) ([]Image, error) {
+	images, err := YearWithArchived(libraryPath, year)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(images, func(image Image) bool { return image.Archived }), nil
+}
+
+// YearWithArchived returns all the images of the folder including the ones archived in the catalog.
+func YearWithArchived(libraryPath string, year string) ([]Image, error) {
 	yearPath := path.Join(libraryPath, year)
 	_, err := os.Stat(yearPath)
 	if err != nil {
@@ -78,25 +137,168 @@ func Year(libraryPath string, year string) ([]Image, error) {
 	}
 
 	for _, file := range fileInfos {
-		if !file.IsDir() {
-			imageName := file.Name()
-			imagePath := path.Join(year, file.Name())
-			images = append(images, Image{
-				CreationTime: extractCreationTime(file),
-				ModTime:      file.ModTime(), Path: imagePath,
-				Name:          imageName,
-				ThumbnailName: getThumbnailName(imageName),
-				ThumbnailPath: getThumbnailPath(imagePath),
-			})
+		if !file.IsDir() && isItem(file.Name()) {
+			images = append(images, newImage(yearPath, year, file))
 		}
 	}
 
 	return images, nil
 }
 
-// Try to extract the creation date from the name of the file.
+// Item returns the image of the library with the given path relative to the library like 2024/IMG_0001.jpg.
+func Item(libraryPath string, itemPath string) (Image, error) {
+	if !filepath.IsLocal(itemPath) || !isItem(path.Base(itemPath)) {
+		return Image{}, ErrNotExist
+	}
+	folderPath := path.Join(libraryPath, path.Dir(itemPath))
+	file, err := os.Stat(path.Join(libraryPath, itemPath))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Image{}, ErrNotExist
+		}
+		return Image{}, ErrUnexpected{cause: err}
+	}
+	if file.IsDir() {
+		return Image{}, ErrNotExist
+	}
+	return newImage(folderPath, path.Dir(itemPath), file), nil
+}
+
+// Skip hidden files like the cover file, the album file and the XMP sidecars
+func isItem(name string) bool {
+	return !strings.HasPrefix(name, ".") && name != albumFileName && !isSidecar(name)
+}
+
+func newImage(folderPath string, folder string, file os.FileInfo) Image {
+	imageName := file.Name()
+	imagePath := path.Join(folder, imageName)
+
+	var entry catalog.Entry
+	var hash string
+	if itemCatalog != nil {
+		var err error
+		hash, err = itemCatalog.Hash(path.Join(folderPath, imageName))
+		if err != nil {
+			log.Printf("could not hash %s. %v", imagePath, err)
+		} else {
+			entry = itemCatalog.Entry(hash)
+		}
+	}
+
+	image := Image{
+		CreationTime:  extractCreationTime(file, entry),
+		ModTime:       file.ModTime(),
+		Path:          imagePath,
+		Name:          imageName,
+		ThumbnailName: getThumbnailName(imageName),
+		ThumbnailPath: getThumbnailPath(imagePath),
+		Hash:          hash,
+		Favourite:     entry.Favourite,
+		Caption:       entry.Caption,
+		TimeZone:      entry.TimeZone,
+		Archived:      entry.Archived,
+	}
+
+	metadata, err := cachedReadMetadata(path.Join(folderPath, imageName), file.ModTime())
+	if err != nil {
+		log.Printf("could not read metadata of %s. %v", imagePath, err)
+	}
+	image.Title = metadata.Title
+	image.Description = metadata.Description
+	image.Keywords = metadata.Keywords
+	image.Rating = metadata.Rating
+	if entry.Caption != "" {
+		image.Description = entry.Caption
+	}
+	if entry.Rating > 0 {
+		image.Rating = entry.Rating
+	}
+	return image
+}
+
+// Summary returns the number of items, the date range, the metadata and the cover of the folder.
+// The cover is the image named in the album file or in the cover file of the folder if present, otherwise the newest image.
+func Summary(libraryPath string, folder string) (Album, error) {
+	album, _, err := Folder(libraryPath, folder)
+	return album, err
+}
+
+// Folder returns the summary of the folder together with its images sorted as configured in the album file.
+func Folder(libraryPath string, folder string) (Album, []Image, error) {
+	images, err := Year(libraryPath, folder)
+	if err != nil {
+		return Album{}, nil, err
+	}
+
+	album := Album{Name: folder, Count: len(images)}
+	album.Metadata, err = ReadAlbumMetadata(libraryPath, folder)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidMetadata) {
+			return Album{}, nil, err
+		}
+		album.MetadataError = err
+	}
+	SortImages(images, album.Metadata.Sort)
+	if len(images) == 0 {
+		return album, images, nil
+	}
+
+	cover := album.Metadata.Cover
+	if cover == "" {
+		cover = configuredCover(path.Join(libraryPath, folder))
+	}
+	var coverImage, newest *Image
+	for i, image := range images {
+		if album.From.IsZero() || image.CreationTime.Before(album.From) {
+			album.From = image.CreationTime
+		}
+		if image.CreationTime.After(album.To) {
+			album.To = image.CreationTime
+		}
+		if image.Name == cover {
+			coverImage = &images[i]
+		}
+		// Videos only have a generic thumbnail so prefer images
+		if !isVideo(image.Name) && (newest == nil || image.CreationTime.After(newest.CreationTime)) {
+			newest = &images[i]
+		}
+	}
+	if coverImage == nil {
+		coverImage = newest
+	}
+	if coverImage == nil {
+		// Only videos in the folder
+		coverImage = &images[0]
+	}
+	album.CoverPath = coverImage.Path
+	album.ThumbnailPath = coverImage.ThumbnailPath
+
+	return album, images, nil
+}
+
+func configuredCover(folderPath string) string {
+	b, err := os.ReadFile(path.Join(folderPath, coverFileName))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("error reading cover file of %s. %v", folderPath, err)
+		}
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// Use the creation date of the catalog entry if it was overridden, otherwise
+// try to extract the creation date from the name of the file.
 // If that is not possible use file.ModTime() as fallback.
-func extractCreationTime(file os.FileInfo) time.Time {
+func extractCreationTime(file os.FileInfo, entry catalog.Entry) time.Time {
+	if !entry.CreationTime.IsZero() {
+		location, err := time.LoadLocation(entry.TimeZone)
+		if err != nil {
+			return entry.CreationTime
+		}
+		return entry.CreationTime.In(location)
+	}
+
 	matches := res.FindStringSubmatch(file.Name())
 	if len(matches) >= 2 {
 		match := matches[1]
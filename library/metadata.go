@@ -0,0 +1,354 @@
+package library
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metadata contains the descriptive metadata written by tools like Lightroom or digiKam,
+// either embedded in the image as IPTC or XMP or in an XMP sidecar next to it.
+type Metadata struct {
+	Title       string
+	Description string
+	Keywords    []string
+	// From 1 to 5, 0 when the image is not rated
+	Rating int
+}
+
+const (
+	xmpPrefix       string = "http://ns.adobe.com/xap/1.0/\x00"
+	photoshopPrefix string = "Photoshop 3.0\x00"
+	sidecarExt      string = ".xmp"
+
+	nsDC  string = "http://purl.org/dc/elements/1.1/"
+	nsXMP string = "http://ns.adobe.com/xap/1.0/"
+	nsRDF string = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+
+	// Photoshop image resource containing the IPTC-IIM records
+	iptcResourceID uint16 = 0x0404
+	iptcObjectName byte   = 5
+	iptcKeywords   byte   = 25
+	iptcCaption    byte   = 120
+)
+
+type cachedMetadata struct {
+	modTimes []time.Time
+	metadata Metadata
+}
+
+// Metadata of the files of the library by path, invalidated when the file or its sidecars change
+var metadataCache = struct {
+	sync.Mutex
+	entries map[string]cachedMetadata
+}{entries: make(map[string]cachedMetadata)}
+
+// SidecarPaths returns the possible paths of the XMP sidecar of a file. Some tools name the sidecar
+// IMG_0001.jpg.xmp and others IMG_0001.xmp.
+func SidecarPaths(filePath string) []string {
+	return []string{
+		filePath + sidecarExt,
+		strings.TrimSuffix(filePath, filepath.Ext(filePath)) + sidecarExt,
+	}
+}
+
+func isSidecar(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), sidecarExt)
+}
+
+// ReadMetadata reads the IPTC and XMP metadata of a file and its XMP sidecars.
+// The values of the sidecar take precedence over the embedded XMP ones, which take precedence over the IPTC ones.
+func ReadMetadata(filePath string) (Metadata, error) {
+	var metadata Metadata
+	if !isVideo(filePath) {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return Metadata{}, fmt.Errorf("error opening file %s. %w", filePath, err)
+		}
+		segments, err := readJPEGSegments(bufio.NewReader(f))
+		f.Close()
+		if err != nil && !errors.Is(err, errSegmentNotFound) {
+			return Metadata{}, fmt.Errorf("error reading segments of %s. %w", filePath, err)
+		}
+
+		if segment, err := findSegment(segments, 0xed, photoshopPrefix); err == nil {
+			metadata = merge(metadata, parseIPTC(segment))
+		}
+		if segment, err := findSegment(segments, 0xe1, xmpPrefix); err == nil {
+			xmp, err := parseXMP(bytes.NewReader(segment))
+			if err != nil {
+				return Metadata{}, fmt.Errorf("error parsing embedded xmp of %s. %w", filePath, err)
+			}
+			metadata = merge(metadata, xmp)
+		}
+	}
+
+	for _, sidecarPath := range SidecarPaths(filePath) {
+		b, err := os.ReadFile(sidecarPath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return Metadata{}, fmt.Errorf("error reading sidecar %s. %w", sidecarPath, err)
+		}
+		xmp, err := parseXMP(bytes.NewReader(b))
+		if err != nil {
+			return Metadata{}, fmt.Errorf("error parsing sidecar %s. %w", sidecarPath, err)
+		}
+		metadata = merge(metadata, xmp)
+		break
+	}
+
+	return metadata, nil
+}
+
+// cachedReadMetadata reads the metadata of the file only if it or its sidecars changed since the last read
+func cachedReadMetadata(filePath string, modTime time.Time) (Metadata, error) {
+	modTimes := []time.Time{modTime}
+	for _, sidecarPath := range SidecarPaths(filePath) {
+		var sidecarModTime time.Time
+		if info, err := os.Stat(sidecarPath); err == nil {
+			sidecarModTime = info.ModTime()
+		}
+		modTimes = append(modTimes, sidecarModTime)
+	}
+
+	metadataCache.Lock()
+	cached, ok := metadataCache.entries[filePath]
+	metadataCache.Unlock()
+	if ok && slices.EqualFunc(cached.modTimes, modTimes, time.Time.Equal) {
+		return cached.metadata, nil
+	}
+
+	metadata, err := ReadMetadata(filePath)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	metadataCache.Lock()
+	metadataCache.entries[filePath] = cachedMetadata{modTimes: modTimes, metadata: metadata}
+	metadataCache.Unlock()
+	return metadata, nil
+}
+
+// merge overrides the values of base with the non empty values of override
+func merge(base Metadata, override Metadata) Metadata {
+	if override.Title != "" {
+		base.Title = override.Title
+	}
+	if override.Description != "" {
+		base.Description = override.Description
+	}
+	if len(override.Keywords) > 0 {
+		base.Keywords = override.Keywords
+	}
+	if override.Rating != 0 {
+		base.Rating = override.Rating
+	}
+	return base
+}
+
+// parseXMP extracts the dc:title, dc:description, dc:subject and xmp:Rating properties of an XMP packet
+func parseXMP(r io.Reader) (Metadata, error) {
+	var metadata Metadata
+	decoder := xml.NewDecoder(r)
+	// Stack of the open properties
+	var stack []xml.Name
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return Metadata{}, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name)
+			if t.Name.Space == nsRDF && t.Name.Local == "Description" {
+				// Simple properties can be written as attributes of rdf:Description
+				for _, attr := range t.Attr {
+					setXMPProperty(&metadata, attr.Name, attr.Value)
+				}
+			}
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			value := strings.TrimSpace(string(t))
+			if value == "" || len(stack) == 0 {
+				continue
+			}
+			current := stack[len(stack)-1]
+			if current.Space == nsRDF && current.Local == "li" {
+				// Items of dc:subject bags and dc:title or dc:description alternatives
+				for _, property := range slices.Backward(stack) {
+					if property.Space != nsRDF {
+						setXMPProperty(&metadata, property, value)
+						break
+					}
+				}
+				continue
+			}
+			setXMPProperty(&metadata, current, value)
+		}
+	}
+	return metadata, nil
+}
+
+func setXMPProperty(metadata *Metadata, name xml.Name, value string) {
+	switch {
+	case name.Space == nsDC && name.Local == "title" && metadata.Title == "":
+		metadata.Title = value
+	case name.Space == nsDC && name.Local == "description" && metadata.Description == "":
+		metadata.Description = value
+	case name.Space == nsDC && name.Local == "subject":
+		metadata.Keywords = appendKeyword(metadata.Keywords, value)
+	case name.Space == nsXMP && name.Local == "Rating":
+		// Ratings can be decimal numbers and -1 means rejected
+		rating, err := strconv.ParseFloat(value, 64)
+		if err == nil && rating >= 0 && rating <= 5 {
+			metadata.Rating = int(rating)
+		}
+	}
+}
+
+// parseIPTC extracts the object name, caption and keywords of the IPTC-IIM records of a Photoshop APP13 segment
+func parseIPTC(data []byte) Metadata {
+	var metadata Metadata
+	for len(data) >= 12 && string(data[:4]) == "8BIM" {
+		id := binary.BigEndian.Uint16(data[4:6])
+		// Pascal string padded to an even length
+		nameLength := int(data[6]) + 1
+		nameLength += nameLength % 2
+		offset := 6 + nameLength
+		if offset+4 > len(data) {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		offset += 4
+		if size < 0 || offset+size > len(data) {
+			break
+		}
+		if id == iptcResourceID {
+			metadata = merge(metadata, parseIIM(data[offset:offset+size]))
+		}
+		offset += size + size%2
+		if offset > len(data) {
+			break
+		}
+		data = data[offset:]
+	}
+	return metadata
+}
+
+func parseIIM(data []byte) Metadata {
+	var metadata Metadata
+	for len(data) >= 5 && data[0] == 0x1c {
+		record, dataset := data[1], data[2]
+		size := int(binary.BigEndian.Uint16(data[3:5]))
+		// Extended datasets are not used for the supported fields
+		if size&0x8000 != 0 || 5+size > len(data) {
+			break
+		}
+		value := strings.TrimSpace(string(data[5 : 5+size]))
+		if record == 2 && value != "" {
+			switch dataset {
+			case iptcObjectName:
+				metadata.Title = value
+			case iptcCaption:
+				metadata.Description = value
+			case iptcKeywords:
+				metadata.Keywords = appendKeyword(metadata.Keywords, value)
+			}
+		}
+		data = data[5+size:]
+	}
+	return metadata
+}
+
+func appendKeyword(keywords []string, keyword string) []string {
+	if slices.Contains(keywords, keyword) {
+		return keywords
+	}
+	return append(keywords, keyword)
+}
+
+// HasKeyword reports whether the image has the keyword ignoring case.
+func (i Image) HasKeyword(keyword string) bool {
+	return slices.ContainsFunc(i.Keywords, func(k string) bool { return strings.EqualFold(k, keyword) })
+}
+
+var (
+	resRatingAttr    = regexp.MustCompile(`xmp:Rating="[^"]*"`)
+	resRatingElement = regexp.MustCompile(`<xmp:Rating>[^<]*</xmp:Rating>`)
+	resDescription   = regexp.MustCompile(`<rdf:Description\b`)
+)
+
+const sidecarTemplate string = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:Rating="%d"/>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>
+`
+
+// WriteSidecarRating writes the rating to the XMP sidecar of the item, creating the sidecar if it does not exist.
+// The rest of the contents of an existing sidecar are kept.
+func WriteSidecarRating(libraryPath string, itemPath string, rating int) error {
+	filePath := path.Join(libraryPath, itemPath)
+	for _, sidecarPath := range SidecarPaths(filePath) {
+		b, err := os.ReadFile(sidecarPath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return fmt.Errorf("error reading sidecar %s. %w", sidecarPath, err)
+		}
+
+		sidecar := string(b)
+		switch {
+		case resRatingAttr.MatchString(sidecar):
+			sidecar = resRatingAttr.ReplaceAllString(sidecar, fmt.Sprintf(`xmp:Rating="%d"`, rating))
+		case resRatingElement.MatchString(sidecar):
+			sidecar = resRatingElement.ReplaceAllString(sidecar, fmt.Sprintf(`<xmp:Rating>%d</xmp:Rating>`, rating))
+		case resDescription.MatchString(sidecar):
+			attributes := fmt.Sprintf(` xmp:Rating="%d"`, rating)
+			if !strings.Contains(sidecar, `xmlns:xmp="`) {
+				attributes = ` xmlns:xmp="` + nsXMP + `"` + attributes
+			}
+			location := resDescription.FindStringIndex(sidecar)
+			sidecar = sidecar[:location[1]] + attributes + sidecar[location[1]:]
+		default:
+			return fmt.Errorf("sidecar %s does not contain an rdf:Description", sidecarPath)
+		}
+
+		err = os.WriteFile(sidecarPath, []byte(sidecar), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing sidecar %s. %w", sidecarPath, err)
+		}
+		return nil
+	}
+
+	sidecarPath := SidecarPaths(filePath)[0]
+	err := os.WriteFile(sidecarPath, []byte(fmt.Sprintf(sidecarTemplate, rating)), 0644)
+	if err != nil {
+		return fmt.Errorf("error creating sidecar %s. %w", sidecarPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package library
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Move moves the item of the library with the given path, its sidecars and its thumbnail to another top-level folder.
+// If a file with the same name exists in the folder a number is appended to the name.
+func Move(libraryPath string, thumbnailsPath string, itemPath string, folder string) (Image, error) {
+	image, err := Item(libraryPath, itemPath)
+	if err != nil {
+		return Image{}, err
+	}
+	if !isValidFolder(folder) {
+		return Image{}, fmt.Errorf("invalid folder %s", folder)
+	}
+	folderPath := path.Join(libraryPath, folder)
+	info, err := os.Stat(folderPath)
+	if err != nil || !info.IsDir() {
+		return Image{}, ErrNotExist
+	}
+	if path.Dir(image.Path) == folder {
+		return image, nil
+	}
+
+	importMu.Lock()
+	defer importMu.Unlock()
+
+	name, err := availableName(folderPath, image.Name, nil)
+	if err != nil {
+		return Image{}, err
+	}
+	sourcePath := path.Join(libraryPath, image.Path)
+	err = moveFile(sourcePath, path.Join(folderPath, name))
+	if err != nil {
+		return Image{}, fmt.Errorf("error moving %s to %s. %w", image.Path, folder, err)
+	}
+
+	for _, sidecarPath := range SidecarPaths(sourcePath) {
+		if _, err := os.Stat(sidecarPath); err != nil {
+			continue
+		}
+		// Keep the naming style of the sidecar, IMG_0001.jpg.xmp or IMG_0001.xmp
+		sidecarName := SidecarPaths(name)[0]
+		if filepath.Base(sidecarPath) != image.Name+sidecarExt {
+			sidecarName = SidecarPaths(name)[1]
+		}
+		err := moveFile(sidecarPath, path.Join(folderPath, sidecarName))
+		if err != nil {
+			log.Printf("could not move sidecar %s. %v", sidecarPath, err)
+		}
+	}
+	if !image.IsVideo() {
+		err := moveFile(path.Join(thumbnailsPath, image.ThumbnailPath), path.Join(thumbnailsPath, folder, getThumbnailName(name)))
+		if err != nil {
+			// The thumbnail will be generated again by the next scan
+			log.Printf("could not move thumbnail of %s. %v", image.Path, err)
+		}
+	}
+
+	return Item(libraryPath, path.Join(folder, name))
+}
@@ -7,6 +7,7 @@ import (
 	"image"
 	jpeg "image/jpeg"
 	_ "image/png"
+	"io"
 	"log"
 	"os"
 	"path"
@@ -51,7 +52,8 @@ func GenerateAllThumbnails(libraryPath string, thumbnailsPath string) error {
 			}
 		}
 
-		images, err := Year(libraryPath, year)
+		// Archived images keep their thumbnails to be able to browse the archive
+		images, err := YearWithArchived(libraryPath, year)
 		if err != nil {
 			return fmt.Errorf("error retrieving year images. %v", err)
 		}
@@ -128,6 +130,45 @@ func generateThumbnail(imageFile *os.File, thumbnailsPath string) (string, error
 	return path.Join(thumbnailsPath, thumbnailFile.Name()), nil
 }
 
+// Max width and height of the display renditions of the images
+const displaySize int = 2048
+
+// EncodeDisplayImage writes a JPEG version of the image scaled down to fit the display size.
+// Videos cannot be scaled and are copied as they are.
+func EncodeDisplayImage(w io.Writer, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("error opening file %s. %w", filePath, err)
+	}
+	defer f.Close()
+	if isVideo(filePath) {
+		_, err = io.Copy(w, f)
+		return err
+	}
+
+	inputImage, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("error decoding image %s. %w", filePath, err)
+	}
+	bounds := inputImage.Bounds()
+	outputImage := inputImage
+	if bounds.Dx() > displaySize || bounds.Dy() > displaySize {
+		ratio := min(float64(displaySize)/float64(bounds.Dx()), float64(displaySize)/float64(bounds.Dy()))
+		scaled := image.NewRGBA(image.Rect(0, 0, int(float64(bounds.Dx())*ratio), int(float64(bounds.Dy())*ratio)))
+		draw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), inputImage, bounds, draw.Over, nil)
+		outputImage = scaled
+	}
+	return jpeg.Encode(w, outputImage, &jpeg.Options{Quality: 85})
+}
+
+// DisplayImageName returns the name of the display rendition of the item, which is always a JPEG for images.
+func DisplayImageName(name string) string {
+	if isVideo(name) {
+		return name
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".jpg"
+}
+
 func exists(imagePath string) (bool, error) {
 	_, err := os.Stat(imagePath)
 	if err != nil {
@@ -154,6 +195,10 @@ func getThumbnailPath(imagePath string) string {
 	return strings.TrimSuffix(imagePath, filepath.Ext(imagePath)) + ".jpg"
 }
 
+func (i Image) IsVideo() bool {
+	return isVideo(i.Name)
+}
+
 func isVideo(path string) bool {
-	return filepath.Ext(path) == ".mp4"
+	return strings.EqualFold(filepath.Ext(path), ".mp4")
 }
@@ -0,0 +1,270 @@
+package library
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+)
+
+const trashedItemFileName string = "item.json"
+
+var ErrAlreadyExists = os.ErrExist
+
+// TrashedItem is an item of the library moved to the trash. Every item is stored in its own folder
+// of the trash together with its sidecars and thumbnail.
+type TrashedItem struct {
+	ID            string    `json:"-"`
+	Path          string    `json:"path"`
+	ThumbnailName string    `json:"thumbnailName,omitempty"`
+	Sidecars      []string  `json:"sidecars,omitempty"`
+	DeletedBy     string    `json:"deletedBy"`
+	DeletionTime  time.Time `json:"deletionTime"`
+}
+
+// Trash moves the item of the library with the given path, its sidecars and its thumbnail to the trash.
+func Trash(libraryPath string, thumbnailsPath string, trashPath string, itemPath string, actor string) (TrashedItem, error) {
+	image, err := Item(libraryPath, itemPath)
+	if err != nil {
+		return TrashedItem{}, err
+	}
+
+	b := make([]byte, 8)
+	// Ignore the error since it cannot fail. See source for more details
+	rand.Read(b)
+	item := TrashedItem{
+		ID:           time.Now().UTC().Format("20060102150405") + "-" + hex.EncodeToString(b),
+		Path:         image.Path,
+		DeletedBy:    actor,
+		DeletionTime: time.Now().UTC(),
+	}
+	itemTrashPath := path.Join(trashPath, item.ID)
+	err = os.MkdirAll(itemTrashPath, os.ModePerm)
+	if err != nil {
+		return TrashedItem{}, fmt.Errorf("error creating trash directory %s. %w", itemTrashPath, err)
+	}
+
+	for _, sidecarPath := range SidecarPaths(path.Join(libraryPath, image.Path)) {
+		if _, err := os.Stat(sidecarPath); err == nil {
+			item.Sidecars = append(item.Sidecars, filepath.Base(sidecarPath))
+		}
+	}
+	thumbnailPath := path.Join(thumbnailsPath, image.ThumbnailPath)
+	// The thumbnail of the videos is shared by all of them
+	if !image.IsVideo() {
+		if _, err := os.Stat(thumbnailPath); err == nil {
+			item.ThumbnailName = image.ThumbnailName
+		}
+	}
+	// Write the item file before moving anything so the original path is never lost
+	err = writeTrashedItem(itemTrashPath, item)
+	if err != nil {
+		return TrashedItem{}, err
+	}
+
+	filesPath := path.Join(itemTrashPath, trashedFilesDirName)
+	err = moveFile(path.Join(libraryPath, image.Path), path.Join(filesPath, image.Name))
+	if err != nil {
+		return TrashedItem{}, fmt.Errorf("error moving %s to the trash. %w", image.Path, err)
+	}
+	folderPath := path.Dir(path.Join(libraryPath, image.Path))
+	for _, sidecar := range item.Sidecars {
+		err := moveFile(path.Join(folderPath, sidecar), path.Join(filesPath, sidecar))
+		if err != nil {
+			log.Printf("could not move sidecar %s to the trash. %v", sidecar, err)
+		}
+	}
+	if item.ThumbnailName != "" {
+		err := moveFile(thumbnailPath, path.Join(itemTrashPath, thumbnailDirName, item.ThumbnailName))
+		if err != nil {
+			log.Printf("could not move thumbnail of %s to the trash. %v", image.Path, err)
+		}
+	}
+
+	return item, nil
+}
+
+// Name of the folder of the trashed item containing its thumbnail to avoid clashes with the item name
+const thumbnailDirName string = "thumbnail"
+
+// Name of the folder of the trashed item containing the item and its sidecars,
+// so they do not clash with the item file and the thumbnail folder whatever their names are
+const trashedFilesDirName string = "files"
+
+// TrashedThumbnailPath returns the path of the thumbnail of the trashed item or an empty string if it does not have one.
+func TrashedThumbnailPath(trashPath string, item TrashedItem) string {
+	if item.ThumbnailName == "" {
+		return ""
+	}
+	return path.Join(trashPath, item.ID, thumbnailDirName, item.ThumbnailName)
+}
+
+// TrashedItems returns the items of the trash, most recently deleted first.
+func TrashedItems(trashPath string) ([]TrashedItem, error) {
+	entries, err := os.ReadDir(trashPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading trash directory %s. %w", trashPath, err)
+	}
+
+	var items []TrashedItem
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		item, err := TrashedItemByID(trashPath, entry.Name())
+		if err != nil {
+			log.Printf("could not read trashed item %s. %v", entry.Name(), err)
+			continue
+		}
+		items = append(items, item)
+	}
+	slices.SortFunc(items, func(a, b TrashedItem) int { return b.DeletionTime.Compare(a.DeletionTime) })
+	return items, nil
+}
+
+func TrashedItemByID(trashPath string, id string) (TrashedItem, error) {
+	if !filepath.IsLocal(id) || path.Base(id) != id {
+		return TrashedItem{}, ErrNotExist
+	}
+	b, err := os.ReadFile(path.Join(trashPath, id, trashedItemFileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return TrashedItem{}, ErrNotExist
+		}
+		return TrashedItem{}, fmt.Errorf("error reading trashed item %s. %w", id, err)
+	}
+	var item TrashedItem
+	err = json.Unmarshal(b, &item)
+	if err != nil {
+		return TrashedItem{}, fmt.Errorf("error decoding trashed item %s. %w", id, err)
+	}
+	item.ID = id
+	return item, nil
+}
+
+// Restore moves the trashed item back to its original path in the library.
+// If another file was created in the same path meanwhile ErrAlreadyExists is returned.
+func Restore(libraryPath string, thumbnailsPath string, trashPath string, id string) (TrashedItem, error) {
+	item, err := TrashedItemByID(trashPath, id)
+	if err != nil {
+		return TrashedItem{}, err
+	}
+
+	originalPath := path.Join(libraryPath, item.Path)
+	if _, err := os.Stat(originalPath); err == nil {
+		return TrashedItem{}, fmt.Errorf("%w. %s", ErrAlreadyExists, item.Path)
+	}
+	err = os.MkdirAll(path.Dir(originalPath), os.ModePerm)
+	if err != nil {
+		return TrashedItem{}, fmt.Errorf("error creating folder of %s. %w", item.Path, err)
+	}
+
+	itemTrashPath := path.Join(trashPath, id)
+	filesPath := path.Join(itemTrashPath, trashedFilesDirName)
+	// The items trashed before the files had their own folder are stored next to the item file
+	if _, err := os.Stat(filesPath); errors.Is(err, os.ErrNotExist) {
+		filesPath = itemTrashPath
+	}
+	err = moveFile(path.Join(filesPath, path.Base(item.Path)), originalPath)
+	if err != nil {
+		return TrashedItem{}, fmt.Errorf("error restoring %s. %w", item.Path, err)
+	}
+	for _, sidecar := range item.Sidecars {
+		err := moveFile(path.Join(filesPath, sidecar), path.Join(path.Dir(originalPath), sidecar))
+		if err != nil {
+			log.Printf("could not restore sidecar %s. %v", sidecar, err)
+		}
+	}
+	if item.ThumbnailName != "" {
+		thumbnailPath := path.Join(thumbnailsPath, path.Dir(item.Path), item.ThumbnailName)
+		err := os.MkdirAll(path.Dir(thumbnailPath), os.ModePerm)
+		if err == nil {
+			err = moveFile(TrashedThumbnailPath(trashPath, item), thumbnailPath)
+		}
+		if err != nil {
+			// The thumbnail will be generated again by the next scan
+			log.Printf("could not restore thumbnail of %s. %v", item.Path, err)
+		}
+	}
+
+	err = os.RemoveAll(itemTrashPath)
+	if err != nil {
+		return TrashedItem{}, fmt.Errorf("error removing trash directory %s. %w", itemTrashPath, err)
+	}
+	return item, nil
+}
+
+// Purge permanently deletes the trashed item.
+func Purge(trashPath string, id string) error {
+	_, err := TrashedItemByID(trashPath, id)
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(path.Join(trashPath, id))
+	if err != nil {
+		return fmt.Errorf("error purging trashed item %s. %w", id, err)
+	}
+	return nil
+}
+
+// PurgeExpired permanently deletes the items that have been in the trash for longer than the retention.
+func PurgeExpired(trashPath string, retention time.Duration) error {
+	items, err := TrashedItems(trashPath)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if time.Since(item.DeletionTime) > retention {
+			err := Purge(trashPath, item.ID)
+			if err != nil {
+				return err
+			}
+			log.Printf("Purged %s from the trash", item.Path)
+		}
+	}
+	return nil
+}
+
+func writeTrashedItem(itemTrashPath string, item TrashedItem) error {
+	b, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding trashed item. %w", err)
+	}
+	err = os.WriteFile(path.Join(itemTrashPath, trashedItemFileName), b, 0600)
+	if err != nil {
+		return fmt.Errorf("error writing trashed item. %w", err)
+	}
+	return nil
+}
+
+// moveFile renames the file falling back to copying it when the source and the destination are in different file systems
+func moveFile(sourcePath string, destinationPath string) error {
+	err := os.MkdirAll(path.Dir(destinationPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(sourcePath, destinationPath)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	err = copyFile(sourcePath, destinationPath)
+	if err != nil {
+		return err
+	}
+	return os.Remove(sourcePath)
+}
@@ -2,15 +2,24 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+	// Embed the time zone database since the container image does not have one
+	_ "time/tzdata"
 
+	"davidc.es/jag/catalog"
 	"davidc.es/jag/configuration"
+	"davidc.es/jag/dropboxes"
 	"davidc.es/jag/http"
 	"davidc.es/jag/library"
+	"davidc.es/jag/search"
+	"davidc.es/jag/shares"
+	"davidc.es/jag/users"
 )
 
 func main() {
@@ -19,25 +28,61 @@ func main() {
 		log.Fatalf("error creating configuration. %v", err)
 	}
 
-	go func() {
-		err := library.GenerateAllThumbnails(configuration.LibraryPath(), configuration.ThumbnailsPath())
+	switch flag.Arg(0) {
+	case "":
+	case "import":
+		err := importCommand(configuration, flag.Args()[1:])
 		if err != nil {
-			log.Fatalf("error generating thumbnails. %v", err)
+			log.Fatalf("error importing files. %v", err)
 		}
-	}()
-	// Generate thumbnails every 1 hour
+		return
+	default:
+		fmt.Fprintf(flag.CommandLine.Output(), "Unknown command %s\nUsage: jag [flags] [import [import flags] <folder>]\n", flag.Arg(0))
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	itemCatalog, err := catalog.New(configuration.DataPath())
+	if err != nil {
+		log.Fatalf("error loading catalog. %v", err)
+	}
+	library.SetCatalog(itemCatalog)
+
+	userStore, err := users.New(configuration.DataPath())
+	if err != nil {
+		log.Fatalf("error loading users. %v", err)
+	}
+	err = userStore.Bootstrap(configuration.AdminUsername(), configuration.EncryptedPassword())
+	if err != nil {
+		log.Fatalf("error creating admin %s. %v", configuration.AdminUsername(), err)
+	}
+
+	shareStore, err := shares.New(configuration.DataPath())
+	if err != nil {
+		log.Fatalf("error loading shares. %v", err)
+	}
+	dropBoxStore, err := dropboxes.New(configuration.DataPath())
+	if err != nil {
+		log.Fatalf("error loading drop boxes. %v", err)
+	}
+
+	searchIndex := search.NewIndex()
+
+	go scan(configuration, searchIndex)
+	// Scan the library every 1 hour
 	ticker := time.NewTicker(1 * time.Hour)
 	go func() {
 		for range ticker.C {
-			err := library.GenerateAllThumbnails(configuration.LibraryPath(), configuration.ThumbnailsPath())
-			if err != nil {
-				log.Fatalf("error generating thumbnails. %v", err)
-			}
+			scan(configuration, searchIndex)
 		}
 	}()
 
+	if configuration.InboxPath() != "" {
+		go watchInbox(configuration, searchIndex)
+	}
+
 	// Attach HTTP handlers to HTTP server
-	server := http.Serve(configuration)
+	server := http.Serve(configuration, searchIndex, itemCatalog, userStore, shareStore, dropBoxStore)
 
 	// Handle gracefull shutdown
 	errC := make(chan error, 1)
@@ -70,3 +115,21 @@ func main() {
 	}
 	log.Print("Exited properly")
 }
+
+// scan generates the missing thumbnails, rebuilds the search index and purges the expired items of the trash
+func scan(configuration configuration.Configuration, searchIndex *search.Index) {
+	err := library.GenerateAllThumbnails(configuration.LibraryPath(), configuration.ThumbnailsPath())
+	if err != nil {
+		log.Fatalf("error generating thumbnails. %v", err)
+	}
+
+	err = searchIndex.Rebuild(configuration.LibraryPath())
+	if err != nil {
+		log.Printf("error rebuilding search index. %v", err)
+	}
+
+	err = library.PurgeExpired(configuration.TrashPath(), time.Duration(configuration.TrashRetentionDays())*24*time.Hour)
+	if err != nil {
+		log.Printf("error purging expired items from the trash. %v", err)
+	}
+}
@@ -0,0 +1,337 @@
+// Package oidc logs in the users with an OpenID Connect provider using the authorization code flow with PKCE.
+// The provider is discovered from its issuer URL and the ID tokens are verified with the RS256 or ES256 keys it publishes.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time between the downloads of the keys when an ID token is signed with an unknown one
+const minKeysRefreshInterval time.Duration = time.Minute
+
+// Time the metadata of the provider is cached before being discovered again
+const metadataTTL time.Duration = 24 * time.Hour
+
+// Tolerated difference between the clocks of the provider and the gallery
+const clockSkew time.Duration = time.Minute
+
+// Maximum size of the responses of the provider
+const maxResponseSize int64 = 1 << 20
+
+type metadata struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+}
+
+// Provider is an OpenID Connect provider the gallery is registered in as a client
+type Provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	client       *http.Client
+
+	mu          sync.Mutex
+	metadata    *metadata
+	discovered  time.Time
+	keys        map[string]any
+	keysFetched time.Time
+}
+
+// Claims are the claims of a verified ID token
+type Claims map[string]any
+
+// New returns the provider of the issuer URL, which is discovered the first time it is used.
+// The client secret is empty for the public clients and the openid scope is always requested.
+func New(issuer string, clientID string, clientSecret string, scopes []string) *Provider {
+	if !slices.Contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	return &Provider{
+		issuer:       issuer,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		scopes:       scopes,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// NewRandom returns a random base64url string for the state, the nonce and the PKCE code verifier
+func NewRandom() string {
+	b := make([]byte, 32)
+	// Ignore the error since it cannot fail. See source for more details
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// AuthURL returns the URL of the provider the user logs in with, which redirects back to the redirect URI with the code
+func (p *Provider) AuthURL(ctx context.Context, redirectURI string, state string, nonce string, codeVerifier string) (string, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {strings.Join(p.scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(m.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return m.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange redeems the code with the code verifier and returns the verified claims of the ID token
+func (p *Provider) Exchange(ctx context.Context, redirectURI string, code string, codeVerifier string, nonce string) (Claims, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {p.clientID},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("error creating token request. %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.do(req, &token)
+	if err != nil {
+		return nil, fmt.Errorf("error redeeming code. %w", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %d %s %s", status, token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("token response without ID token")
+	}
+	return p.verify(ctx, m, token.IDToken, nonce)
+}
+
+// verify checks the signature, the issuer, the audience, the expiration and the nonce of the ID token
+func (p *Provider) verify(ctx context.Context, m *metadata, idToken string, nonce string) (Claims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding ID token header. %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("error decoding ID token signature. %w", err)
+	}
+	key, err := p.key(ctx, m, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding ID token claims. %w", err)
+	}
+	if claims.String("iss") != m.Issuer {
+		return nil, fmt.Errorf("ID token of issuer %s instead of %s", claims.String("iss"), m.Issuer)
+	}
+	audience := claims.Strings("aud")
+	if !slices.Contains(audience, p.clientID) {
+		return nil, errors.New("ID token of another client")
+	}
+	if azp := claims.String("azp"); (len(audience) > 1 || azp != "") && azp != p.clientID {
+		return nil, errors.New("ID token authorized to another client")
+	}
+	now := time.Now()
+	expiration, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(expiration), 0).Add(clockSkew)) {
+		return nil, errors.New("ID token expired")
+	}
+	if issuedAt, ok := claims["iat"].(float64); ok && time.Unix(int64(issuedAt), 0).After(now.Add(clockSkew)) {
+		return nil, errors.New("ID token issued in the future")
+	}
+	if claims.String("nonce") != nonce {
+		return nil, errors.New("ID token of another login")
+	}
+	if claims.String("sub") == "" {
+		return nil, errors.New("ID token without subject")
+	}
+	return claims, nil
+}
+
+// discover returns the metadata of the provider, downloading it when it was not discovered yet or a day ago
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil && time.Since(p.discovered) < metadataTTL {
+		return p.metadata, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating discovery request. %w", err)
+	}
+	var m metadata
+	status, err := p.do(req, &m)
+	if err != nil {
+		return nil, fmt.Errorf("error discovering %s. %w", p.issuer, err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("discovery of %s returned %d", p.issuer, status)
+	}
+	// The issuer must be the configured one, trailing slash included, so the issuer of the ID tokens can be compared
+	if m.Issuer != p.issuer {
+		return nil, fmt.Errorf("discovery of %s returned issuer %s", p.issuer, m.Issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery of %s without endpoints", p.issuer)
+	}
+	// Providers that do not list the methods may still support PKCE, the ones that list them must support S256
+	if len(m.CodeChallengeMethods) > 0 && !slices.Contains(m.CodeChallengeMethods, "S256") {
+		return nil, fmt.Errorf("%s does not support PKCE with S256", p.issuer)
+	}
+	p.metadata = &m
+	p.discovered = time.Now()
+	// The keys could have changed with the metadata
+	p.keys = nil
+	return p.metadata, nil
+}
+
+// key returns the public key of the ID, downloading the keys of the provider again when it is unknown
+// since the provider could have rotated them
+func (p *Provider) key(ctx context.Context, m *metadata, kid string) (any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := lookupKey(p.keys, kid); ok {
+		return key, nil
+	}
+	if p.keys != nil && time.Since(p.keysFetched) < minKeysRefreshInterval {
+		return nil, fmt.Errorf("unknown key %s", kid)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.JWKSURI, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating keys request. %w", err)
+	}
+	var set jsonWebKeySet
+	status, err := p.do(req, &set)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading keys of %s. %w", p.issuer, err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("keys of %s returned %d", p.issuer, status)
+	}
+	p.keys = set.publicKeys()
+	p.keysFetched = time.Now()
+	if key, ok := lookupKey(p.keys, kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %s", kid)
+}
+
+// do sends the request and decodes the JSON response into the value, returning the status code
+func (p *Provider) do(req *http.Request, value any) (int, error) {
+	res, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	if err != nil {
+		return 0, err
+	}
+	err = json.Unmarshal(b, value)
+	// The errors are not always JSON
+	if err != nil && res.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("error decoding response. %w", err)
+	}
+	return res.StatusCode, nil
+}
+
+// lookupKey returns the key of the ID, or the only key when the ID token does not name it
+func lookupKey(keys map[string]any, kid string) (any, bool) {
+	if key, ok := keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func decodeSegment(segment string, value any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, value)
+}
+
+// String returns the claim when it is a string
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns the claim when it is a string or an array of strings, like the audience or the groups
+func (c Claims) Strings(name string) []string {
+	switch value := c[name].(type) {
+	case string:
+		return []string{value}
+	case []any:
+		var values []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
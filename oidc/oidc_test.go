@@ -0,0 +1,342 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "jag"
+	testClientSecret = "secret"
+	testRedirectURI  = "https://photos.example.com/login/oidc/callback"
+	testCode         = "code"
+)
+
+// testProvider is an identity provider that issues the ID token of the test for the code of the last login
+type testProvider struct {
+	server *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu sync.Mutex
+	// Keys published besides the RSA and EC ones by their ID
+	extraKeys map[string]*rsa.PrivateKey
+	// Code challenge of the last login and the ID token returned for its code
+	challenge    string
+	idToken      string
+	keysRequests int
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProvider{rsaKey: rsaKey, ecKey: ecKey, extraKeys: make(map[string]*rsa.PrivateKey)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                           p.server.URL,
+			"authorization_endpoint":           p.server.URL + "/authorize",
+			"token_endpoint":                   p.server.URL + "/token",
+			"jwks_uri":                         p.server.URL + "/jwks",
+			"code_challenge_methods_supported": []string{"S256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.keysRequests++
+		x, y := make([]byte, 32), make([]byte, 32)
+		p.ecKey.X.FillBytes(x)
+		p.ecKey.Y.FillBytes(y)
+		keys := []map[string]string{
+			rsaJWK("rsa", &p.rsaKey.PublicKey),
+			{"kty": "EC", "use": "sig", "kid": "ec", "crv": "P-256", "x": encode(x), "y": encode(y)},
+		}
+		for kid, key := range p.extraKeys {
+			keys = append(keys, rsaJWK(kid, &key.PublicKey))
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		clientID, clientSecret, _ := r.BasicAuth()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if clientID != testClientID || clientSecret != testClientSecret || r.PostFormValue("grant_type") != "authorization_code" ||
+			r.PostFormValue("code") != testCode || r.PostFormValue("redirect_uri") != testRedirectURI || encode(verifier[:]) != p.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "token_type": "Bearer", "id_token": p.idToken})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{"kty": "RSA", "use": "sig", "kid": kid, "n": encode(key.N.Bytes()), "e": encode(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// claims returns the claims of a valid ID token of the login with the nonce
+func (p *testProvider) claims(nonce string) map[string]any {
+	now := time.Now().Unix()
+	return map[string]any{
+		"iss":                p.server.URL,
+		"sub":                "248289761001",
+		"aud":                testClientID,
+		"exp":                now + 300,
+		"iat":                now,
+		"nonce":              nonce,
+		"preferred_username": "jane",
+		"groups":             []string{"family", "parents"},
+	}
+}
+
+// sign returns the ID token of the claims signed with the algorithm and the key of the ID
+func (p *testProvider) sign(t *testing.T, alg string, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := encode(header) + "." + encode(payload)
+	hash := sha256.Sum256([]byte(signed))
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		key := p.rsaKey
+		if extraKey, ok := p.extraKeys[kid]; ok {
+			key = extraKey
+		}
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, p.ecKey, hash[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case "HS256":
+		// The public key the provider publishes used as the shared secret
+		publicKey, _ := x509.MarshalPKIXPublicKey(&p.rsaKey.PublicKey)
+		mac := hmac.New(sha256.New, publicKey)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + encode(signature)
+}
+
+// login starts a login with the provider, which returns the ID token for the code, and returns the claims of the exchange
+func (p *testProvider) login(t *testing.T, provider *Provider, idToken func(nonce string) string) (Claims, error) {
+	t.Helper()
+	state, nonce, codeVerifier := NewRandom(), NewRandom(), NewRandom()
+	authURL, err := provider.AuthURL(context.Background(), testRedirectURI, state, nonce, codeVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if u.Path != "/authorize" || query.Get("state") != state || query.Get("nonce") != nonce || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("invalid authorization URL %s", authURL)
+	}
+	p.mu.Lock()
+	p.challenge = query.Get("code_challenge")
+	p.idToken = idToken(nonce)
+	p.mu.Unlock()
+	return provider.Exchange(context.Background(), testRedirectURI, testCode, codeVerifier, nonce)
+}
+
+func (p *testProvider) keysRequestCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.keysRequests
+}
+
+func (p *testProvider) newProvider() *Provider {
+	return New(p.server.URL, testClientID, testClientSecret, []string{"profile", "groups"})
+}
+
+func TestExchange(t *testing.T) {
+	p := newTestProvider(t)
+	for _, alg := range []string{"RS256", "ES256"} {
+		kid := map[string]string{"RS256": "rsa", "ES256": "ec"}[alg]
+		claims, err := p.login(t, p.newProvider(), func(nonce string) string { return p.sign(t, alg, kid, p.claims(nonce)) })
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+			continue
+		}
+		if claims.String("sub") != "248289761001" || claims.String("preferred_username") != "jane" {
+			t.Errorf("%s: got claims %v", alg, claims)
+		}
+		if groups := claims.Strings("groups"); len(groups) != 2 || groups[0] != "family" || groups[1] != "parents" {
+			t.Errorf("%s: got groups %v", alg, groups)
+		}
+	}
+}
+
+func TestAuthURLScopes(t *testing.T) {
+	p := newTestProvider(t)
+	authURL, err := p.newProvider().AuthURL(context.Background(), testRedirectURI, "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(authURL)
+	if scope := u.Query().Get("scope"); scope != "openid profile groups" {
+		t.Errorf("got scope %q", scope)
+	}
+	challenge := sha256.Sum256([]byte("verifier"))
+	if u.Query().Get("code_challenge") != encode(challenge[:]) {
+		t.Errorf("got code challenge %s", u.Query().Get("code_challenge"))
+	}
+}
+
+func TestExchangeErrors(t *testing.T) {
+	p := newTestProvider(t)
+	withClaims := func(update func(claims map[string]any)) func(nonce string) string {
+		return func(nonce string) string {
+			claims := p.claims(nonce)
+			update(claims)
+			return p.sign(t, "RS256", "rsa", claims)
+		}
+	}
+	tests := []struct {
+		name    string
+		idToken func(nonce string) string
+	}{
+		{"wrong nonce", withClaims(func(claims map[string]any) { claims["nonce"] = NewRandom() })},
+		{"without nonce", withClaims(func(claims map[string]any) { delete(claims, "nonce") })},
+		{"wrong audience", withClaims(func(claims map[string]any) { claims["aud"] = "another" })},
+		{"audience of several clients without authorized party", withClaims(func(claims map[string]any) { claims["aud"] = []string{testClientID, "another"} })},
+		{"another authorized party", withClaims(func(claims map[string]any) { claims["azp"] = "another" })},
+		{"wrong issuer", withClaims(func(claims map[string]any) { claims["iss"] = "https://evil.example.com" })},
+		{"expired", withClaims(func(claims map[string]any) { claims["exp"] = time.Now().Add(-clockSkew - time.Minute).Unix() })},
+		{"without expiration", withClaims(func(claims map[string]any) { delete(claims, "exp") })},
+		{"issued in the future", withClaims(func(claims map[string]any) { claims["iat"] = time.Now().Add(clockSkew + time.Minute).Unix() })},
+		{"without subject", withClaims(func(claims map[string]any) { delete(claims, "sub") })},
+		{"unknown key", func(nonce string) string { return p.sign(t, "RS256", "unknown", p.claims(nonce)) }},
+		{"alg none", func(nonce string) string {
+			token := p.sign(t, "RS256", "rsa", p.claims(nonce))
+			header, _ := json.Marshal(map[string]string{"alg": "none", "kid": "rsa"})
+			return encode(header) + "." + strings.Split(token, ".")[1] + "."
+		}},
+		{"HS256 with the RSA public key", func(nonce string) string { return p.sign(t, "HS256", "rsa", p.claims(nonce)) }},
+		{"ES256 with the RSA key", func(nonce string) string {
+			token := p.sign(t, "ES256", "ec", p.claims(nonce))
+			header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "rsa"})
+			return encode(header) + token[strings.Index(token, "."):]
+		}},
+		{"tampered claims", func(nonce string) string {
+			parts := strings.Split(p.sign(t, "RS256", "rsa", p.claims(nonce)), ".")
+			claims := p.claims(nonce)
+			claims["preferred_username"] = "admin"
+			payload, _ := json.Marshal(claims)
+			return parts[0] + "." + encode(payload) + "." + parts[2]
+		}},
+		{"malformed", func(nonce string) string { return "not a token" }},
+		{"without ID token", func(nonce string) string { return "" }},
+	}
+	for _, test := range tests {
+		_, err := p.login(t, p.newProvider(), test.idToken)
+		if err == nil {
+			t.Errorf("%s: verified", test.name)
+		}
+	}
+}
+
+func TestExchangeWrongCodeVerifier(t *testing.T) {
+	p := newTestProvider(t)
+	provider := p.newProvider()
+	_, err := provider.AuthURL(context.Background(), testRedirectURI, "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	p.challenge = "another"
+	p.idToken = p.sign(t, "RS256", "rsa", p.claims("nonce"))
+	p.mu.Unlock()
+	_, err = provider.Exchange(context.Background(), testRedirectURI, testCode, "verifier", "nonce")
+	if err == nil {
+		t.Error("redeemed the code of another login")
+	}
+}
+
+// The keys are downloaded again when the provider rotates them, but at most once a minute
+func TestKeyRotation(t *testing.T) {
+	p := newTestProvider(t)
+	provider := p.newProvider()
+	_, err := p.login(t, provider, func(nonce string) string { return p.sign(t, "RS256", "rsa", p.claims(nonce)) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotatedKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	p.extraKeys["rotated"] = rotatedKey
+	p.mu.Unlock()
+	rotated := func(nonce string) string { return p.sign(t, "RS256", "rotated", p.claims(nonce)) }
+	_, err = p.login(t, provider, rotated)
+	if err == nil {
+		t.Error("verified with a key downloaded less than a minute ago")
+	}
+	if requests := p.keysRequestCount(); requests != 1 {
+		t.Errorf("got %d key requests, want 1", requests)
+	}
+
+	provider.mu.Lock()
+	provider.keysFetched = time.Now().Add(-minKeysRefreshInterval)
+	provider.mu.Unlock()
+	_, err = p.login(t, provider, rotated)
+	if err != nil {
+		t.Errorf("rotated key: %v", err)
+	}
+	if requests := p.keysRequestCount(); requests != 2 {
+		t.Errorf("got %d key requests, want 2", requests)
+	}
+}
+
+func TestDiscoveryOfAnotherIssuer(t *testing.T) {
+	p := newTestProvider(t)
+	provider := New(p.server.URL+"/", testClientID, testClientSecret, nil)
+	_, err := provider.AuthURL(context.Background(), testRedirectURI, "state", "nonce", "verifier")
+	if err == nil {
+		t.Error("discovered a provider of another issuer")
+	}
+}
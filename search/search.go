@@ -0,0 +1,424 @@
+package search
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"davidc.es/jag/library"
+)
+
+const (
+	MediaTypeImage string = "image"
+	MediaTypeVideo string = "video"
+
+	// Max number of documents returned by a search when the query has no limit
+	defaultLimit int = 200
+)
+
+type Document struct {
+	Path          string    `json:"path"`
+	Name          string    `json:"name"`
+	Folder        string    `json:"folder"`
+	FolderTitle   string    `json:"folderTitle"`
+	ThumbnailPath string    `json:"thumbnailPath"`
+	MediaType     string    `json:"mediaType"`
+	Camera        string    `json:"camera,omitempty"`
+	HasLocation   bool      `json:"hasLocation"`
+	CreationTime  time.Time `json:"creationTime"`
+	Title         string    `json:"title,omitempty"`
+	Caption       string    `json:"caption,omitempty"`
+	Tags          []string  `json:"tags,omitempty"`
+}
+
+// Query filters the documents of the index. Empty fields do not filter.
+type Query struct {
+	Text      string
+	Year      string
+	MediaType string
+	Camera    string
+	// Documents with the tag ignoring case
+	Tag string
+	// One of yes or no
+	HasLocation string
+	From        time.Time
+	// Inclusive
+	To     time.Time
+	Offset int
+	Limit  int
+	// Visible reports whether the document of the path can be returned, all of them when it is nil
+	Visible func(path string) bool
+}
+
+type FacetValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+type Facets struct {
+	Years       []FacetValue `json:"years"`
+	MediaTypes  []FacetValue `json:"mediaTypes"`
+	Cameras     []FacetValue `json:"cameras"`
+	HasLocation []FacetValue `json:"hasLocation"`
+	Tags        []FacetValue `json:"tags"`
+}
+
+type Result struct {
+	Total     int        `json:"total"`
+	Documents []Document `json:"documents"`
+	Facets    Facets     `json:"facets"`
+}
+
+type cachedExif struct {
+	modTime time.Time
+	exif    library.Exif
+}
+
+// Index is an in memory inverted index of the library rebuilt by the scan job.
+type Index struct {
+	mu        sync.RWMutex
+	documents []Document
+	// Sorted list of the tokens of all the documents to find tokens by prefix
+	vocabulary []string
+	postings   map[string][]int
+
+	// Serializes the rebuilds and the updates, which are the only ones accessing the cache
+	rebuildMu sync.Mutex
+	exifCache map[string]cachedExif
+
+	refreshMu  sync.Mutex
+	refreshing bool
+	pending    bool
+}
+
+func NewIndex() *Index {
+	return &Index{
+		postings:  make(map[string][]int),
+		exifCache: make(map[string]cachedExif),
+	}
+}
+
+// Rebuild scans the whole library and replaces the contents of the index.
+// The EXIF data of the files that did not change since the previous rebuild is not read again.
+func (i *Index) Rebuild(libraryPath string) error {
+	i.rebuildMu.Lock()
+	defer i.rebuildMu.Unlock()
+
+	var documents []Document
+	exifCache := make(map[string]cachedExif, len(i.exifCache))
+	for _, folder := range library.Years(libraryPath) {
+		album, images, err := library.Folder(libraryPath, folder)
+		if err != nil {
+			return fmt.Errorf("error reading folder %s. %w", folder, err)
+		}
+		for _, image := range images {
+			documents = append(documents, i.newDocument(libraryPath, album.DisplayName(), image, exifCache))
+		}
+	}
+
+	i.setDocuments(documents)
+	i.exifCache = exifCache
+
+	log.Printf("Search index rebuilt with %d documents", len(documents))
+	return nil
+}
+
+// Update replaces the document of the item after a change in the catalog without scanning the library again.
+// The document is removed when the item no longer exists or it was archived.
+func (i *Index) Update(libraryPath string, itemPath string) error {
+	i.rebuildMu.Lock()
+	defer i.rebuildMu.Unlock()
+
+	i.mu.RLock()
+	documents := slices.DeleteFunc(slices.Clone(i.documents), func(document Document) bool { return document.Path == itemPath })
+	i.mu.RUnlock()
+
+	image, err := library.Item(libraryPath, itemPath)
+	if err != nil && !errors.Is(err, library.ErrNotExist) {
+		return fmt.Errorf("error reading item %s. %w", itemPath, err)
+	}
+	if err == nil && !image.Archived {
+		album := library.Album{Name: path.Dir(itemPath)}
+		album.Metadata, err = library.ReadAlbumMetadata(libraryPath, album.Name)
+		if err != nil && !errors.Is(err, library.ErrInvalidMetadata) {
+			return fmt.Errorf("error reading folder %s. %w", album.Name, err)
+		}
+		documents = append(documents, i.newDocument(libraryPath, album.DisplayName(), image, i.exifCache))
+	}
+	i.setDocuments(documents)
+	return nil
+}
+
+// newDocument returns the document of the image, reading its EXIF data when it is not in the cache of the previous rebuild
+// or the file changed since then. The EXIF data is added to the cache passed.
+func (i *Index) newDocument(libraryPath string, folderTitle string, image library.Image, exifCache map[string]cachedExif) Document {
+	document := Document{
+		Path:          image.Path,
+		Name:          image.Name,
+		Folder:        path.Dir(image.Path),
+		FolderTitle:   folderTitle,
+		ThumbnailPath: image.ThumbnailPath,
+		MediaType:     MediaTypeImage,
+		CreationTime:  image.CreationTime,
+		Title:         image.Title,
+		Caption:       image.Description,
+		Tags:          image.Keywords,
+	}
+	if image.IsVideo() {
+		document.MediaType = MediaTypeVideo
+		return document
+	}
+	cached, ok := i.exifCache[image.Path]
+	if !ok || !cached.modTime.Equal(image.ModTime) {
+		exif, err := library.ReadExif(path.Join(libraryPath, image.Path))
+		if err != nil {
+			log.Printf("could not read exif data of %s. %v", image.Path, err)
+		}
+		cached = cachedExif{modTime: image.ModTime, exif: exif}
+	}
+	exifCache[image.Path] = cached
+	document.Camera = cached.exif.Camera()
+	document.HasLocation = cached.exif.HasLocation
+	return document
+}
+
+// setDocuments sorts the documents and replaces the contents of the index with them
+func (i *Index) setDocuments(documents []Document) {
+	// Newest first
+	slices.SortStableFunc(documents, func(a, b Document) int { return b.CreationTime.Compare(a.CreationTime) })
+
+	postings := make(map[string][]int)
+	for id, document := range documents {
+		for _, token := range documentTokens(document) {
+			ids := postings[token]
+			// Tokens can be repeated inside the same document
+			if len(ids) == 0 || ids[len(ids)-1] != id {
+				postings[token] = append(ids, id)
+			}
+		}
+	}
+	vocabulary := make([]string, 0, len(postings))
+	for token := range postings {
+		vocabulary = append(vocabulary, token)
+	}
+	slices.Sort(vocabulary)
+
+	i.mu.Lock()
+	i.documents = documents
+	i.postings = postings
+	i.vocabulary = vocabulary
+	i.mu.Unlock()
+}
+
+// Refresh rebuilds the index in the background after a change in the library or the catalog.
+// The refreshes requested while a rebuild is running are done together in a single rebuild after it.
+func (i *Index) Refresh(libraryPath string) {
+	i.refreshMu.Lock()
+	defer i.refreshMu.Unlock()
+	if i.refreshing {
+		i.pending = true
+		return
+	}
+	i.refreshing = true
+
+	go func() {
+		for {
+			err := i.Rebuild(libraryPath)
+			if err != nil {
+				log.Printf("error refreshing search index. %v", err)
+			}
+
+			i.refreshMu.Lock()
+			if !i.pending {
+				i.refreshing = false
+				i.refreshMu.Unlock()
+				return
+			}
+			i.pending = false
+			i.refreshMu.Unlock()
+		}
+	}()
+}
+
+// Search returns the documents matching all the words of the text and all the filters of the query.
+// The count of every facet is calculated applying all the filters except the one of the facet itself.
+func (i *Index) Search(query Query) Result {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	candidates := i.match(query.Text)
+
+	years := make(map[string]int)
+	mediaTypes := make(map[string]int)
+	cameras := make(map[string]int)
+	locations := make(map[string]int)
+	tags := make(map[string]int)
+
+	var result Result
+	var matches []int
+	for _, id := range candidates {
+		document := i.documents[id]
+		if query.Visible != nil && !query.Visible(document.Path) {
+			continue
+		}
+		if !query.From.IsZero() && document.CreationTime.Before(query.From) {
+			continue
+		}
+		if !query.To.IsZero() && document.CreationTime.After(query.To) {
+			continue
+		}
+
+		year := strconv.Itoa(document.CreationTime.Year())
+		location := "no"
+		if document.HasLocation {
+			location = "yes"
+		}
+
+		yearOk := query.Year == "" || query.Year == year
+		mediaTypeOk := query.MediaType == "" || query.MediaType == document.MediaType
+		cameraOk := query.Camera == "" || query.Camera == document.Camera
+		locationOk := query.HasLocation == "" || query.HasLocation == location
+		tagOk := query.Tag == "" || slices.ContainsFunc(document.Tags, func(tag string) bool { return strings.EqualFold(tag, query.Tag) })
+
+		if mediaTypeOk && cameraOk && locationOk && tagOk {
+			years[year]++
+		}
+		if yearOk && cameraOk && locationOk && tagOk {
+			mediaTypes[document.MediaType]++
+		}
+		if yearOk && mediaTypeOk && locationOk && tagOk && document.Camera != "" {
+			cameras[document.Camera]++
+		}
+		if yearOk && mediaTypeOk && cameraOk && tagOk {
+			locations[location]++
+		}
+		if yearOk && mediaTypeOk && cameraOk && locationOk {
+			for _, tag := range document.Tags {
+				tags[tag]++
+			}
+		}
+		if yearOk && mediaTypeOk && cameraOk && locationOk && tagOk {
+			matches = append(matches, id)
+		}
+	}
+
+	result.Total = len(matches)
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if query.Offset < len(matches) {
+		matches = matches[max(query.Offset, 0):]
+		for _, id := range matches[:min(limit, len(matches))] {
+			result.Documents = append(result.Documents, i.documents[id])
+		}
+	}
+
+	result.Facets = Facets{
+		Years:       facetValues(years, func(a, b FacetValue) int { return strings.Compare(b.Value, a.Value) }),
+		MediaTypes:  facetValues(mediaTypes, nil),
+		Cameras:     facetValues(cameras, nil),
+		HasLocation: facetValues(locations, func(a, b FacetValue) int { return strings.Compare(b.Value, a.Value) }),
+		Tags:        facetValues(tags, nil),
+	}
+	return result
+}
+
+// Tags returns all the tags of the visible documents of the library with the number of documents of each one sorted by name.
+// All the documents are visible when visible is nil.
+func (i *Index) Tags(visible func(path string) bool) []FacetValue {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	counts := make(map[string]int)
+	// Tags that only differ in case are the same tag, use the first spelling found
+	names := make(map[string]string)
+	for _, document := range i.documents {
+		if visible != nil && !visible(document.Path) {
+			continue
+		}
+		for _, tag := range document.Tags {
+			key := strings.ToLower(tag)
+			if _, ok := names[key]; !ok {
+				names[key] = tag
+			}
+			counts[names[key]]++
+		}
+	}
+	return facetValues(counts, func(a, b FacetValue) int { return strings.Compare(strings.ToLower(a.Value), strings.ToLower(b.Value)) })
+}
+
+// match returns the ids of the documents containing a token starting with every word of the text, in index order.
+func (i *Index) match(text string) []int {
+	words := tokenize(text)
+	if len(words) == 0 {
+		ids := make([]int, len(i.documents))
+		for id := range ids {
+			ids[id] = id
+		}
+		return ids
+	}
+
+	var ids []int
+	for n, word := range words {
+		wordIds := make(map[int]bool)
+		for j := sort.SearchStrings(i.vocabulary, word); j < len(i.vocabulary) && strings.HasPrefix(i.vocabulary[j], word); j++ {
+			for _, id := range i.postings[i.vocabulary[j]] {
+				wordIds[id] = true
+			}
+		}
+		if n == 0 {
+			for id := range wordIds {
+				ids = append(ids, id)
+			}
+			slices.Sort(ids)
+		} else {
+			ids = slices.DeleteFunc(ids, func(id int) bool { return !wordIds[id] })
+		}
+		if len(ids) == 0 {
+			break
+		}
+	}
+	return ids
+}
+
+func documentTokens(document Document) []string {
+	var tokens []string
+	for _, field := range []string{document.Name, document.Folder, document.FolderTitle, document.Camera, document.Title, document.Caption} {
+		tokens = append(tokens, tokenize(field)...)
+	}
+	for _, tag := range document.Tags {
+		tokens = append(tokens, tokenize(tag)...)
+	}
+	return tokens
+}
+
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// facetValues sorts the values by descending count by default
+func facetValues(counts map[string]int, sortFunc func(a, b FacetValue) int) []FacetValue {
+	values := make([]FacetValue, 0, len(counts))
+	for value, count := range counts {
+		values = append(values, FacetValue{Value: value, Count: count})
+	}
+	if sortFunc == nil {
+		sortFunc = func(a, b FacetValue) int {
+			return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Value, b.Value))
+		}
+	}
+	slices.SortFunc(values, sortFunc)
+	return values
+}
@@ -0,0 +1,185 @@
+package shares
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"davidc.es/jag/jsonfile"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const sharesFileName string = "shares.json"
+
+var ErrNotFound = errors.New("share not found")
+
+// Share gives access to a folder or some items of the library to anyone with the link of the token
+type Share struct {
+	Token string `json:"token"`
+	Title string `json:"title"`
+	// Either the folder or the paths of the items are shared
+	Folder       string    `json:"folder,omitempty"`
+	Paths        []string  `json:"paths,omitempty"`
+	CreatedBy    string    `json:"createdBy"`
+	CreationTime time.Time `json:"creationTime"`
+	// Zero when the share does not expire
+	Expiration    time.Time `json:"expiration,omitzero"`
+	PasswordHash  string    `json:"passwordHash,omitempty"`
+	AllowDownload bool      `json:"allowDownload,omitempty"`
+	Views         int       `json:"views"`
+}
+
+func (s Share) Expired() bool {
+	return !s.Expiration.IsZero() && time.Now().After(s.Expiration)
+}
+
+func (s Share) HasPassword() bool {
+	return s.PasswordHash != ""
+}
+
+func (s Share) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(s.PasswordHash), []byte(password)) == nil
+}
+
+// Store keeps the share links. The expired shares are removed the next time the store is written.
+type Store interface {
+	// Create stores the share with a new token hashing the password when it is not empty
+	Create(share Share, password string) (Share, error)
+	// Share returns the share of the token, ErrNotFound when it does not exist or it expired
+	Share(token string) (Share, error)
+	// Shares returns the shares that did not expire, newest first
+	Shares() []Share
+	Revoke(token string) error
+	AddView(token string) error
+}
+
+type fileStore struct {
+	mu       sync.RWMutex
+	filePath string
+	shares   map[string]Share
+}
+
+// New loads the shares stored in the data path, creating the data path if it does not exist.
+func New(dataPath string) (Store, error) {
+	err := os.MkdirAll(dataPath, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("error creating data directory %s. %w", dataPath, err)
+	}
+
+	s := &fileStore{
+		filePath: path.Join(dataPath, sharesFileName),
+		shares:   make(map[string]Share),
+	}
+	b, err := os.ReadFile(s.filePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading %s. %w", s.filePath, err)
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &s.shares)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s. %w", s.filePath, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *fileStore) Create(share Share, password string) (Share, error) {
+	b := make([]byte, 32)
+	rand.Read(b)
+	share.Token = hex.EncodeToString(b)
+	share.CreationTime = time.Now().UTC()
+	share.Views = 0
+	share.PasswordHash = ""
+	if password != "" {
+		passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return Share{}, fmt.Errorf("error hashing password. %w", err)
+		}
+		share.PasswordHash = string(passwordHash)
+	}
+
+	err := s.update(func(shares map[string]Share) error {
+		shares[share.Token] = share
+		return nil
+	})
+	if err != nil {
+		return Share{}, err
+	}
+	return share, nil
+}
+
+func (s *fileStore) Share(token string) (Share, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	share, ok := s.shares[token]
+	if !ok || share.Expired() {
+		return Share{}, ErrNotFound
+	}
+	return share, nil
+}
+
+func (s *fileStore) Shares() []Share {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var shares []Share
+	for _, share := range s.shares {
+		if !share.Expired() {
+			shares = append(shares, share)
+		}
+	}
+	slices.SortFunc(shares, func(a, b Share) int { return b.CreationTime.Compare(a.CreationTime) })
+	return shares
+}
+
+func (s *fileStore) Revoke(token string) error {
+	return s.update(func(shares map[string]Share) error {
+		if _, ok := shares[token]; !ok {
+			return ErrNotFound
+		}
+		delete(shares, token)
+		return nil
+	})
+}
+
+func (s *fileStore) AddView(token string) error {
+	return s.update(func(shares map[string]Share) error {
+		share, ok := shares[token]
+		if !ok {
+			return ErrNotFound
+		}
+		share.Views++
+		shares[token] = share
+		return nil
+	})
+}
+
+// update modifies a copy of the shares and writes them to disk before replacing the ones in memory
+func (s *fileStore) update(update func(shares map[string]Share) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shares := make(map[string]Share, len(s.shares))
+	for token, share := range s.shares {
+		if !share.Expired() {
+			shares[token] = share
+		}
+	}
+	err := update(shares)
+	if err != nil {
+		return err
+	}
+
+	err = jsonfile.Write(s.filePath, shares)
+	if err != nil {
+		return err
+	}
+	s.shares = shares
+	return nil
+}
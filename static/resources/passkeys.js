@@ -0,0 +1,90 @@
+// Registration of the passkeys and login with them. Without WebAuthn support the forms stay hidden.
+(function () {
+  if (!window.PublicKeyCredential) {
+    return;
+  }
+
+  function decode(value) {
+    const base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+    return Uint8Array.from(atob(base64), (c) => c.charCodeAt(0)).buffer;
+  }
+
+  function encode(buffer) {
+    const bytes = String.fromCharCode(...new Uint8Array(buffer));
+    return btoa(bytes).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+  }
+
+  async function post(url, body) {
+    const response = await fetch(url, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: body === undefined ? undefined : JSON.stringify(body),
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()).trim() || response.statusText);
+    }
+    return response;
+  }
+
+  function showError(container, error) {
+    const message = container.querySelector(".passkey-error");
+    // Cancelling the dialog of the browser is not an error
+    if (error.name === "NotAllowedError" || error.name === "AbortError") {
+      message.hidden = true;
+      return;
+    }
+    message.textContent = error.message;
+    message.hidden = false;
+  }
+
+  const register = document.querySelector("form.passkey-register");
+  if (register) {
+    register.hidden = false;
+    register.addEventListener("submit", async (event) => {
+      event.preventDefault();
+      try {
+        const options = await (await post("/passkeys/options")).json();
+        options.challenge = decode(options.challenge);
+        options.user.id = decode(options.user.id);
+        options.excludeCredentials.forEach((credential) => {
+          credential.id = decode(credential.id);
+        });
+        const credential = await navigator.credentials.create({ publicKey: options });
+        await post("/passkeys", {
+          name: register.elements.name.value,
+          clientDataJSON: encode(credential.response.clientDataJSON),
+          attestationObject: encode(credential.response.attestationObject),
+        });
+        window.location.reload();
+      } catch (error) {
+        showError(register, error);
+      }
+    });
+  }
+
+  const login = document.querySelector(".passkey-login");
+  if (login) {
+    login.hidden = false;
+    login.querySelector("button").addEventListener("click", async () => {
+      try {
+        const options = await (await post("/login/passkey/options")).json();
+        options.challenge = decode(options.challenge);
+        const credential = await navigator.credentials.get({ publicKey: options });
+        const remember = document.getElementById("remember");
+        const result = await (
+          await post("/login/passkey", {
+            id: credential.id,
+            clientDataJSON: encode(credential.response.clientDataJSON),
+            authenticatorData: encode(credential.response.authenticatorData),
+            signature: encode(credential.response.signature),
+            userHandle: credential.response.userHandle ? encode(credential.response.userHandle) : "",
+            remember: remember !== null && remember.checked,
+          })
+        ).json();
+        window.location.href = result.redirect;
+      } catch (error) {
+        showError(login, error);
+      }
+    });
+  }
+})();
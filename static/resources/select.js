@@ -0,0 +1,68 @@
+// Selection mode of the grids. Without JavaScript the items can still be selected with their checkboxes.
+(function () {
+  const form = document.querySelector("form.selection");
+  if (!form) {
+    return;
+  }
+  const mode = form.querySelector("#select-mode");
+  const count = form.querySelector(".selection-count");
+  const boxes = Array.from(form.querySelectorAll(".select-box"));
+  let last = null;
+
+  function update() {
+    const selected = boxes.filter((box) => box.checked).length;
+    count.textContent = selected + " selected";
+    form.querySelectorAll(".selection-actions button").forEach((button) => {
+      button.disabled = selected === 0;
+    });
+  }
+
+  // Shift-click selects or unselects all the items between the last clicked one and this one
+  function toggle(box, shift) {
+    if (shift && last !== null) {
+      const from = boxes.indexOf(last);
+      const to = boxes.indexOf(box);
+      boxes.slice(Math.min(from, to), Math.max(from, to) + 1).forEach((b) => {
+        b.checked = box.checked;
+      });
+    }
+    last = box;
+    update();
+  }
+
+  form.querySelectorAll(".image-container").forEach((container) => {
+    const box = container.querySelector(".select-box");
+    container.querySelector("a").addEventListener("click", (event) => {
+      if (!mode.checked) {
+        return;
+      }
+      event.preventDefault();
+      box.checked = !box.checked;
+      toggle(box, event.shiftKey);
+    });
+    box.addEventListener("click", (event) => toggle(box, event.shiftKey));
+  });
+
+  form.querySelectorAll(".select-bucket").forEach((button) => {
+    const grid = button.parentElement.nextElementSibling;
+    button.addEventListener("click", () => {
+      const bucket = Array.from(grid.querySelectorAll(".select-box"));
+      const checked = !bucket.every((box) => box.checked);
+      bucket.forEach((box) => {
+        box.checked = checked;
+      });
+      update();
+    });
+  });
+
+  form.querySelectorAll("[data-confirm]").forEach((button) => {
+    button.addEventListener("click", (event) => {
+      if (!confirm(button.dataset.confirm)) {
+        event.preventDefault();
+      }
+    });
+  });
+
+  mode.addEventListener("change", update);
+  update();
+})();
@@ -0,0 +1,447 @@
+package tus
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Version    string = "1.0.0"
+	Extensions string = "creation,termination,checksum,expiration"
+
+	offsetContentType string = "application/offset+octet-stream"
+	// Status code defined by the checksum extension when the checksum does not match
+	statusChecksumMismatch int = 460
+)
+
+// ErrForbidden is returned by the CompleteFunc to refuse an upload the user is not allowed to make
+var ErrForbidden = errors.New("forbidden")
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// CompleteFunc is called when all the bytes of an upload have been received with the path of the file and the
+// metadata sent by the client when it was created. The file is removed after the call so it must be moved to keep it.
+// The returned location is sent to the client in the Content-Location header.
+type CompleteFunc func(r *http.Request, filePath string, metadata map[string]string) (string, error)
+
+type info struct {
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Handler implements the core tus 1.0 protocol with the creation, termination, checksum and expiration extensions.
+// The uploads are stored in the staging path as a data file and an info file named after the upload id.
+type Handler struct {
+	basePath    string
+	stagingPath string
+	maxSize     int64
+	// Time an unfinished upload is kept after the last bytes received, zero to keep it forever
+	expiration time.Duration
+	onComplete CompleteFunc
+
+	mu sync.Mutex
+	// Uploads with a PATCH or DELETE request in progress
+	locked map[string]bool
+}
+
+// New creates a handler for the uploads under the base path like /tus/.
+// The uploads that do not receive data during the expiration are removed, zero disables it.
+func New(basePath string, stagingPath string, maxSize int64, expiration time.Duration, onComplete CompleteFunc) (*Handler, error) {
+	err := os.MkdirAll(stagingPath, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("error creating tus staging directory %s. %w", stagingPath, err)
+	}
+	return &Handler{
+		basePath:    basePath,
+		stagingPath: stagingPath,
+		maxSize:     maxSize,
+		expiration:  expiration,
+		onComplete:  onComplete,
+		locked:      make(map[string]bool),
+	}, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.Method
+	// For clients that cannot send PATCH or DELETE requests
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" {
+		method = override
+	}
+
+	if method == http.MethodOptions {
+		w.Header().Set("Tus-Resumable", Version)
+		w.Header().Set("Tus-Version", Version)
+		w.Header().Set("Tus-Extension", Extensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.maxSize, 10))
+		w.Header().Set("Tus-Checksum-Algorithm", "md5,sha1,sha256")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", Version)
+	if r.Header.Get("Tus-Resumable") != Version {
+		w.Header().Set("Tus-Version", Version)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, h.basePath)
+	switch {
+	case id == "" && method == http.MethodPost:
+		h.create(w, r)
+	case id != "" && isValidID(id) && method == http.MethodHead:
+		h.head(w, id)
+	case id != "" && isValidID(id) && method == http.MethodPatch:
+		h.patch(w, r, id)
+	case id != "" && isValidID(id) && method == http.MethodDelete:
+		h.terminate(w, id)
+	case id != "" && !isValidID(id):
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) create(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length must be a positive number", http.StatusBadRequest)
+		return
+	}
+	if length > h.maxSize {
+		http.Error(w, "Upload-Length exceeds Tus-Max-Size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	metadata, err := parseMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 16)
+	// Ignore the error since it cannot fail. See source for more details
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+
+	err = os.WriteFile(h.dataPath(id), nil, 0600)
+	if err != nil {
+		log.Printf("error creating upload %s. %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	infoBytes, err := json.Marshal(info{Length: length, Metadata: metadata})
+	if err == nil {
+		err = os.WriteFile(h.infoPath(id), infoBytes, 0600)
+	}
+	if err != nil {
+		os.Remove(h.dataPath(id))
+		log.Printf("error writing info of upload %s. %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", path.Join(h.basePath, id))
+	h.setExpires(w, time.Now())
+	if length == 0 {
+		// Empty uploads are complete as soon as they are created
+		h.complete(w, r, id, info{Length: length, Metadata: metadata}, http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *Handler) head(w http.ResponseWriter, id string) {
+	uploadInfo, offset, err := h.read(id)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("error reading upload %s. %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(uploadInfo.Length, 10))
+	if len(uploadInfo.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", formatMetadata(uploadInfo.Metadata))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) patch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != offsetContentType {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	requestOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || requestOffset < 0 {
+		http.Error(w, "Upload-Offset must be a positive number", http.StatusBadRequest)
+		return
+	}
+	var checksum hash.Hash
+	var expectedChecksum []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		algorithm, value, _ := strings.Cut(header, " ")
+		newHash, ok := checksumAlgorithms[algorithm]
+		if !ok {
+			http.Error(w, "unsupported checksum algorithm "+algorithm, http.StatusBadRequest)
+			return
+		}
+		expectedChecksum, err = base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			http.Error(w, "Upload-Checksum must be base64 encoded", http.StatusBadRequest)
+			return
+		}
+		checksum = newHash()
+	}
+
+	if !h.lock(id) {
+		w.WriteHeader(http.StatusLocked)
+		return
+	}
+	defer h.unlock(id)
+
+	uploadInfo, offset, err := h.read(id)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("error reading upload %s. %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if requestOffset != offset {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(h.dataPath(id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("error opening upload %s. %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// Never accept more bytes than the length of the upload
+	var body io.Reader = io.LimitReader(r.Body, uploadInfo.Length-offset)
+	if checksum != nil {
+		body = io.TeeReader(body, checksum)
+	}
+	// The bytes received before a network error are kept so the client can resume from them,
+	// except when a checksum was sent because it can only be verified with the whole body
+	written, copyErr := io.Copy(f, body)
+	if checksum != nil && (copyErr != nil || !bytes.Equal(checksum.Sum(nil), expectedChecksum)) {
+		f.Truncate(offset)
+		f.Close()
+		if copyErr == nil {
+			w.WriteHeader(statusChecksumMismatch)
+		}
+		return
+	}
+	err = f.Close()
+	if err != nil {
+		log.Printf("error writing upload %s. %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if copyErr != nil {
+		log.Printf("upload %s interrupted at offset %d. %v", id, offset+written, copyErr)
+		return
+	}
+
+	offset += written
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if offset == uploadInfo.Length {
+		h.complete(w, r, id, uploadInfo, http.StatusNoContent)
+		return
+	}
+	h.setExpires(w, time.Now())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) terminate(w http.ResponseWriter, id string) {
+	if !h.lock(id) {
+		w.WriteHeader(http.StatusLocked)
+		return
+	}
+	defer h.unlock(id)
+
+	if _, err := os.Stat(h.infoPath(id)); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	h.remove(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// complete hands the file to the complete function and removes the upload whatever the result is,
+// since retrying the upload would not change it
+func (h *Handler) complete(w http.ResponseWriter, r *http.Request, id string, uploadInfo info, status int) {
+	defer h.remove(id)
+
+	location, err := h.onComplete(r, h.dataPath(id), uploadInfo.Metadata)
+	if errors.Is(err, ErrForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if location != "" {
+		w.Header().Set("Content-Location", location)
+	}
+	w.WriteHeader(status)
+}
+
+func (h *Handler) read(id string) (info, int64, error) {
+	b, err := os.ReadFile(h.infoPath(id))
+	if err != nil {
+		return info{}, 0, err
+	}
+	var uploadInfo info
+	err = json.Unmarshal(b, &uploadInfo)
+	if err != nil {
+		return info{}, 0, fmt.Errorf("error decoding info of upload %s. %w", id, err)
+	}
+	stat, err := os.Stat(h.dataPath(id))
+	if err != nil {
+		return info{}, 0, err
+	}
+	// The expired uploads not removed yet cannot be resumed
+	if h.expired(stat.ModTime()) {
+		return info{}, 0, os.ErrNotExist
+	}
+	return uploadInfo, stat.Size(), nil
+}
+
+// RemoveExpired removes the uploads that did not receive data during the expiration
+func (h *Handler) RemoveExpired() error {
+	if h.expiration == 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(h.stagingPath)
+	if err != nil {
+		return fmt.Errorf("error listing uploads in %s. %w", h.stagingPath, err)
+	}
+	for _, entry := range entries {
+		// Also the data files left without info file by a failed creation
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if !isValidID(id) {
+			continue
+		}
+		stat, err := entry.Info()
+		if err != nil || !h.expired(stat.ModTime()) {
+			continue
+		}
+		if dataStat, err := os.Stat(h.dataPath(id)); err == nil && !h.expired(dataStat.ModTime()) {
+			continue
+		}
+		if !h.lock(id) {
+			continue
+		}
+		h.remove(id)
+		h.unlock(id)
+		log.Printf("removed expired upload %s", id)
+	}
+	return nil
+}
+
+func (h *Handler) expired(lastWrite time.Time) bool {
+	return h.expiration > 0 && time.Since(lastWrite) > h.expiration
+}
+
+// setExpires sets the Upload-Expires header with the expiration of an upload that received data at the time
+func (h *Handler) setExpires(w http.ResponseWriter, lastWrite time.Time) {
+	if h.expiration > 0 {
+		w.Header().Set("Upload-Expires", lastWrite.Add(h.expiration).UTC().Format(http.TimeFormat))
+	}
+}
+
+func (h *Handler) remove(id string) {
+	os.Remove(h.dataPath(id))
+	os.Remove(h.infoPath(id))
+}
+
+func (h *Handler) lock(id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.locked[id] {
+		return false
+	}
+	h.locked[id] = true
+	return true
+}
+
+func (h *Handler) unlock(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.locked, id)
+}
+
+func (h *Handler) dataPath(id string) string {
+	return path.Join(h.stagingPath, id)
+}
+
+func (h *Handler) infoPath(id string) string {
+	return path.Join(h.stagingPath, id+".json")
+}
+
+// Ids are generated by the server so anything else cannot be an upload
+func isValidID(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == 16
+}
+
+// parseMetadata decodes the Upload-Metadata header, a comma separated list of keys and base64 encoded values
+func parseMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for pair := range strings.SplitSeq(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("Upload-Metadata keys must not be empty")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("Upload-Metadata value of %s must be base64 encoded", key)
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, nil
+}
+
+func formatMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,163 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"davidc.es/jag/jsonfile"
+)
+
+const accessFileName string = "access.json"
+
+var ErrInvalidFolder = errors.New("invalid folder")
+
+// Rule restricts a folder of the library and all its subfolders to the users and the groups of the rule.
+// Folders without rules are visible to everyone.
+type Rule struct {
+	Folder string   `json:"folder"`
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// Access decides which folders of the library a user can see
+type Access struct {
+	user  User
+	rules []Rule
+}
+
+// CanAccess returns whether the user can see the item or folder with the path relative to the library.
+// Every restricted folder of the path must grant the user access, the admins can see everything.
+func (a Access) CanAccess(itemPath string) bool {
+	// The zero access of the requests without user cannot see anything
+	if a.user.Username == "" {
+		return false
+	}
+	if a.user.IsAdmin() {
+		return true
+	}
+	itemPath = path.Clean(strings.Trim(itemPath, "/"))
+	for _, rule := range a.rules {
+		if itemPath != rule.Folder && !strings.HasPrefix(itemPath, rule.Folder+"/") {
+			continue
+		}
+		if !a.granted(rule) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a Access) granted(rule Rule) bool {
+	if slices.ContainsFunc(rule.Users, func(username string) bool { return strings.EqualFold(username, a.user.Username) }) {
+		return true
+	}
+	return slices.ContainsFunc(rule.Groups, func(group string) bool { return slices.Contains(a.user.Groups, group) })
+}
+
+func (s *fileStore) Access(user User) Access {
+	s.reload()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return Access{user: user, rules: s.rules}
+}
+
+func (s *fileStore) Rules() []Rule {
+	s.reload()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.rules)
+}
+
+func (s *fileStore) SetRule(rule Rule) error {
+	folder := path.Clean(strings.Trim(rule.Folder, "/"))
+	if !filepath.IsLocal(folder) || folder == "." {
+		return ErrInvalidFolder
+	}
+	rule.Folder = folder
+	rule.Users = cleanNames(rule.Users)
+	rule.Groups = cleanNames(rule.Groups)
+
+	return s.updateRules(func(rules []Rule) []Rule {
+		rules = slices.DeleteFunc(rules, func(r Rule) bool { return r.Folder == folder })
+		rules = append(rules, rule)
+		slices.SortFunc(rules, func(a, b Rule) int { return strings.Compare(a.Folder, b.Folder) })
+		return rules
+	})
+}
+
+func (s *fileStore) DeleteRule(folder string) error {
+	return s.updateRules(func(rules []Rule) []Rule {
+		return slices.DeleteFunc(rules, func(r Rule) bool { return r.Folder == folder })
+	})
+}
+
+func (s *fileStore) SetGroups(username string, groups []string) error {
+	return s.update(username, false, func(user *User) { user.Groups = cleanNames(groups) })
+}
+
+func (s *fileStore) updateRules(update func(rules []Rule) []Rule) error {
+	// Do not overwrite the changes of other servers, which wait for the lock to write theirs
+	unlock, err := jsonfile.Lock(s.accessPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rules, modTime, err := readRules(s.accessPath)
+	if err != nil {
+		return err
+	}
+	s.rules, s.rulesModTime = rules, modTime
+
+	rules = update(slices.Clone(s.rules))
+	err = jsonfile.Write(s.accessPath, rules)
+	if err != nil {
+		return err
+	}
+	s.rules = rules
+	if info, err := os.Stat(s.accessPath); err == nil {
+		s.rulesModTime = info.ModTime()
+	}
+	return nil
+}
+
+// readRules returns the rules of the access file and the modification time of the file
+func readRules(filePath string) ([]Rule, time.Time, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, time.Time{}, nil
+		}
+		return nil, time.Time{}, fmt.Errorf("error reading %s. %w", filePath, err)
+	}
+	b, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("error reading %s. %w", filePath, err)
+	}
+	var rules []Rule
+	err = json.Unmarshal(b, &rules)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("error decoding %s. %w", filePath, err)
+	}
+	return rules, info.ModTime(), nil
+}
+
+// cleanNames trims the names removing the empty and repeated ones
+func cleanNames(names []string) []string {
+	var cleaned []string
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name != "" && !slices.Contains(cleaned, name) {
+			cleaned = append(cleaned, name)
+		}
+	}
+	return cleaned
+}
@@ -0,0 +1,45 @@
+package users
+
+func (s *fileStore) OIDCUser(subject string, username string, role Role) (User, error) {
+	linked := s.oidcUsername(subject)
+	if linked == "" {
+		if !usernameRegex.MatchString(username) {
+			return User{}, ErrInvalidUsername
+		}
+		if _, err := s.User(username); err == nil {
+			return User{}, ErrAlreadyExists
+		}
+		linked = username
+	}
+
+	conflict := false
+	err := s.update(linked, true, func(user *User) {
+		// Another server could have created a user with the username since it was checked
+		if user.OIDCSubject != subject && user.Role != "" {
+			conflict = true
+			return
+		}
+		user.OIDCSubject = subject
+		// The groups of the identity provider decide the role, so it changes with them
+		user.Role = role
+	})
+	if err != nil {
+		return User{}, err
+	}
+	if conflict {
+		return User{}, ErrAlreadyExists
+	}
+	return s.User(linked)
+}
+
+func (s *fileStore) oidcUsername(subject string) string {
+	s.reload()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, user := range s.users {
+		if user.OIDCSubject == subject {
+			return user.Username
+		}
+	}
+	return ""
+}
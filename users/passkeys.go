@@ -0,0 +1,99 @@
+package users
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrPasskeyExists = errors.New("passkey already registered")
+
+// Passkey is a WebAuthn credential the user logs in with instead of the password
+type Passkey struct {
+	// Base64url encoded credential ID
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	PublicKey    []byte    `json:"publicKey"`
+	SignCount    uint32    `json:"signCount"`
+	CreationTime time.Time `json:"creationTime"`
+	LastUsed     time.Time `json:"lastUsed,omitzero"`
+}
+
+func (s *fileStore) WebAuthnID(username string) (string, error) {
+	user, err := s.User(username)
+	if err != nil {
+		return "", err
+	}
+	if user.WebAuthnID != "" {
+		return user.WebAuthnID, nil
+	}
+	b := make([]byte, 32)
+	rand.Read(b)
+	id := base64.RawURLEncoding.EncodeToString(b)
+	err = s.update(username, false, func(user *User) {
+		// Another server could have created it at the same time
+		if user.WebAuthnID == "" {
+			user.WebAuthnID = id
+		}
+		id = user.WebAuthnID
+	})
+	return id, err
+}
+
+func (s *fileStore) AddPasskey(username string, passkey Passkey) error {
+	if _, _, err := s.PasskeyUser(passkey.ID); err == nil {
+		return ErrPasskeyExists
+	}
+	passkey.Name = strings.TrimSpace(passkey.Name)
+	passkey.CreationTime = time.Now().UTC()
+	return s.update(username, false, func(user *User) {
+		if passkey.Name == "" {
+			passkey.Name = "Passkey " + strconv.Itoa(len(user.Passkeys)+1)
+		}
+		user.Passkeys = append(slices.Clone(user.Passkeys), passkey)
+	})
+}
+
+func (s *fileStore) RemovePasskey(username string, id string) error {
+	user, err := s.User(username)
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(user.Passkeys, func(passkey Passkey) bool { return passkey.ID == id }) {
+		return ErrNotFound
+	}
+	return s.update(username, false, func(user *User) {
+		user.Passkeys = slices.DeleteFunc(slices.Clone(user.Passkeys), func(passkey Passkey) bool { return passkey.ID == id })
+	})
+}
+
+func (s *fileStore) PasskeyUser(id string) (User, Passkey, error) {
+	s.reload()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, user := range s.users {
+		for _, passkey := range user.Passkeys {
+			if passkey.ID == id {
+				return user, passkey, nil
+			}
+		}
+	}
+	return User{}, Passkey{}, ErrNotFound
+}
+
+func (s *fileStore) UsePasskey(username string, id string, signCount uint32) error {
+	return s.update(username, false, func(user *User) {
+		passkeys := slices.Clone(user.Passkeys)
+		for i, passkey := range passkeys {
+			if passkey.ID == id {
+				passkeys[i].SignCount = signCount
+				passkeys[i].LastUsed = time.Now().UTC()
+			}
+		}
+		user.Passkeys = passkeys
+	})
+}
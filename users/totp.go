@@ -0,0 +1,206 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// RFC 6238 parameters supported by every authenticator app
+const (
+	totpPeriod int64 = 30
+	totpDigits int   = 6
+	// Codes of the previous and next periods are accepted too since the clocks are never perfectly in sync
+	totpSkew int64 = 1
+)
+
+const recoveryCodesCount int = 10
+
+// Wrong codes in a row before the second factor is locked and the time it stays locked
+const (
+	maxSecondFactorFailures int           = 5
+	secondFactorLockTime    time.Duration = 5 * time.Minute
+)
+
+var (
+	ErrInvalidCode        = errors.New("invalid code")
+	ErrTooManyAttempts    = errors.New("too many wrong codes, try again in a few minutes")
+	ErrTOTPNotSetUp       = errors.New("two-factor authentication is not being set up")
+	ErrTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// HasTOTP returns whether the user logs in with a TOTP code after the password
+func (u User) HasTOTP() bool {
+	return u.TOTPSecret != ""
+}
+
+// RecoveryCodesLeft returns the recovery codes that were not used yet
+func (u User) RecoveryCodesLeft() int {
+	return len(u.RecoveryCodeHashes)
+}
+
+func (s *fileStore) SetupTOTP(username string) (string, error) {
+	user, err := s.User(username)
+	if err != nil {
+		return "", err
+	}
+	if user.HasTOTP() {
+		return "", ErrTOTPAlreadyEnabled
+	}
+	b := make([]byte, 20)
+	rand.Read(b)
+	secret := totpEncoding.EncodeToString(b)
+	err = s.update(username, false, func(user *User) { user.PendingTOTPSecret = secret })
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func (s *fileStore) EnableTOTP(username string, code string) ([]string, error) {
+	codes, hashes := newRecoveryCodes()
+	var result error
+	err := s.update(username, false, func(user *User) {
+		if user.HasTOTP() {
+			result = ErrTOTPAlreadyEnabled
+			return
+		}
+		if user.PendingTOTPSecret == "" {
+			result = ErrTOTPNotSetUp
+			return
+		}
+		step, ok := validTOTP(user.PendingTOTPSecret, code, time.Now())
+		if !ok {
+			result = ErrInvalidCode
+			return
+		}
+		user.TOTPSecret = user.PendingTOTPSecret
+		user.PendingTOTPSecret = ""
+		user.TOTPLastStep = step
+		user.RecoveryCodeHashes = hashes
+		user.SecondFactorFailures = 0
+		user.SecondFactorLockedUntil = time.Time{}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result != nil {
+		return nil, result
+	}
+	return codes, nil
+}
+
+func (s *fileStore) DisableTOTP(username string) error {
+	return s.update(username, false, func(user *User) { clearTOTP(user) })
+}
+
+func (s *fileStore) VerifySecondFactor(username string, code string) error {
+	var result error
+	// The attempt is always written so the failures and used codes are shared with the other servers
+	err := s.update(username, false, func(user *User) {
+		now := time.Now()
+		if now.Before(user.SecondFactorLockedUntil) {
+			result = ErrTooManyAttempts
+			return
+		}
+		if !user.HasTOTP() {
+			result = ErrInvalidCode
+			return
+		}
+		if step, ok := validTOTP(user.TOTPSecret, code, now); ok && step > user.TOTPLastStep {
+			user.TOTPLastStep = step
+			user.SecondFactorFailures = 0
+			return
+		}
+		if i := slices.Index(user.RecoveryCodeHashes, hashToken(normalizeRecoveryCode(code))); i >= 0 {
+			user.RecoveryCodeHashes = slices.Delete(slices.Clone(user.RecoveryCodeHashes), i, i+1)
+			user.SecondFactorFailures = 0
+			return
+		}
+		user.SecondFactorFailures++
+		result = ErrInvalidCode
+		if user.SecondFactorFailures >= maxSecondFactorFailures {
+			user.SecondFactorFailures = 0
+			user.SecondFactorLockedUntil = now.Add(secondFactorLockTime).UTC()
+			result = ErrTooManyAttempts
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// TOTPURI returns the otpauth URI of the secret that the authenticator apps read from the QR code
+func TOTPURI(issuer string, username string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	return fmt.Sprintf("otpauth://totp/%s?%s", url.PathEscape(issuer+":"+username), query.Encode())
+}
+
+func clearTOTP(user *User) {
+	user.TOTPSecret = ""
+	user.PendingTOTPSecret = ""
+	user.TOTPLastStep = 0
+	user.RecoveryCodeHashes = nil
+	user.SecondFactorFailures = 0
+	user.SecondFactorLockedUntil = time.Time{}
+}
+
+// validTOTP returns the time step of the code when it is valid for the secret at the time
+func validTOTP(secret string, code string, t time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+	current := t.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode implements the HOTP algorithm of RFC 4226 with the time step as the counter
+func totpCode(key []byte, step int64) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// newRecoveryCodes returns the recovery codes to show to the user once and their hashes to store
+func newRecoveryCodes() ([]string, []string) {
+	var codes, hashes []string
+	for range recoveryCodesCount {
+		b := make([]byte, 5)
+		rand.Read(b)
+		code := hex.EncodeToString(b)
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -0,0 +1,179 @@
+package users
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Secret of the test vectors of RFC 4226 and RFC 6238
+var rfcSecret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+// RFC 4226 Appendix D
+func TestTOTPCodeHOTPVectors(t *testing.T) {
+	codes := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range codes {
+		if got := totpCode([]byte("12345678901234567890"), int64(counter)); got != code {
+			t.Errorf("counter %d: got %s, want %s", counter, got, code)
+		}
+	}
+}
+
+// RFC 6238 Appendix B with SHA-1, the codes of 6 digits are the last 6 digits of the codes of 8 digits
+func TestValidTOTPVectors(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, test := range tests {
+		step, ok := validTOTP(rfcSecret, test.code[2:], time.Unix(test.unix, 0))
+		if !ok {
+			t.Errorf("%d: code %s not valid", test.unix, test.code[2:])
+			continue
+		}
+		if step != test.unix/totpPeriod {
+			t.Errorf("%d: got step %d, want %d", test.unix, step, test.unix/totpPeriod)
+		}
+	}
+}
+
+func TestValidTOTPSkew(t *testing.T) {
+	key, _ := totpEncoding.DecodeString(rfcSecret)
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+	tests := []struct {
+		name  string
+		code  string
+		valid bool
+	}{
+		{"current", totpCode(key, current), true},
+		{"previous", totpCode(key, current-1), true},
+		{"next", totpCode(key, current+1), true},
+		{"two before", totpCode(key, current-2), false},
+		{"two after", totpCode(key, current+2), false},
+		{"with spaces", " " + totpCode(key, current)[:3] + " " + totpCode(key, current)[3:] + " ", true},
+		{"too short", totpCode(key, current)[:5], false},
+		{"empty", "", false},
+	}
+	for _, test := range tests {
+		if _, ok := validTOTP(rfcSecret, test.code, now); ok != test.valid {
+			t.Errorf("%s: got %t, want %t", test.name, ok, test.valid)
+		}
+	}
+}
+
+// newTOTPUser returns a store with a user with two-factor authentication enabled and its recovery codes
+func newTOTPUser(t *testing.T) (*fileStore, []byte, []string) {
+	t.Helper()
+	store, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.(*fileStore)
+	err = s.Bootstrap("admin", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := s.SetupTOTP("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	_, err = s.EnableTOTP("admin", "000000")
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("enabled with a wrong code: %v", err)
+	}
+	recoveryCodes, err := s.EnableTOTP("admin", totpCode(key, time.Now().Unix()/totpPeriod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, key, recoveryCodes
+}
+
+func TestVerifySecondFactorReplay(t *testing.T) {
+	s, key, _ := newTOTPUser(t)
+
+	// The code used to enable it cannot be used again
+	err := s.VerifySecondFactor("admin", totpCode(key, time.Now().Unix()/totpPeriod-1))
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("code of a previous step: got %v, want %v", err, ErrInvalidCode)
+	}
+	code := totpCode(key, time.Now().Unix()/totpPeriod+1)
+	err = s.VerifySecondFactor("admin", code)
+	if err != nil {
+		t.Fatalf("code of the next step: %v", err)
+	}
+	err = s.VerifySecondFactor("admin", code)
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("replayed code: got %v, want %v", err, ErrInvalidCode)
+	}
+}
+
+func TestVerifySecondFactorLockout(t *testing.T) {
+	s, key, recoveryCodes := newTOTPUser(t)
+
+	for i := 1; i < maxSecondFactorFailures; i++ {
+		err := s.VerifySecondFactor("admin", "wrong")
+		if !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("failure %d: got %v, want %v", i, err, ErrInvalidCode)
+		}
+	}
+	err := s.VerifySecondFactor("admin", "wrong")
+	if !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("failure %d: got %v, want %v", maxSecondFactorFailures, err, ErrTooManyAttempts)
+	}
+	// Not even the valid codes are accepted while it is locked
+	err = s.VerifySecondFactor("admin", totpCode(key, time.Now().Unix()/totpPeriod+1))
+	if !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("valid code while locked: got %v, want %v", err, ErrTooManyAttempts)
+	}
+	err = s.VerifySecondFactor("admin", recoveryCodes[0])
+	if !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("recovery code while locked: got %v, want %v", err, ErrTooManyAttempts)
+	}
+
+	err = s.update("admin", false, func(user *User) { user.SecondFactorLockedUntil = time.Now().Add(-time.Second) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.VerifySecondFactor("admin", totpCode(key, time.Now().Unix()/totpPeriod+1))
+	if err != nil {
+		t.Errorf("valid code after the lock: %v", err)
+	}
+}
+
+func TestVerifySecondFactorRecoveryCodes(t *testing.T) {
+	s, _, recoveryCodes := newTOTPUser(t)
+	if len(recoveryCodes) != recoveryCodesCount {
+		t.Fatalf("got %d recovery codes, want %d", len(recoveryCodes), recoveryCodesCount)
+	}
+
+	err := s.VerifySecondFactor("admin", recoveryCodes[0])
+	if err != nil {
+		t.Fatalf("recovery code: %v", err)
+	}
+	err = s.VerifySecondFactor("admin", recoveryCodes[0])
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("used recovery code: got %v, want %v", err, ErrInvalidCode)
+	}
+	// The codes can be typed without the hyphen and in uppercase
+	err = s.VerifySecondFactor("admin", strings.ToUpper(strings.ReplaceAll(recoveryCodes[1], "-", "")))
+	if err != nil {
+		t.Errorf("recovery code without hyphen: %v", err)
+	}
+	user, err := s.User("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.RecoveryCodesLeft() != recoveryCodesCount-2 {
+		t.Errorf("got %d recovery codes left, want %d", user.RecoveryCodesLeft(), recoveryCodesCount-2)
+	}
+}
@@ -0,0 +1,447 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"davidc.es/jag/jsonfile"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const usersFileName string = "users.json"
+
+// Time the link to set the password of an invited or reset user is valid for
+const invitationTTL time.Duration = 7 * 24 * time.Hour
+
+// Minimum length of the passwords set by the users
+const MinPasswordLength int = 8
+
+// Time between the checks of the users file for changes made by other servers sharing the data path
+const reloadInterval time.Duration = 2 * time.Second
+
+var (
+	ErrNotFound           = errors.New("user not found")
+	ErrAlreadyExists      = errors.New("user already exists")
+	ErrInvalidUsername    = errors.New("usernames can only contain letters, numbers, dots, dashes and underscores")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrInvalidInvitation  = errors.New("invalid or expired invitation")
+	ErrShortPassword      = fmt.Errorf("passwords must have at least %d characters", MinPasswordLength)
+)
+
+var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// Compared when the user does not exist so the response time does not reveal which usernames exist
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("jag"), bcrypt.DefaultCost)
+
+type Role string
+
+const (
+	// Viewers can browse, search and download the library
+	RoleViewer Role = "viewer"
+	// Contributors can also upload and organize the items of the library
+	RoleContributor Role = "contributor"
+	// Admins can also manage the users and purge the trash
+	RoleAdmin Role = "admin"
+)
+
+var roles = []Role{RoleViewer, RoleContributor, RoleAdmin}
+
+func ParseRole(s string) (Role, error) {
+	role := Role(s)
+	if !slices.Contains(roles, role) {
+		return "", fmt.Errorf("invalid role %s", s)
+	}
+	return role, nil
+}
+
+// Allows returns whether the role has at least the permissions of the required role
+func (r Role) Allows(required Role) bool {
+	return slices.Index(roles, r) >= slices.Index(roles, required)
+}
+
+type User struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"passwordHash,omitempty"`
+	Role         Role      `json:"role"`
+	Disabled     bool      `json:"disabled,omitempty"`
+	CreationTime time.Time `json:"creationTime"`
+	// Groups the user belongs to in the access rules of the folders
+	Groups []string `json:"groups,omitempty"`
+	// SHA-256 of the token of the link to set the password, empty when there is no pending invitation
+	InvitationHash       string    `json:"invitationHash,omitempty"`
+	InvitationExpiration time.Time `json:"invitationExpiration,omitzero"`
+	// Incremented to revoke the stateless sessions of the user
+	SessionGeneration int `json:"sessionGeneration,omitempty"`
+	// Base32 secret of the TOTP two-factor authentication, empty when it is not enabled
+	TOTPSecret string `json:"totpSecret,omitempty"`
+	// Secret being set up until a code generated with it is verified
+	PendingTOTPSecret string `json:"pendingTotpSecret,omitempty"`
+	// Time step of the last code used so the codes cannot be used twice
+	TOTPLastStep int64 `json:"totpLastStep,omitempty"`
+	// SHA-256 of the recovery codes that were not used yet
+	RecoveryCodeHashes []string `json:"recoveryCodeHashes,omitempty"`
+	// Wrong codes in a row and time until the second factor is locked after too many of them
+	SecondFactorFailures    int       `json:"secondFactorFailures,omitempty"`
+	SecondFactorLockedUntil time.Time `json:"secondFactorLockedUntil,omitzero"`
+	// Random user handle of the passkeys, created when the first one is registered
+	WebAuthnID string    `json:"webAuthnId,omitempty"`
+	Passkeys   []Passkey `json:"passkeys,omitempty"`
+	// Issuer and subject of the account of the identity provider the user logs in with, empty for the local users
+	OIDCSubject string `json:"oidcSubject,omitempty"`
+}
+
+func (u User) IsContributor() bool {
+	return u.Role.Allows(RoleContributor)
+}
+
+func (u User) IsAdmin() bool {
+	return u.Role.Allows(RoleAdmin)
+}
+
+// PendingInvitation returns whether the user has not set the password of the last invitation or reset
+func (u User) PendingInvitation() bool {
+	return u.InvitationHash != ""
+}
+
+// Store keeps the user accounts of the gallery.
+type Store interface {
+	User(username string) (User, error)
+	// Users returns all the users sorted by username
+	Users() []User
+	// Authenticate returns the enabled user with the username and password
+	Authenticate(username string, password string) (User, error)
+	// Bootstrap makes sure the admin with the password hash exists and is enabled so the access can always be recovered
+	Bootstrap(username string, passwordHash string) error
+	// Invite creates a user without password and returns the token of the link to set it
+	Invite(username string, role Role) (string, error)
+	// Reset removes the password, the two-factor authentication and the passkeys of the user and returns the token of the link to set a new one
+	Reset(username string) (string, error)
+	// AcceptInvitation sets the password of the user of the invitation token
+	AcceptInvitation(token string, password string) (User, error)
+	// Invitation returns the user of a valid invitation token
+	Invitation(token string) (User, error)
+	SetRole(username string, role Role) error
+	SetDisabled(username string, disabled bool) error
+	SetGroups(username string, groups []string) error
+	// SetupTOTP generates a new TOTP secret for the user that is enabled once a code of it is verified with EnableTOTP
+	SetupTOTP(username string) (string, error)
+	// EnableTOTP enables the secret being set up when the code is valid and returns the new recovery codes
+	EnableTOTP(username string, code string) ([]string, error)
+	DisableTOTP(username string) error
+	// VerifySecondFactor checks a TOTP code or a recovery code of the user, which cannot be used again.
+	// ErrTooManyAttempts is returned for a while after too many wrong codes.
+	VerifySecondFactor(username string, code string) error
+	// WebAuthnID returns the user handle of the passkeys of the user, creating it the first time
+	WebAuthnID(username string) (string, error)
+	// AddPasskey registers a passkey of the user, ErrPasskeyExists is returned when its ID is already registered
+	AddPasskey(username string, passkey Passkey) error
+	RemovePasskey(username string, id string) error
+	// PasskeyUser returns the user of the passkey of the ID
+	PasskeyUser(id string) (User, Passkey, error)
+	// UsePasskey stores the signature counter and the time of the last login with the passkey
+	UsePasskey(username string, id string, signCount uint32) error
+	// OIDCUser returns the user linked to the subject of the identity provider with the role of its groups,
+	// creating it with the username the first time. ErrAlreadyExists is returned when a local user has the username.
+	OIDCUser(subject string, username string, role Role) (User, error)
+	// RevokeSessions increments the session generation of the user so the sessions issued before are no longer valid
+	RevokeSessions(username string) error
+	// Access returns the folders the user can see with the current rules
+	Access(user User) Access
+	// Rules returns the access rules sorted by folder
+	Rules() []Rule
+	// SetRule creates or replaces the rule of the folder
+	SetRule(rule Rule) error
+	DeleteRule(folder string) error
+}
+
+type fileStore struct {
+	mu       sync.RWMutex
+	filePath string
+	users    map[string]User
+	// Modification time of the users file when it was last read or written and time of the last check
+	modTime    time.Time
+	checked    time.Time
+	accessPath string
+	rules      []Rule
+	// Modification time of the access file when it was last read or written
+	rulesModTime time.Time
+}
+
+// New loads the users stored in the data path, creating the data path if it does not exist.
+func New(dataPath string) (Store, error) {
+	err := os.MkdirAll(dataPath, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("error creating data directory %s. %w", dataPath, err)
+	}
+
+	s := &fileStore{
+		filePath:   path.Join(dataPath, usersFileName),
+		accessPath: path.Join(dataPath, accessFileName),
+		checked:    time.Now(),
+	}
+	s.users, s.modTime, err = readUsers(s.filePath)
+	if err != nil {
+		return nil, err
+	}
+	s.rules, s.rulesModTime, err = readRules(s.accessPath)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileStore) User(username string) (User, error) {
+	s.reload()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[strings.ToLower(username)]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (s *fileStore) Users() []User {
+	s.reload()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	slices.SortFunc(users, func(a, b User) int { return strings.Compare(a.Username, b.Username) })
+	return users
+}
+
+func (s *fileStore) Authenticate(username string, password string) (User, error) {
+	user, err := s.User(username)
+	if err != nil || user.PasswordHash == "" {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return User{}, ErrInvalidCredentials
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	if err != nil || user.Disabled {
+		return User{}, ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+func (s *fileStore) Bootstrap(username string, passwordHash string) error {
+	if !usernameRegex.MatchString(username) {
+		return ErrInvalidUsername
+	}
+	return s.update(username, true, func(user *User) {
+		user.PasswordHash = passwordHash
+		user.Role = RoleAdmin
+		user.Disabled = false
+		user.InvitationHash = ""
+		user.InvitationExpiration = time.Time{}
+	})
+}
+
+func (s *fileStore) Invite(username string, role Role) (string, error) {
+	if !usernameRegex.MatchString(username) {
+		return "", ErrInvalidUsername
+	}
+	if _, err := s.User(username); err == nil {
+		return "", ErrAlreadyExists
+	}
+	token, hash := newInvitation()
+	err := s.update(username, true, func(user *User) {
+		user.Role = role
+		user.InvitationHash = hash
+		user.InvitationExpiration = time.Now().UTC().Add(invitationTTL)
+	})
+	return token, err
+}
+
+func (s *fileStore) Reset(username string) (string, error) {
+	token, hash := newInvitation()
+	err := s.update(username, false, func(user *User) {
+		user.PasswordHash = ""
+		// The users that lost the device of the second factor and the recovery codes are reset too,
+		// and the passkeys are removed in case the account was taken over
+		clearTOTP(user)
+		user.Passkeys = nil
+		user.InvitationHash = hash
+		user.InvitationExpiration = time.Now().UTC().Add(invitationTTL)
+	})
+	return token, err
+}
+
+func (s *fileStore) Invitation(token string) (User, error) {
+	hash := hashToken(token)
+	s.reload()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, user := range s.users {
+		if user.InvitationHash == hash && time.Now().Before(user.InvitationExpiration) && !user.Disabled {
+			return user, nil
+		}
+	}
+	return User{}, ErrInvalidInvitation
+}
+
+func (s *fileStore) AcceptInvitation(token string, password string) (User, error) {
+	if len(password) < MinPasswordLength {
+		return User{}, ErrShortPassword
+	}
+	user, err := s.Invitation(token)
+	if err != nil {
+		return User{}, err
+	}
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, fmt.Errorf("error hashing password. %w", err)
+	}
+	err = s.update(user.Username, false, func(user *User) {
+		user.PasswordHash = string(passwordHash)
+		user.InvitationHash = ""
+		user.InvitationExpiration = time.Time{}
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return s.User(user.Username)
+}
+
+func (s *fileStore) SetRole(username string, role Role) error {
+	return s.update(username, false, func(user *User) { user.Role = role })
+}
+
+func (s *fileStore) SetDisabled(username string, disabled bool) error {
+	return s.update(username, false, func(user *User) { user.Disabled = disabled })
+}
+
+func (s *fileStore) RevokeSessions(username string) error {
+	return s.update(username, false, func(user *User) { user.SessionGeneration++ })
+}
+
+// update modifies the user and writes all the users to disk. The user is created when it does not exist if create is true.
+func (s *fileStore) update(username string, create bool, update func(user *User)) error {
+	// Do not overwrite the changes of other servers, which wait for the lock to write theirs
+	unlock, err := jsonfile.Lock(s.filePath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users, modTime, err := readUsers(s.filePath)
+	if err != nil {
+		return err
+	}
+	s.users, s.modTime = users, modTime
+
+	key := strings.ToLower(username)
+	previous, existed := s.users[key]
+	if !existed && !create {
+		return ErrNotFound
+	}
+	user := previous
+	if !existed {
+		user = User{Username: username, CreationTime: time.Now().UTC()}
+	}
+	update(&user)
+	s.users[key] = user
+
+	err = s.write()
+	if err != nil {
+		// Keep the memory consistent with the disk
+		if existed {
+			s.users[key] = previous
+		} else {
+			delete(s.users, key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) write() error {
+	err := jsonfile.Write(s.filePath, s.users)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.filePath); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// reload reads the users and the access files again when they were changed by another server sharing the data path,
+// checking them at most every reload interval
+func (s *fileStore) reload() {
+	s.mu.RLock()
+	recent := time.Since(s.checked) < reloadInterval
+	s.mu.RUnlock()
+	if recent {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checked = time.Now()
+	if info, err := os.Stat(s.filePath); err == nil && !info.ModTime().Equal(s.modTime) {
+		users, modTime, err := readUsers(s.filePath)
+		if err != nil {
+			log.Printf("could not reload the users. %v", err)
+		} else {
+			s.users, s.modTime = users, modTime
+		}
+	}
+	if info, err := os.Stat(s.accessPath); err == nil && !info.ModTime().Equal(s.rulesModTime) {
+		rules, modTime, err := readRules(s.accessPath)
+		if err != nil {
+			log.Printf("could not reload the access rules. %v", err)
+		} else {
+			s.rules, s.rulesModTime = rules, modTime
+		}
+	}
+}
+
+// readUsers returns the users of the file by their lowercase username and the modification time of the file
+func readUsers(filePath string) (map[string]User, time.Time, error) {
+	users := make(map[string]User)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return users, time.Time{}, nil
+		}
+		return nil, time.Time{}, fmt.Errorf("error reading %s. %w", filePath, err)
+	}
+	b, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("error reading %s. %w", filePath, err)
+	}
+	err = json.Unmarshal(b, &users)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("error decoding %s. %w", filePath, err)
+	}
+	return users, info.ModTime(), nil
+}
+
+// newInvitation returns a random token and the hash stored in the user so the file does not contain valid tokens
+func newInvitation() (string, string) {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	return token, hashToken(token)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
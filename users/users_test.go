@@ -0,0 +1,59 @@
+package users
+
+import (
+	"sync"
+	"testing"
+)
+
+// The servers sharing the data path must not overwrite the changes of each other, even right after reading the file
+func TestUpdateSharedDataPath(t *testing.T) {
+	dataPath := t.TempDir()
+	first, err := New(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = first.Bootstrap("admin", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := New(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for _, store := range []Store{first, second} {
+		wg.Go(func() {
+			for range 20 {
+				err := store.RevokeSessions("admin")
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	err = first.SetRule(Rule{Folder: "Private", Users: []string{"admin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = second.SetRule(Rule{Folder: "Family", Groups: []string{"family"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reread, err := New(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := reread.User("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.SessionGeneration != 40 {
+		t.Errorf("got session generation %d, want 40", user.SessionGeneration)
+	}
+	if rules := reread.Rules(); len(rules) != 2 {
+		t.Errorf("got rules %v, want 2 rules", rules)
+	}
+}
@@ -0,0 +1,121 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Nesting of the CBOR values decoded at most, the authenticators do not send deeper values
+const maxCBORDepth int = 8
+
+var errTruncatedCBOR = errors.New("truncated CBOR value")
+
+// decodeCBOR decodes the subset of CBOR used by the authenticators returning the value and the bytes after it.
+// Unsigned and negative integers are returned as int64, byte strings as []byte, text strings as string,
+// arrays as []any and maps as map[any]any. Indefinite lengths and floats are not supported.
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeCBORValue(data, 0)
+}
+
+func decodeCBORValue(data []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, errors.New("CBOR value nested too deep")
+	}
+	if len(data) == 0 {
+		return nil, nil, errTruncatedCBOR
+	}
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		}
+		return nil, nil, fmt.Errorf("unsupported CBOR simple value %d", info)
+	}
+
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info == 24 && len(data) >= 1:
+		n, data = uint64(data[0]), data[1:]
+	case info == 25 && len(data) >= 2:
+		n, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case info == 26 && len(data) >= 4:
+		n, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case info == 27 && len(data) >= 8:
+		n, data = binary.BigEndian.Uint64(data), data[8:]
+	case info < 28:
+		return nil, nil, errTruncatedCBOR
+	default:
+		return nil, nil, fmt.Errorf("unsupported CBOR additional information %d", info)
+	}
+
+	switch major {
+	case 0, 1:
+		if n > 1<<63-1 {
+			return nil, nil, errors.New("CBOR integer too big")
+		}
+		if major == 1 {
+			return -1 - int64(n), data, nil
+		}
+		return int64(n), data, nil
+	case 2, 3:
+		if n > uint64(len(data)) {
+			return nil, nil, errTruncatedCBOR
+		}
+		if major == 3 {
+			return string(data[:n]), data[n:], nil
+		}
+		return data[:n], data[n:], nil
+	case 4:
+		// Every item takes at least one byte
+		if n > uint64(len(data)) {
+			return nil, nil, errTruncatedCBOR
+		}
+		items := make([]any, 0, n)
+		for range n {
+			var item any
+			var err error
+			item, data, err = decodeCBORValue(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case 5:
+		if n > uint64(len(data))/2 {
+			return nil, nil, errTruncatedCBOR
+		}
+		m := make(map[any]any, n)
+		for range n {
+			var key, value any
+			var err error
+			key, data, err = decodeCBORValue(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("unsupported CBOR map key")
+			}
+			value, data, err = decodeCBORValue(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, data, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported CBOR major type %d", major)
+}
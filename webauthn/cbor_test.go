@@ -0,0 +1,134 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand/v2"
+	"reflect"
+	"testing"
+)
+
+// Examples of RFC 8949 Appendix A in the subset used by the authenticators
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		data  string
+		value any
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"190100", int64(256)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3863", int64(-100)},
+		{"390100", int64(-257)},
+		{"40", []byte{}},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6449455446", "IETF"},
+		{"80", []any{}},
+		{"83010203", []any{int64(1), int64(2), int64(3)}},
+		{"8301820203820405", []any{int64(1), []any{int64(2), int64(3)}, []any{int64(4), int64(5)}}},
+		{"a0", map[any]any{}},
+		{"a201020304", map[any]any{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[any]any{"a": int64(1), "b": []any{int64(2), int64(3)}}},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+	}
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.data)
+		value, rest, err := decodeCBOR(append(data, 0xff))
+		if err != nil {
+			t.Errorf("%s: %v", test.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(value, test.value) {
+			t.Errorf("%s: got %#v, want %#v", test.data, value, test.value)
+		}
+		if !bytes.Equal(rest, []byte{0xff}) {
+			t.Errorf("%s: got rest %x, want ff", test.data, rest)
+		}
+	}
+}
+
+func TestDecodeCBORErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"truncated length", "19"},
+		{"truncated 8 byte length", "1b0000"},
+		{"truncated byte string", "430102"},
+		{"truncated text string", "636162"},
+		{"truncated array", "830102"},
+		{"truncated map", "a20102"},
+		{"map without value", "a101"},
+		{"huge byte string", "5bffffffffffffffff"},
+		{"huge array", "9bffffffffffffffff00"},
+		{"huge map", "bbffffffffffffffff0000"},
+		{"integer too big", "1bffffffffffffffff"},
+		{"negative integer too big", "3bffffffffffffffff"},
+		{"indefinite byte string", "5f4101ff"},
+		{"indefinite array", "9f01ff"},
+		{"reserved additional information", "1c"},
+		{"float", "fb3ff199999999999a"},
+		{"undefined simple value", "f0"},
+		{"tag", "c11a514b67b0"},
+		{"byte string map key", "a1410001"},
+		{"array map key", "a1800001"},
+	}
+	for _, test := range tests {
+		data, err := hex.DecodeString(test.data)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		_, _, err = decodeCBOR(data)
+		if err == nil {
+			t.Errorf("%s: decoded", test.name)
+		}
+	}
+}
+
+func TestDecodeCBORDepth(t *testing.T) {
+	nested := func(depth int) []byte {
+		return append(bytes.Repeat([]byte{0x81}, depth), 0x00)
+	}
+	_, _, err := decodeCBOR(nested(maxCBORDepth))
+	if err != nil {
+		t.Errorf("%d nested arrays: %v", maxCBORDepth, err)
+	}
+	_, _, err = decodeCBOR(nested(maxCBORDepth + 1))
+	if err == nil {
+		t.Errorf("%d nested arrays decoded", maxCBORDepth+1)
+	}
+	// Deep enough to overflow the stack without the limit
+	_, _, err = decodeCBOR(nested(1 << 20))
+	if err == nil {
+		t.Error("deeply nested arrays decoded")
+	}
+	_, _, err = decodeCBOR(append(bytes.Repeat([]byte{0xa1, 0x01}, maxCBORDepth+1), 0x00))
+	if err == nil {
+		t.Errorf("%d nested maps decoded", maxCBORDepth+1)
+	}
+}
+
+// Garbage must be refused with an error instead of a panic or a huge allocation
+func TestDecodeCBORGarbage(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	for range 100000 {
+		data := make([]byte, r.IntN(64))
+		for i := range data {
+			data[i] = byte(r.UintN(256))
+		}
+		value, rest, err := decodeCBOR(data)
+		if err == nil && len(rest) > len(data) {
+			t.Fatalf("%x: got rest %x longer than the data", data, rest)
+		}
+		if err != nil && (value != nil || rest != nil) {
+			t.Fatalf("%x: got value %v with error %v", data, value, err)
+		}
+	}
+}
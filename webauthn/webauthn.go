@@ -0,0 +1,271 @@
+// Package webauthn verifies the registration and authentication ceremonies of the passkeys.
+// It supports the ES256, EdDSA and RS256 keys used by the platform and roaming authenticators and
+// does not verify the attestation statements, the options ask for none since the gallery trusts any authenticator.
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithms of the supported keys in order of preference
+const (
+	AlgES256 int64 = -7
+	AlgEdDSA int64 = -8
+	AlgRS256 int64 = -257
+)
+
+var Algorithms = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+// Flags of the authenticator data
+const (
+	flagUserPresent       byte = 0x01
+	flagUserVerified      byte = 0x04
+	flagAttestedData      byte = 0x40
+	authenticatorDataSize int  = 37
+)
+
+// Credential is a public key credential created by an authenticator
+type Credential struct {
+	ID []byte
+	// COSE_Key encoded public key
+	PublicKey []byte
+	SignCount uint32
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	// Only present in the registration
+	credentialID []byte
+	publicKey    []byte
+}
+
+// NewChallenge returns a random base64url encoded challenge for a ceremony
+func NewChallenge() string {
+	b := make([]byte, 32)
+	// Ignore the error since it cannot fail. See source for more details
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// VerifyRegistration checks the response of navigator.credentials.create to the challenge and returns the new credential.
+// The user must have been verified by the authenticator.
+func VerifyRegistration(rpID string, origin string, challenge string, clientDataJSON []byte, attestationObject []byte) (Credential, error) {
+	err := verifyClientData(clientDataJSON, "webauthn.create", origin, challenge)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	value, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return Credential{}, fmt.Errorf("error decoding attestation object. %w", err)
+	}
+	attestation, ok := value.(map[any]any)
+	if !ok {
+		return Credential{}, errors.New("attestation object is not a map")
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return Credential{}, errors.New("attestation object without authenticator data")
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return Credential{}, err
+	}
+	err = verifyAuthenticatorData(authData, rpID)
+	if err != nil {
+		return Credential{}, err
+	}
+	if authData.flags&flagAttestedData == 0 {
+		return Credential{}, errors.New("authenticator data without credential")
+	}
+	// Reject the keys that could not be used to log in
+	_, err = parsePublicKey(authData.publicKey)
+	if err != nil {
+		return Credential{}, err
+	}
+	return Credential{ID: authData.credentialID, PublicKey: authData.publicKey, SignCount: authData.signCount}, nil
+}
+
+// VerifyAssertion checks the response of navigator.credentials.get to the challenge with the public key of the credential
+// and returns the new signature counter. The user must have been verified by the authenticator.
+func VerifyAssertion(rpID string, origin string, challenge string, publicKey []byte, signCount uint32, clientDataJSON []byte, rawAuthData []byte, signature []byte) (uint32, error) {
+	err := verifyClientData(clientDataJSON, "webauthn.get", origin, challenge)
+	if err != nil {
+		return 0, err
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+	err = verifyAuthenticatorData(authData, rpID)
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(bytes.Clone(rawAuthData), clientDataHash[:]...)
+	if !verifySignature(key, signed, signature) {
+		return 0, errors.New("invalid signature")
+	}
+
+	// A counter that does not increase means the authenticator was cloned, the ones that do not count always send zero
+	if (authData.signCount != 0 || signCount != 0) && authData.signCount <= signCount {
+		return 0, errors.New("signature counter did not increase")
+	}
+	return authData.signCount, nil
+}
+
+func verifyClientData(clientDataJSON []byte, ceremony string, origin string, challenge string) error {
+	var data clientData
+	err := json.Unmarshal(clientDataJSON, &data)
+	if err != nil {
+		return fmt.Errorf("error decoding client data. %w", err)
+	}
+	if data.Type != ceremony {
+		return fmt.Errorf("client data of %s instead of %s", data.Type, ceremony)
+	}
+	if subtle.ConstantTimeCompare([]byte(data.Challenge), []byte(challenge)) != 1 {
+		return errors.New("client data of another challenge")
+	}
+	if data.Origin != origin || data.CrossOrigin {
+		return fmt.Errorf("client data of origin %s instead of %s", data.Origin, origin)
+	}
+	return nil
+}
+
+func verifyAuthenticatorData(authData authenticatorData, rpID string) error {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(authData.rpIDHash, rpIDHash[:]) {
+		return errors.New("authenticator data of another relying party")
+	}
+	if authData.flags&flagUserPresent == 0 {
+		return errors.New("user not present")
+	}
+	if authData.flags&flagUserVerified == 0 {
+		return errors.New("user not verified")
+	}
+	return nil
+}
+
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	if len(data) < authenticatorDataSize {
+		return authenticatorData{}, errors.New("authenticator data too short")
+	}
+	authData := authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if authData.flags&flagAttestedData == 0 {
+		return authData, nil
+	}
+
+	// The attested credential data is the AAGUID, the length of the credential ID, the ID and the COSE key
+	rest := data[authenticatorDataSize:]
+	if len(rest) < 18 {
+		return authenticatorData{}, errors.New("attested credential data too short")
+	}
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLength == 0 || len(rest) < idLength {
+		return authenticatorData{}, errors.New("invalid credential ID")
+	}
+	authData.credentialID = rest[:idLength]
+	rest = rest[idLength:]
+	_, extensions, err := decodeCBOR(rest)
+	if err != nil {
+		return authenticatorData{}, fmt.Errorf("error decoding credential public key. %w", err)
+	}
+	authData.publicKey = rest[:len(rest)-len(extensions)]
+	return authData, nil
+}
+
+// parsePublicKey returns the ECDSA, Ed25519 or RSA key of the COSE_Key
+func parsePublicKey(coseKey []byte) (crypto.PublicKey, error) {
+	value, _, err := decodeCBOR(coseKey)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding public key. %w", err)
+	}
+	key, ok := value.(map[any]any)
+	if !ok {
+		return nil, errors.New("public key is not a map")
+	}
+	// Labels of the COSE_Key parameters, the negative ones depend on the key type
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+	switch {
+	case kty == 2 && alg == AlgES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid P-256 public key")
+		}
+		point := append(append([]byte{4}, x...), y...)
+		publicKey, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+		if err != nil {
+			return nil, fmt.Errorf("invalid P-256 public key. %w", err)
+		}
+		return publicKey, nil
+	case kty == 1 && alg == AlgEdDSA:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key")
+		}
+		return ed25519.PublicKey(x), nil
+	case kty == 3 && alg == AlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA public key")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %d with algorithm %d", kty, alg)
+}
+
+func verifySignature(key crypto.PublicKey, signed []byte, signature []byte) bool {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(signed)
+		return ecdsa.VerifyASN1(key, hash[:], signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, signed, signature)
+	case *rsa.PublicKey:
+		hash := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil
+	}
+	return false
+}
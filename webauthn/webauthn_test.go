@@ -0,0 +1,298 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"testing"
+)
+
+const (
+	testRPID   = "photos.example.com"
+	testOrigin = "https://photos.example.com"
+)
+
+// authenticator signs the ceremonies with its key like a real one
+type authenticator struct {
+	alg    int64
+	signer crypto.Signer
+	id     []byte
+}
+
+func newAuthenticator(t *testing.T, alg int64) authenticator {
+	t.Helper()
+	var signer crypto.Signer
+	var err error
+	switch alg {
+	case AlgES256:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	case AlgRS256:
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return authenticator{alg: alg, signer: signer, id: id}
+}
+
+// coseKey returns the COSE_Key of the public key
+func (a authenticator) coseKey() []byte {
+	switch key := a.signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		key.X.FillBytes(x)
+		key.Y.FillBytes(y)
+		return cborMap(1, cborInt(2), 3, cborInt(AlgES256), -1, cborInt(1), -2, cborBytes(x), -3, cborBytes(y))
+	case ed25519.PublicKey:
+		return cborMap(1, cborInt(1), 3, cborInt(AlgEdDSA), -1, cborInt(6), -2, cborBytes(key))
+	case *rsa.PublicKey:
+		return cborMap(1, cborInt(3), 3, cborInt(AlgRS256), -1, cborBytes(key.N.Bytes()), -2, cborBytes(big.NewInt(int64(key.E)).Bytes()))
+	}
+	return nil
+}
+
+func (a authenticator) sign(t *testing.T, message []byte) []byte {
+	t.Helper()
+	var signature []byte
+	var err error
+	if a.alg == AlgEdDSA {
+		signature, err = a.signer.Sign(rand.Reader, message, crypto.Hash(0))
+	} else {
+		hash := sha256.Sum256(message)
+		signature, err = a.signer.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+// register returns the client data and the attestation object of the registration
+func (a authenticator) register(challenge string) ([]byte, []byte) {
+	authData := newAuthData(testRPID, flagUserPresent|flagUserVerified|flagAttestedData, 0)
+	authData = append(authData, make([]byte, 16)...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.id)))
+	authData = append(authData, a.id...)
+	authData = append(authData, a.coseKey()...)
+	attestation := cborMapText("fmt", cborText("none"), "attStmt", cborMap(), "authData", cborBytes(authData))
+	return newClientData("webauthn.create", challenge, testOrigin), attestation
+}
+
+// assert returns the client data, the authenticator data and the signature of the login
+func (a authenticator) assert(t *testing.T, challenge string, signCount uint32) ([]byte, []byte, []byte) {
+	clientDataJSON := newClientData("webauthn.get", challenge, testOrigin)
+	authData := newAuthData(testRPID, flagUserPresent|flagUserVerified, signCount)
+	hash := sha256.Sum256(clientDataJSON)
+	return clientDataJSON, authData, a.sign(t, append(bytes.Clone(authData), hash[:]...))
+}
+
+func newAuthData(rpID string, flags byte, signCount uint32) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	authData := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(authData, signCount)
+}
+
+func newClientData(ceremony string, challenge string, origin string) []byte {
+	b, _ := json.Marshal(clientData{Type: ceremony, Challenge: challenge, Origin: origin})
+	return b
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 1<<8:
+		return []byte{major<<5 | 24, byte(n)}
+	case n < 1<<16:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	}
+	return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+}
+
+func cborInt(i int64) []byte {
+	if i < 0 {
+		return cborHead(1, uint64(-1-i))
+	}
+	return cborHead(0, uint64(i))
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, uint64(len(b))), b...)
+}
+
+func cborText(s string) []byte {
+	return append(cborHead(3, uint64(len(s))), s...)
+}
+
+// cborMap encodes the integer labels followed by their encoded values
+func cborMap(pairs ...any) []byte {
+	b := cborHead(5, uint64(len(pairs)/2))
+	for i := 0; i < len(pairs); i += 2 {
+		b = append(b, cborInt(int64(pairs[i].(int)))...)
+		b = append(b, pairs[i+1].([]byte)...)
+	}
+	return b
+}
+
+// cborMapText encodes the text keys followed by their encoded values
+func cborMapText(pairs ...any) []byte {
+	b := cborHead(5, uint64(len(pairs)/2))
+	for i := 0; i < len(pairs); i += 2 {
+		b = append(b, cborText(pairs[i].(string))...)
+		b = append(b, pairs[i+1].([]byte)...)
+	}
+	return b
+}
+
+func TestCeremonies(t *testing.T) {
+	for _, alg := range Algorithms {
+		a := newAuthenticator(t, alg)
+		challenge := NewChallenge()
+		clientDataJSON, attestationObject := a.register(challenge)
+		credential, err := VerifyRegistration(testRPID, testOrigin, challenge, clientDataJSON, attestationObject)
+		if err != nil {
+			t.Errorf("algorithm %d: registration: %v", alg, err)
+			continue
+		}
+		if !bytes.Equal(credential.ID, a.id) || !bytes.Equal(credential.PublicKey, a.coseKey()) {
+			t.Errorf("algorithm %d: got credential %x with key %x", alg, credential.ID, credential.PublicKey)
+		}
+
+		challenge = NewChallenge()
+		clientDataJSON, authData, signature := a.assert(t, challenge, 1)
+		signCount, err := VerifyAssertion(testRPID, testOrigin, challenge, credential.PublicKey, credential.SignCount, clientDataJSON, authData, signature)
+		if err != nil {
+			t.Errorf("algorithm %d: assertion: %v", alg, err)
+		}
+		if signCount != 1 {
+			t.Errorf("algorithm %d: got signature counter %d, want 1", alg, signCount)
+		}
+	}
+}
+
+func TestVerifyAssertionErrors(t *testing.T) {
+	a := newAuthenticator(t, AlgES256)
+	other := newAuthenticator(t, AlgES256)
+	challenge := NewChallenge()
+	clientDataJSON, authData, signature := a.assert(t, challenge, 5)
+	sign := func(clientDataJSON []byte, authData []byte) []byte {
+		hash := sha256.Sum256(clientDataJSON)
+		return a.sign(t, append(bytes.Clone(authData), hash[:]...))
+	}
+	withClientData := func(clientDataJSON []byte) [3][]byte {
+		return [3][]byte{clientDataJSON, authData, sign(clientDataJSON, authData)}
+	}
+	withAuthData := func(authData []byte) [3][]byte {
+		return [3][]byte{clientDataJSON, authData, sign(clientDataJSON, authData)}
+	}
+	tampered := bytes.Clone(signature)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name      string
+		response  [3][]byte
+		publicKey []byte
+		signCount uint32
+	}{
+		{"another challenge", withClientData(newClientData("webauthn.get", NewChallenge(), testOrigin)), a.coseKey(), 0},
+		{"another origin", withClientData(newClientData("webauthn.get", challenge, "https://evil.example.com")), a.coseKey(), 0},
+		{"registration client data", withClientData(newClientData("webauthn.create", challenge, testOrigin)), a.coseKey(), 0},
+		{"cross origin", withClientData([]byte(`{"type":"webauthn.get","challenge":"` + challenge + `","origin":"` + testOrigin + `","crossOrigin":true}`)), a.coseKey(), 0},
+		{"invalid client data", withClientData([]byte("{")), a.coseKey(), 0},
+		{"another relying party", withAuthData(newAuthData("evil.example.com", flagUserPresent|flagUserVerified, 5)), a.coseKey(), 0},
+		{"user not present", withAuthData(newAuthData(testRPID, flagUserVerified, 5)), a.coseKey(), 0},
+		{"user not verified", withAuthData(newAuthData(testRPID, flagUserPresent, 5)), a.coseKey(), 0},
+		{"short authenticator data", withAuthData(authData[:authenticatorDataSize-1]), a.coseKey(), 0},
+		{"tampered signature", [3][]byte{clientDataJSON, authData, tampered}, a.coseKey(), 0},
+		{"empty signature", [3][]byte{clientDataJSON, authData, nil}, a.coseKey(), 0},
+		{"key of another authenticator", [3][]byte{clientDataJSON, authData, signature}, other.coseKey(), 0},
+		{"counter not increased", [3][]byte{clientDataJSON, authData, signature}, a.coseKey(), 5},
+		{"counter decreased", [3][]byte{clientDataJSON, authData, signature}, a.coseKey(), 6},
+		{"counter reset", withAuthData(newAuthData(testRPID, flagUserPresent|flagUserVerified, 0)), a.coseKey(), 5},
+		{"invalid public key", [3][]byte{clientDataJSON, authData, signature}, []byte{0xa1}, 0},
+	}
+	for _, test := range tests {
+		_, err := VerifyAssertion(testRPID, testOrigin, challenge, test.publicKey, test.signCount, test.response[0], test.response[1], test.response[2])
+		if err == nil {
+			t.Errorf("%s: verified", test.name)
+		}
+	}
+
+	// The authenticators that do not count always send zero
+	clientDataJSON, authData, signature = a.assert(t, challenge, 0)
+	_, err := VerifyAssertion(testRPID, testOrigin, challenge, a.coseKey(), 0, clientDataJSON, authData, signature)
+	if err != nil {
+		t.Errorf("authenticator without counter: %v", err)
+	}
+}
+
+func TestVerifyRegistrationErrors(t *testing.T) {
+	a := newAuthenticator(t, AlgES256)
+	challenge := NewChallenge()
+	clientDataJSON, attestationObject := a.register(challenge)
+	withAuthData := func(authData []byte) []byte {
+		return cborMapText("fmt", cborText("none"), "attStmt", cborMap(), "authData", cborBytes(authData))
+	}
+	withKey := func(coseKey []byte) []byte {
+		authData := newAuthData(testRPID, flagUserPresent|flagUserVerified|flagAttestedData, 0)
+		authData = append(authData, make([]byte, 16)...)
+		authData = binary.BigEndian.AppendUint16(authData, 1)
+		authData = append(authData, 1)
+		return withAuthData(append(authData, coseKey...))
+	}
+	smallRSA, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := make([]byte, 32)
+	x[31] = 1
+
+	tests := []struct {
+		name              string
+		clientDataJSON    []byte
+		attestationObject []byte
+	}{
+		{"another challenge", newClientData("webauthn.create", NewChallenge(), testOrigin), attestationObject},
+		{"login client data", newClientData("webauthn.get", challenge, testOrigin), attestationObject},
+		{"attestation object is not a map", clientDataJSON, cborBytes([]byte{1})},
+		{"without authenticator data", clientDataJSON, cborMapText("fmt", cborText("none"))},
+		{"without credential", clientDataJSON, withAuthData(newAuthData(testRPID, flagUserPresent|flagUserVerified, 0))},
+		{"user not verified", clientDataJSON, withAuthData(newAuthData(testRPID, flagUserPresent|flagAttestedData, 0))},
+		{"short attested credential data", clientDataJSON, withAuthData(append(newAuthData(testRPID, flagUserPresent|flagUserVerified|flagAttestedData, 0), make([]byte, 17)...))},
+		{"credential ID longer than the data", clientDataJSON, withAuthData(append(newAuthData(testRPID, flagUserPresent|flagUserVerified|flagAttestedData, 0), append(make([]byte, 16), 0xff, 0xff, 1)...))},
+		{"empty credential ID", clientDataJSON, withAuthData(append(newAuthData(testRPID, flagUserPresent|flagUserVerified|flagAttestedData, 0), make([]byte, 18)...))},
+		{"unsupported algorithm", clientDataJSON, withKey(cborMap(1, cborInt(2), 3, cborInt(-35), -1, cborInt(2), -2, cborBytes(x), -3, cborBytes(x)))},
+		{"mismatched key type", clientDataJSON, withKey(cborMap(1, cborInt(1), 3, cborInt(AlgES256), -1, cborInt(1), -2, cborBytes(x), -3, cborBytes(x)))},
+		{"point not on the curve", clientDataJSON, withKey(cborMap(1, cborInt(2), 3, cborInt(AlgES256), -1, cborInt(1), -2, cborBytes(x), -3, cborBytes(x)))},
+		{"short Ed25519 key", clientDataJSON, withKey(cborMap(1, cborInt(1), 3, cborInt(AlgEdDSA), -1, cborInt(6), -2, cborBytes(x[:31])))},
+		{"small RSA key", clientDataJSON, withKey(cborMap(1, cborInt(3), 3, cborInt(AlgRS256), -1, cborBytes(smallRSA.N.Bytes()), -2, cborBytes([]byte{1, 0, 1})))},
+		{"key is not a map", clientDataJSON, withKey(cborBytes(x))},
+		{"truncated key", clientDataJSON, withKey(a.coseKey()[:10])},
+	}
+	for _, test := range tests {
+		_, err := VerifyRegistration(testRPID, testOrigin, challenge, test.clientDataJSON, test.attestationObject)
+		if err == nil {
+			t.Errorf("%s: verified", test.name)
+		}
+	}
+
+	// Every truncation of a valid attestation object must be refused with an error
+	for i := range len(attestationObject) {
+		_, err := VerifyRegistration(testRPID, testOrigin, challenge, clientDataJSON, attestationObject[:i])
+		if err == nil {
+			t.Errorf("attestation object truncated to %d bytes verified", i)
+		}
+	}
+}